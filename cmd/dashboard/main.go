@@ -16,6 +16,10 @@ var (
 	logLevel     = types.EnvDefault("LOG_LEVEL", "info").String()
 	logFile      = types.EnvDefault("LOG_FILE", "dashboard.log").String()
 	trafficsFile = types.EnvDefault("TRAFFICS_FILE", "traffics.log").String()
+
+	rejectionsFile = types.EnvDefault("REJECTIONS_FILE", "rejections.log").String()
+	lockoutsFile   = types.EnvDefault("LOCKOUTS_FILE", "lockouts.log").String()
+	failuresFile   = types.EnvDefault("FAILURES_FILE", "failures.log").String()
 )
 
 func main() {
@@ -26,7 +30,19 @@ func main() {
 	s := dashboard.NewStatistician(trafficsFile, storage)
 	go s.Run()
 
-	handler := dashboard.NewHandler(storage)
+	rejections := dashboard.NewStaticStorage()
+	rs := dashboard.NewStatistician(rejectionsFile, rejections)
+	go rs.Run()
+
+	lockouts := dashboard.NewStaticStorage()
+	ls := dashboard.NewStatistician(lockoutsFile, lockouts)
+	go ls.Run()
+
+	failures := dashboard.NewStaticStorage()
+	fs := dashboard.NewStatistician(failuresFile, failures)
+	go fs.Run()
+
+	handler := dashboard.NewHandler(storage, rejections, lockouts, failures)
 	go handler.Serve(fmt.Sprintf(":%d", httpPort))
 
 	waitSignal(syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT)
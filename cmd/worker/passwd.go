@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const passwdUsage = `usage: worker passwd [-f file] [-a algorithm] add|remove|rotate user
+
+  add     添加用户，用户已存在时失败
+  remove  删除用户
+  rotate  修改已存在用户的密码
+
+密码从标准输入的第一行读取，如 echo -n secret | worker passwd add alice
+`
+
+// passwd 管理 htpasswd 格式的用户名密码哈希文件
+func passwd(args []string) error {
+	flags := flag.NewFlagSet("passwd", flag.ContinueOnError)
+	flags.Usage = func() { fmt.Fprint(flags.Output(), passwdUsage); flags.PrintDefaults() }
+	file := flags.String("f", credentialsFileOrDefault(), "htpasswd file")
+	algorithm := flags.String("a", proxy.HashBcrypt, "hash algorithm: bcrypt, argon2id, sha256 or sha512")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 2 {
+		flags.Usage()
+		return fmt.Errorf("expected action and user")
+	}
+	action, user := flags.Arg(0), flags.Arg(1)
+
+	store, err := proxy.LoadHtpasswd(*file)
+	if os.IsNotExist(err) {
+		store, err = proxy.NewHtpasswd(), nil
+	}
+	if err != nil {
+		return err
+	}
+
+	switch action {
+	case "add", "rotate":
+		if action == "add" && store.Has(user) {
+			return fmt.Errorf("user %s already exists", user)
+		}
+		if action == "rotate" && !store.Has(user) {
+			return fmt.Errorf("user %s not found", user)
+		}
+		password, err := readPassword()
+		if err != nil {
+			return err
+		}
+		hashed, err := proxy.HashPassword(*algorithm, password)
+		if err != nil {
+			return err
+		}
+		if err := store.Set(user, hashed); err != nil {
+			return err
+		}
+	case "remove":
+		if !store.Has(user) {
+			return fmt.Errorf("user %s not found", user)
+		}
+		store.Delete(user)
+	default:
+		flags.Usage()
+		return fmt.Errorf("unknown action: %s", action)
+	}
+
+	return writeHtpasswd(*file, store)
+}
+
+func credentialsFileOrDefault() string {
+	if credentialsFile != "" {
+		return credentialsFile
+	}
+	return "htpasswd"
+}
+
+// readPassword 从标准输入读取密码
+func readPassword() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	password := strings.TrimRight(line, "\r\n")
+	if password == "" {
+		if err != nil {
+			return "", fmt.Errorf("read password from stdin: %v", err)
+		}
+		return "", fmt.Errorf("empty password")
+	}
+	return password, nil
+}
+
+// writeHtpasswd 先写入临时文件再替换，避免运行中的 worker 读取到不完整的文件
+func writeHtpasswd(file string, store *proxy.HtpasswdCredentials) error {
+	tmp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := store.WriteTo(tmp); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
@@ -4,7 +4,9 @@ go 1.18
 
 require (
 	github.com/sirupsen/logrus v1.9.0
+	golang.org/x/crypto v0.0.0-20220525230936-793ad666bf5e
 	golang.org/x/net v0.0.0-20220722155237-a158d28d115b
+	golang.org/x/sync v0.0.0-20220907140024-f12130a52804
 )
 
 require (
@@ -9,11 +9,14 @@ import (
 )
 
 type Handler struct {
-	storage Storage
+	storage    Storage
+	rejections Storage
+	lockouts   Storage
+	failures   Storage
 }
 
-func NewHandler(storage Storage) *Handler {
-	return &Handler{storage}
+func NewHandler(storage Storage, rejections Storage, lockouts Storage, failures Storage) *Handler {
+	return &Handler{storage, rejections, lockouts, failures}
 }
 
 func (h *Handler) Serve(addr string) {
@@ -22,6 +25,9 @@ func (h *Handler) Serve(addr string) {
 	http.Handle("/", http.StripPrefix("/", statics))
 
 	http.HandleFunc("/api/traffics", h.listTraffics)
+	http.HandleFunc("/api/rejections", h.listRejections)
+	http.HandleFunc("/api/lockouts", h.listLockouts)
+	http.HandleFunc("/api/failures", h.listFailures)
 
 	if err := http.ListenAndServe(addr, nil); err != nil {
 		log.WithError(err).Fatalf("listen http failed: %s", addr)
@@ -41,3 +47,48 @@ func (h *Handler) listTraffics(w http.ResponseWriter, r *http.Request) {
 	bytes, _ := json.Marshal(records)
 	w.Write(bytes)
 }
+
+// listRejections 列出最近 7 天因连接数限制被拒绝的请求次数
+// identifier 为用户名，匿名用户为来源 IP
+func (h *Handler) listRejections(w http.ResponseWriter, r *http.Request) {
+	identifier := r.URL.Query().Get("identifier")
+	records, err := h.rejections.List(identifier, time.Minute, time.Now().Add(-7*24*time.Hour), time.Now())
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	bytes, _ := json.Marshal(records)
+	w.Write(bytes)
+}
+
+// listLockouts 列出最近 7 天因鉴权失败次数过多被锁定的次数
+// identifier 为用户名或来源 IP
+func (h *Handler) listLockouts(w http.ResponseWriter, r *http.Request) {
+	identifier := r.URL.Query().Get("identifier")
+	records, err := h.lockouts.List(identifier, time.Minute, time.Now().Add(-7*24*time.Hour), time.Now())
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	bytes, _ := json.Marshal(records)
+	w.Write(bytes)
+}
+
+// listFailures 列出最近 7 天连接目标失败的次数
+// identifier 为失败原因，如 connection_refused、ttl_expired、host_unreachable
+func (h *Handler) listFailures(w http.ResponseWriter, r *http.Request) {
+	identifier := r.URL.Query().Get("identifier")
+	records, err := h.failures.List(identifier, time.Minute, time.Now().Add(-7*24*time.Hour), time.Now())
+	if err != nil {
+		w.WriteHeader(500)
+		return
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	bytes, _ := json.Marshal(records)
+	w.Write(bytes)
+}
@@ -42,6 +42,8 @@ type TrafficsReporter struct {
 	interval time.Duration      // 上报流量间隔
 	traffics chan trafficsEntry // 上报流量管道
 	writer   io.WriteCloser
+	closing  chan struct{} // 通知停止采集
+	closed   chan struct{} // 剩余流量已写入
 }
 
 func NewTrafficsReporter(interval time.Duration, filePath string) (*TrafficsReporter, error) {
@@ -54,6 +56,8 @@ func NewTrafficsReporter(interval time.Duration, filePath string) (*TrafficsRepo
 		interval: interval,
 		traffics: make(chan trafficsEntry, trafficsReportBufSize),
 		writer:   w,
+		closing:  make(chan struct{}),
+		closed:   make(chan struct{}),
 	}
 
 	go c.run()
@@ -74,30 +78,48 @@ func (c *TrafficsReporter) Report(identifier string, bytes int64) error {
 	return nil
 }
 
+// Close 停止采集，写入剩余流量后关闭文件，仅可调用一次
 func (c *TrafficsReporter) Close() error {
+	close(c.closing)
+	<-c.closed
 	return c.writer.Close()
 }
 
 func (c *TrafficsReporter) run() {
+	defer close(c.closed)
+
 	currentPeriod := c.getPeriod(time.Now())    // 当前上报阶段
 	currentTraffics := make(trafficsCollection) // 当前上报阶段流量
+	flush := func() {
+		currentTraffics.Range(func(identifier string, bytes int64) {
+			if bytes > 0 {
+				c.logTraffics(currentPeriod, identifier, bytes)
+			}
+		})
+		currentTraffics.Reset()
+	}
+
 	for {
 		select {
 		case traffic := <-c.traffics:
 			period := c.getPeriod(time.Now())
-			if period == currentPeriod {
-				// 累计当前阶段流量
-				currentTraffics.Add(traffic.identifier, traffic.bytes)
-			} else {
+			if period != currentPeriod {
 				// 下一阶段流量到来了，开始上报当前阶段流量
-				currentTraffics.Range(func(identifier string, bytes int64) {
-					if bytes > 0 {
-						c.logTraffics(currentPeriod, identifier, bytes)
-					}
-				})
-
+				flush()
 				currentPeriod = period
-				currentTraffics.Reset()
+			}
+			// 累计当前阶段流量
+			currentTraffics.Add(traffic.identifier, traffic.bytes)
+		case <-c.closing:
+			// 停止采集，累计管道中剩余的流量并上报
+			for {
+				select {
+				case traffic := <-c.traffics:
+					currentTraffics.Add(traffic.identifier, traffic.bytes)
+				default:
+					flush()
+					return
+				}
 			}
 		}
 	}
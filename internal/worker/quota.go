@@ -0,0 +1,40 @@
+package worker
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/liamylian/lsocks/internal"
+	"github.com/liamylian/lsocks/pkg/log"
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+// loadQuotaUsage 从本月的流量记录中统计已使用的流量，使重启后配额继续生效
+func loadQuotaUsage(quota *proxy.QuotaEnforcer, trafficsFile string) {
+	files, err := internal.ListTrafficsFiles(filepath.Dir(trafficsFile), filepath.Base(trafficsFile))
+	if err != nil {
+		log.WithError(err).Warnf("list traffics files failed, quota usage starts from zero: file=%s", trafficsFile)
+		return
+	}
+
+	// 流量记录文件按天轮转，文件名如 traffics-20230215.log
+	month := "-" + time.Now().Format("200601")
+	for _, file := range files {
+		if !strings.Contains(filepath.Base(file), month) {
+			continue
+		}
+		scanner, err := internal.NewTrafficsScanner(file)
+		if err != nil {
+			log.WithError(err).Warnf("open traffics file failed: file=%s", file)
+			continue
+		}
+		err = scanner.Scan(context.Background(), func(t time.Time, identifier string, bytes int64) {
+			quota.Add(identifier, t, bytes)
+		})
+		if err != nil {
+			log.WithError(err).Warnf("scan traffics file failed: file=%s", file)
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package worker
+
+import (
+	"os"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/log"
+	"github.com/liamylian/lsocks/pkg/proxy"
+	"github.com/liamylian/lsocks/pkg/proxy/socks5"
+)
+
+// Reload 重新加载用户名密码、访问控制规则、地址重写规则和 hosts 文件，加载失败时保留原配置，已建立的连接不受影响
+func (s *Worker) Reload() error {
+	var firstErr error
+	if s.credentials != nil {
+		if err := s.reloadCredentials(); err != nil {
+			firstErr = err
+		}
+	}
+	if s.rules != nil {
+		if err := s.reloadACL(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.rewriter != nil {
+		if err := s.reloadRewriter(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if s.hosts != nil {
+		if err := s.reloadHosts(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func (s *Worker) reloadCredentials() error {
+	if s.accountsFile != "" {
+		return s.reloadAccounts()
+	}
+
+	store, users, err := proxy.LoadCredentialsFile(s.credentialsFile)
+	if err != nil {
+		log.WithError(err).Errorf("reload credentials failed, keeping previous: file=%s", s.credentialsFile)
+		return err
+	}
+	s.credentials.Store(store)
+	log.Infof("reload credentials: file=%s, users=%d", s.credentialsFile, users)
+	return nil
+}
+
+func (s *Worker) reloadAccounts() error {
+	accounts, err := proxy.LoadAccounts(s.accountsFile)
+	if err != nil {
+		log.WithError(err).Errorf("reload accounts failed, keeping previous: file=%s", s.accountsFile)
+		return err
+	}
+	s.credentials.Store(accounts)
+	s.quota.SetQuotas(accounts.Quotas())
+	log.Infof("reload accounts: file=%s, users=%d", s.accountsFile, accounts.Len())
+	return nil
+}
+
+// credentialsPath 当前使用的用户名密码文件
+func (s *Worker) credentialsPath() string {
+	if s.accountsFile != "" {
+		return s.accountsFile
+	}
+	return s.credentialsFile
+}
+
+func (s *Worker) reloadACL() error {
+	acl, err := socks5.LoadACL(s.aclFile)
+	if err != nil {
+		log.WithError(err).Errorf("reload acl failed, keeping previous: file=%s", s.aclFile)
+		return err
+	}
+	s.rules.Store(acl)
+	log.Infof("reload acl: file=%s", s.aclFile)
+	return nil
+}
+
+func (s *Worker) reloadRewriter() error {
+	rewriter, err := socks5.LoadRewriter(s.rewriteFile)
+	if err != nil {
+		log.WithError(err).Errorf("reload rewrite failed, keeping previous: file=%s", s.rewriteFile)
+		return err
+	}
+	s.rewriter.Store(rewriter)
+	log.Infof("reload rewrite: file=%s, rules=%d", s.rewriteFile, rewriter.Len())
+	return nil
+}
+
+func (s *Worker) reloadHosts() error {
+	hosts, err := proxy.LoadHosts(s.hostsFile)
+	if err != nil {
+		log.WithError(err).Errorf("reload hosts failed, keeping previous: file=%s", s.hostsFile)
+		return err
+	}
+	s.hosts.Store(hosts)
+	log.Infof("reload hosts: file=%s, entries=%d", s.hostsFile, hosts.Len())
+	return nil
+}
+
+// fileStamp 用于判断文件是否变化
+type fileStamp struct {
+	modTime int64
+	size    int64
+}
+
+func statFile(file string) fileStamp {
+	info, err := os.Stat(file)
+	if err != nil {
+		return fileStamp{}
+	}
+	return fileStamp{modTime: info.ModTime().UnixNano(), size: info.Size()}
+}
+
+// watch 定期检查文件是否变化，变化时重新加载
+func (s *Worker) watch(interval time.Duration) {
+	credentialsStamp, aclStamp, hostsStamp := statFile(s.credentialsPath()), statFile(s.aclFile), statFile(s.hostsFile)
+	rewriteStamp := statFile(s.rewriteFile)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+		}
+
+		if s.credentials != nil {
+			if stamp := statFile(s.credentialsPath()); stamp != credentialsStamp {
+				credentialsStamp = stamp
+				_ = s.reloadCredentials()
+			}
+		}
+		if s.rules != nil {
+			if stamp := statFile(s.aclFile); stamp != aclStamp {
+				aclStamp = stamp
+				_ = s.reloadACL()
+			}
+		}
+		if s.rewriter != nil {
+			if stamp := statFile(s.rewriteFile); stamp != rewriteStamp {
+				rewriteStamp = stamp
+				_ = s.reloadRewriter()
+			}
+		}
+		if s.hosts != nil {
+			if stamp := statFile(s.hostsFile); stamp != hostsStamp {
+				hostsStamp = stamp
+				_ = s.reloadHosts()
+			}
+		}
+	}
+}
@@ -0,0 +1,194 @@
+package worker
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+	"github.com/liamylian/lsocks/pkg/proxy/socks5"
+)
+
+func writeFile(t *testing.T, file, data string) {
+	t.Helper()
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newReloadWorker(t *testing.T, credentialsFile, aclFile string) *Worker {
+	store, _, err := proxy.LoadCredentialsFile(credentialsFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := socks5.LoadACL(aclFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Worker{
+		credentialsFile: credentialsFile,
+		aclFile:         aclFile,
+		credentials:     proxy.NewReloadableCredentials(store),
+		rules:           socks5.NewReloadableRuleSet(acl),
+		done:            make(chan struct{}),
+	}
+}
+
+func allowPort(w *Worker, port int) bool {
+	req := &socks5.Request{Command: socks5.CommandConnect, DestAddr: &socks5.AddrSpec{IP: net.ParseIP("8.8.8.8"), Port: port}}
+	_, allow := w.rules.Allow(context.Background(), req)
+	return allow
+}
+
+func TestReloadKeepsPrevious(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile, aclFile := filepath.Join(dir, "credentials"), filepath.Join(dir, "acl.json")
+	writeFile(t, credentialsFile, "alice:secret\n")
+	writeFile(t, aclFile, `{"rules": [{"action": "allow", "ports": ["80"]}]}`)
+	w := newReloadWorker(t, credentialsFile, aclFile)
+
+	// 解析失败时保留原配置
+	writeFile(t, credentialsFile, "alice\n")
+	writeFile(t, aclFile, `{"rules": [{"action": "maybe"}]}`)
+	if err := w.Reload(); err == nil {
+		t.Fatal("expected reload error")
+	}
+	if !w.credentials.Valid("alice", "secret") {
+		t.Error("expected previous credentials to be kept")
+	}
+	if !allowPort(w, 80) {
+		t.Error("expected previous acl to be kept")
+	}
+
+	writeFile(t, credentialsFile, "bob:secret\n")
+	writeFile(t, aclFile, `{"rules": [{"action": "allow", "ports": ["443"]}]}`)
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if w.credentials.Valid("alice", "secret") || !w.credentials.Valid("bob", "secret") {
+		t.Error("expected credentials to be replaced")
+	}
+	if allowPort(w, 80) || !allowPort(w, 443) {
+		t.Error("expected acl to be replaced")
+	}
+}
+
+func TestReloadAccounts(t *testing.T) {
+	hashed, err := proxy.HashPassword(proxy.HashSHA256, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	writeFile(t, file, `[
+		{"username": "alice", "password": "`+hashed+`", "daily_quota": 100},
+		{"username": "bob", "password": "`+hashed+`"}
+	]`)
+	accounts, err := proxy.LoadAccounts(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := &Worker{
+		accountsFile: file,
+		credentials:  proxy.NewReloadableCredentials(accounts),
+		quota:        proxy.NewQuotaEnforcer(accounts.Quotas()),
+	}
+	w.quota.Add("alice", time.Now(), 150)
+	if !w.quota.Exceeded("alice") {
+		t.Fatal("expected alice to exceed quota")
+	}
+
+	writeFile(t, file, `[
+		{"username": "alice", "password": "`+hashed+`", "daily_quota": 200}
+	]`)
+	if err := w.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	// 配额替换，已统计的流量保留
+	if w.quota.Exceeded("alice") {
+		t.Error("expected raised quota to take effect")
+	}
+	if daily, _ := w.quota.Usage("alice"); daily != 150 {
+		t.Errorf("expected usage 150 to be kept, got %d", daily)
+	}
+	if w.credentials.UserActive("bob") || w.credentials.Valid("bob", "secret") {
+		t.Error("expected removed account to be inactive")
+	}
+
+	writeFile(t, file, `[{"username": "alice", "password": "plaintext"}]`)
+	if err := w.Reload(); err == nil {
+		t.Fatal("expected reload error")
+	}
+	if !w.credentials.Valid("alice", "secret") {
+		t.Error("expected previous accounts to be kept")
+	}
+	w.quota.Add("alice", time.Now(), 100)
+	if !w.quota.Exceeded("alice") {
+		t.Error("expected previous quota to be kept")
+	}
+}
+
+func TestWatch(t *testing.T) {
+	dir := t.TempDir()
+	credentialsFile, aclFile := filepath.Join(dir, "credentials"), filepath.Join(dir, "acl.json")
+	writeFile(t, credentialsFile, "alice:secret1\n")
+	writeFile(t, aclFile, `{"default": "allow"}`)
+	modTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(credentialsFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	w := newReloadWorker(t, credentialsFile, aclFile)
+	go w.watch(10 * time.Millisecond)
+	defer close(w.done)
+
+	// 修改时间和大小都不变时不重新加载
+	writeFile(t, credentialsFile, "alice:secret2\n")
+	if err := os.Chtimes(credentialsFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if !w.credentials.Valid("alice", "secret1") {
+		t.Fatal("expected unchanged stamp to skip reload")
+	}
+
+	modTime = modTime.Add(time.Minute)
+	if err := os.Chtimes(credentialsFile, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, func() bool { return w.credentials.Valid("alice", "secret2") })
+
+	// 文件内容错误时保留原配置，修正后重新加载
+	writeFile(t, credentialsFile, "alice\n")
+	time.Sleep(100 * time.Millisecond)
+	if !w.credentials.Valid("alice", "secret2") {
+		t.Fatal("expected previous credentials to be kept")
+	}
+	writeFile(t, credentialsFile, "bob:secret3\n")
+	waitFor(t, func() bool { return w.credentials.Valid("bob", "secret3") })
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out waiting for reload")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestShutdownTwice(t *testing.T) {
+	w, err := NewWorker(&Config{TrafficsFile: filepath.Join(t.TempDir(), "traffics.log"), ReloadInterval: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -1,7 +1,10 @@
 package worker
 
 import (
+	"context"
 	"fmt"
+	"net/http"
+	"sync"
 	"time"
 
 	"github.com/liamylian/lsocks/internal"
@@ -10,40 +13,457 @@ import (
 	"github.com/liamylian/lsocks/pkg/proxy/socks5"
 )
 
+// Config 工作节点配置
+type Config struct {
+	// Port 监听端口
+	Port int
+
+	// Credentials 用户名密码鉴权配置，为空时无需鉴权
+	Credentials proxy.CredentialStore
+
+	// TrafficsFile 流量记录文件
+	TrafficsFile string
+
+	// Dialer 出站拨号器，为空时直接拨号
+	Dialer proxy.Dialer
+
+	// HandshakeTimeout 握手超时时间，为 0 时使用默认值
+	HandshakeTimeout time.Duration
+
+	// DialTimeout 连接目标超时时间，为 0 时使用默认值
+	DialTimeout time.Duration
+
+	// IdleTimeout 隧道空闲超时时间，为 0 时不限制
+	IdleTimeout time.Duration
+
+	// MaxLifetime 隧道最长存活时间，为 0 时不限制
+	MaxLifetime time.Duration
+
+	// MaxConns 最大连接数，为 0 时不限制
+	MaxConns int
+
+	// MaxConnsPerUser 每个用户最大连接数，为 0 时不限制
+	MaxConnsPerUser int
+
+	// MaxConnsPerIP 每个来源 IP 最大连接数，为 0 时不限制
+	MaxConnsPerIP int
+
+	// RejectionsFile 被拒绝请求次数记录文件，为空时不记录
+	RejectionsFile string
+
+	// SourceIdentities 按来源地址鉴权，键为 CIDR 或 IP，值为用户标识，匹配的客户端无需用户名密码
+	SourceIdentities map[string]string
+
+	// Socks4UserIdentifier 以 SOCKS4 请求的 USERID 作为用户标识，USERID 未经验证，仅用于可信网络
+	Socks4UserIdentifier bool
+
+	// AuthMaxFailures 同一来源 IP 或用户名连续鉴权失败次数达到后锁定，为 0 时使用默认值，为负数时不限制
+	AuthMaxFailures int
+
+	// AuthLockout 鉴权失败锁定时长，为 0 时使用默认值
+	AuthLockout time.Duration
+
+	// AuthAllowlist 不受鉴权失败限制的来源地址，CIDR 或 IP
+	AuthAllowlist []string
+
+	// LockoutsFile 鉴权锁定次数记录文件，为空时不记录
+	LockoutsFile string
+
+	// FailuresFile 连接目标失败次数记录文件，按失败原因记录，为空时不记录
+	FailuresFile string
+
+	// RateLimits 用户限速，键为用户名，DefaultRateLimitUser 为其他用户的限速
+	RateLimits map[string]RateLimit
+
+	// CredentialsFile 用户名密码文件，每行格式为 user:password，密码可以是明文或 htpasswd 格式的哈希，配置后 Credentials 不生效
+	CredentialsFile string
+
+	// AccountsFile JSON 格式的账号文件，支持停用、过期时间和流量配额，配置后 Credentials 和 CredentialsFile 不生效
+	// 流量配额按下载流量计算，与 TrafficsFile 的记录一致
+	AccountsFile string
+
+	// AuthWebhook HTTP 鉴权地址，配置后 Credentials、CredentialsFile 和 AccountsFile 不生效
+	AuthWebhook string
+
+	// AuthWebhookToken 请求 AuthWebhook 时使用的 Bearer Token，为空时不发送
+	AuthWebhookToken string
+
+	// ACLFile 访问控制规则文件，为空时允许所有请求
+	ACLFile string
+
+	// RewriteFile 目标地址重写规则文件，JSON 格式，见 socks5.RewriteConfig，为空时不重写
+	RewriteFile string
+
+	// ReloadInterval 检查 CredentialsFile、AccountsFile、ACLFile、RewriteFile 和 HostsFile 是否变化的间隔，变化时重新加载，为 0 时不检查
+	ReloadInterval time.Duration
+
+	// DNSServers 上游 DNS 服务器，前一个出错时使用下一个，为空时使用系统解析，格式见 proxy.UpstreamDNSConfig
+	DNSServers []string
+
+	// DNSRoutes 按域名后缀使用的 DNS 服务器，键为域名后缀，如 corp.example 匹配其自身及子域名
+	DNSRoutes map[string][]string
+
+	// DNSCacheTTL 域名解析缓存时间，为 0 时不缓存
+	DNSCacheTTL time.Duration
+
+	// HostsFile hosts 格式的静态域名解析文件，优先于 DNS 解析，支持通配符，为空时不使用
+	HostsFile string
+
+	// FakeIPRange 伪 IP 地址段，如 198.18.0.0/15，配置后客户端经 UDP ASSOCIATE 发往 53 端口的 A 查询以伪 IP 应答，
+	// CONNECT 请求的域名在拨号时才解析，为空时不启用
+	FakeIPRange string
+
+	// ZeroCopy 零拷贝转发隧道数据，配置了 RateLimits 或 AccountsFile 时不生效
+	ZeroCopy bool
+
+	// Sniff 目标为 IP 的 CONNECT 请求从 TLS SNI 或 HTTP Host 获取目标域名，用于 ACL 和 RewriteFile 的域名规则
+	// 启用后先响应成功再拨号，失败时客户端只能看到连接关闭，原因见日志
+	Sniff bool
+
+	// SniffPorts 嗅探的目标端口，为空时使用默认值 80、443
+	SniffPorts []int
+
+	// SniffTimeout 嗅探时等待客户端数据的时间，为 0 时使用默认值
+	SniffTimeout time.Duration
+}
+
+// DefaultRateLimitUser 未单独配置限速的用户
+const DefaultRateLimitUser = "*"
+
+// dnsStatsInterval 记录域名解析缓存统计的间隔
+const dnsStatsInterval = 10 * time.Minute
+
+// RateLimit 用户限速，单位字节每秒，为 0 时不限速
+type RateLimit struct {
+	Upload   int64
+	Download int64
+}
+
 type Worker struct {
 	serverPort int
 	server     *socks5.Server
+	reporter   *internal.TrafficsReporter
+	rejections *internal.TrafficsReporter
+	lockouts   *internal.TrafficsReporter
+	failures   *internal.TrafficsReporter
+
+	credentialsFile string
+	accountsFile    string
+	aclFile         string
+	rewriteFile     string
+	hostsFile       string
+	credentials     *proxy.ReloadableCredentials
+	quota           *proxy.QuotaEnforcer
+	rules           *socks5.ReloadableRuleSet
+	rewriter        *socks5.ReloadableRewriter
+	resolver        *proxy.CachingResolver
+	hosts           *proxy.HostsResolver
+	done            chan struct{}
+
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
-func NewWorker(port int, credentials proxy.CredentialStore, trafficsFile string) (*Worker, error) {
-	reporter, err := internal.NewTrafficsReporter(time.Minute, trafficsFile)
+func NewWorker(conf *Config) (*Worker, error) {
+	w := &Worker{
+		serverPort:  conf.Port,
+		aclFile:     conf.ACLFile,
+		rewriteFile: conf.RewriteFile,
+		hostsFile:   conf.HostsFile,
+		done:        make(chan struct{}),
+	}
+
+	credentials := conf.Credentials
+	if conf.AuthWebhook != "" {
+		webhookConf := proxy.WebhookConfig{URL: conf.AuthWebhook}
+		if conf.AuthWebhookToken != "" {
+			webhookConf.Header = http.Header{"Authorization": {"Bearer " + conf.AuthWebhookToken}}
+		}
+		webhook, err := proxy.NewWebhookCredentials(webhookConf)
+		if err != nil {
+			return nil, err
+		}
+		credentials = webhook
+	} else if conf.AccountsFile != "" {
+		accounts, err := proxy.LoadAccounts(conf.AccountsFile)
+		if err != nil {
+			return nil, err
+		}
+		w.accountsFile = conf.AccountsFile
+		w.credentials = proxy.NewReloadableCredentials(accounts)
+		w.quota = proxy.NewQuotaEnforcer(accounts.Quotas())
+		loadQuotaUsage(w.quota, conf.TrafficsFile)
+		credentials = w.credentials
+	} else if conf.CredentialsFile != "" {
+		store, _, err := proxy.LoadCredentialsFile(conf.CredentialsFile)
+		if err != nil {
+			return nil, err
+		}
+		w.credentialsFile = conf.CredentialsFile
+		w.credentials = proxy.NewReloadableCredentials(store)
+		credentials = w.credentials
+	}
+	if conf.ACLFile != "" {
+		acl, err := socks5.LoadACL(conf.ACLFile)
+		if err != nil {
+			return nil, err
+		}
+		w.rules = socks5.NewReloadableRuleSet(acl)
+	}
+	if conf.RewriteFile != "" {
+		rewriter, err := socks5.LoadRewriter(conf.RewriteFile)
+		if err != nil {
+			return nil, err
+		}
+		w.rewriter = socks5.NewReloadableRewriter(rewriter)
+	}
+
+	reporter, err := internal.NewTrafficsReporter(time.Minute, conf.TrafficsFile)
 	if err != nil {
 		return nil, err
 	}
+	w.reporter = reporter
 
-	conf := &socks5.Config{
+	// 被拒绝的请求次数和锁定次数与流量使用相同的格式记录
+	if conf.RejectionsFile != "" {
+		if w.rejections, err = internal.NewTrafficsReporter(time.Minute, conf.RejectionsFile); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+	if conf.LockoutsFile != "" {
+		if w.lockouts, err = internal.NewTrafficsReporter(time.Minute, conf.LockoutsFile); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+	if conf.FailuresFile != "" {
+		if w.failures, err = internal.NewTrafficsReporter(time.Minute, conf.FailuresFile); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+
+	socksConf := &socks5.Config{
 		RequestReporter:  nil,
 		ResponseReporter: reporter,
 		Credentials:      credentials,
 		Logger:           nil,
+		HandshakeTimeout: conf.HandshakeTimeout,
+		DialTimeout:      conf.DialTimeout,
+		IdleTimeout:      conf.IdleTimeout,
+		MaxLifetime:      conf.MaxLifetime,
+		MaxConns:         conf.MaxConns,
+		MaxConnsPerUser:  conf.MaxConnsPerUser,
+		MaxConnsPerIP:    conf.MaxConnsPerIP,
+		Sniff:            conf.Sniff,
+		SniffPorts:       conf.SniffPorts,
+		SniffTimeout:     conf.SniffTimeout,
+	}
+	if w.rejections != nil {
+		socksConf.RejectReporter = w.rejections
+	}
+	if w.failures != nil {
+		socksConf.FailureReporter = w.failures
+	}
+	if w.rules != nil {
+		socksConf.Rules = w.rules
+	}
+	if w.rewriter != nil {
+		socksConf.Rewriter = w.rewriter
+	}
+	socksConf.Socks4UserIdentifier = conf.Socks4UserIdentifier
+	if len(conf.SourceIdentities) > 0 {
+		if socksConf.SourceAuth, err = socks5.NewSourceAuth(conf.SourceIdentities); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+	if credentials != nil && conf.AuthMaxFailures >= 0 {
+		guardConf := socks5.AuthGuardConfig{
+			MaxFailures: conf.AuthMaxFailures,
+			Lockout:     conf.AuthLockout,
+			Allowlist:   conf.AuthAllowlist,
+		}
+		if w.lockouts != nil {
+			guardConf.Reporter = w.lockouts
+		}
+		if socksConf.AuthGuard, err = socks5.NewAuthGuard(guardConf); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+	if len(conf.RateLimits) > 0 {
+		socksConf.RequestCopier, socksConf.ResponseCopier = makeRateLimitCopiers(conf.RateLimits)
+	}
+	if w.quota != nil {
+		socksConf.Quota = w.quota
+		socksConf.ResponseCopier = w.quota.Copier(socksConf.ResponseCopier)
+	}
+	if socksConf.RequestCopier == nil && socksConf.ResponseCopier == nil {
+		// 零拷贝转发不经过 Copier，限速或限制流量时不能启用
+		socksConf.ZeroCopy = conf.ZeroCopy
 	}
-	server, err := socks5.New(conf)
+	resolver, err := makeResolver(conf.DNSServers, conf.DNSRoutes)
 	if err != nil {
+		w.closeReporters()
+		return nil, err
+	}
+	if conf.DNSCacheTTL > 0 {
+		w.resolver = proxy.NewCachingResolver(resolver, proxy.CachingResolverConfig{DefaultTTL: conf.DNSCacheTTL})
+		resolver = w.resolver
+	}
+	if conf.HostsFile != "" {
+		// 静态解析在缓存之外，重新加载后立即生效
+		hosts, err := proxy.LoadHosts(conf.HostsFile)
+		if err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+		w.hosts = proxy.NewHostsResolver(hosts, resolver)
+		resolver = w.hosts
+	}
+	socksConf.Resolver = resolver
+	if conf.FakeIPRange != "" {
+		if socksConf.FakeIP, err = proxy.NewFakeIPPool(conf.FakeIPRange); err != nil {
+			w.closeReporters()
+			return nil, err
+		}
+	}
+	if conf.Dialer != nil {
+		socksConf.Dial = conf.Dialer.DialContext
+	}
+	if w.server, err = socks5.New(socksConf); err != nil {
+		w.closeReporters()
 		return nil, err
 	}
 
-	return &Worker{
-		serverPort: port,
-		server:     server,
-	}, nil
+	if conf.ReloadInterval > 0 {
+		go w.watch(conf.ReloadInterval)
+	}
+	if w.resolver != nil {
+		go w.reportDNSStats(dnsStatsInterval)
+	}
+	return w, nil
+}
+
+// reportDNSStats 定期记录域名解析缓存统计
+func (s *Worker) reportDNSStats(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.logDNSStats()
+		}
+	}
+}
+
+func (s *Worker) logDNSStats() {
+	stats := s.resolver.Stats()
+	log.Infof("dns cache stats: hits=%d, negative_hits=%d, misses=%d, shared=%d, entries=%d",
+		stats.Hits, stats.NegativeHits, stats.Misses, stats.Shared, stats.Entries)
 }
 
 func (s *Worker) Serve() error {
 	serveAddr := fmt.Sprintf(":%d", s.serverPort)
-	if err := s.server.ListenAndServe("tcp", serveAddr); err != nil {
+	if err := s.server.ListenAndServe("tcp", serveAddr); err != nil && err != socks5.ServerClosed {
 		log.WithError(err).Errorf("listen error: addr=%s", serveAddr)
 		return err
 	}
 
 	return nil
 }
+
+// Shutdown 停止接收新连接，等待正在转发的连接结束（最长至 ctx 结束），然后写入并关闭流量记录
+// 可多次调用，之后的调用直接返回第一次的结果
+func (s *Worker) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		s.shutdownErr = s.shutdown(ctx)
+	})
+	return s.shutdownErr
+}
+
+func (s *Worker) shutdown(ctx context.Context) error {
+	close(s.done)
+	err := s.server.Shutdown(ctx)
+	if err != nil {
+		log.WithError(err).Warnf("shutdown: active connections closed forcibly")
+	}
+
+	if s.resolver != nil {
+		s.logDNSStats()
+	}
+
+	if closeErr := s.closeReporters(); closeErr != nil {
+		return closeErr
+	}
+	return err
+}
+
+// closeReporters 写入并关闭所有记录
+func (s *Worker) closeReporters() error {
+	var firstErr error
+	for name, r := range map[string]*internal.TrafficsReporter{
+		"traffics":   s.reporter,
+		"rejections": s.rejections,
+		"lockouts":   s.lockouts,
+		"failures":   s.failures,
+	} {
+		if r == nil {
+			continue
+		}
+		if err := r.Close(); err != nil {
+			log.WithError(err).Errorf("close %s reporter failed", name)
+			if firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// makeResolver 创建域名解析，未配置 DNS 服务器时使用系统解析
+func makeResolver(servers []string, routes map[string][]string) (proxy.NameResolver, error) {
+	var resolver proxy.NameResolver = proxy.DNSResolver{}
+	if len(servers) > 0 {
+		upstream, err := proxy.NewUpstreamDNSResolver(proxy.UpstreamDNSConfig{Servers: servers})
+		if err != nil {
+			return nil, err
+		}
+		resolver = upstream
+	}
+	if len(routes) == 0 {
+		return resolver, nil
+	}
+
+	routeResolvers := make(map[string]proxy.NameResolver, len(routes))
+	for suffix, servers := range routes {
+		upstream, err := proxy.NewUpstreamDNSResolver(proxy.UpstreamDNSConfig{Servers: servers})
+		if err != nil {
+			return nil, fmt.Errorf("dns route %s: %v", suffix, err)
+		}
+		routeResolvers[suffix] = upstream
+	}
+	return proxy.NewSplitResolver(resolver, routeResolvers), nil
+}
+
+// makeRateLimitCopiers 创建上传和下载限速转发器，同一用户的所有连接共享限速
+func makeRateLimitCopiers(limits map[string]RateLimit) (upload, download proxy.Copier) {
+	defaultLimit := limits[DefaultRateLimitUser]
+	uploads := make(map[string]int64)
+	downloads := make(map[string]int64)
+	for user, limit := range limits {
+		if user == DefaultRateLimitUser {
+			continue
+		}
+		uploads[user] = limit.Upload
+		downloads[user] = limit.Download
+	}
+
+	upload = proxy.NewRateLimitCopier(defaultLimit.Upload, uploads)
+	download = proxy.NewRateLimitCopier(defaultLimit.Download, downloads)
+	return upload, download
+}
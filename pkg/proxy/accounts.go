@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Account 用户账号
+type Account struct {
+	// Username 用户名
+	Username string `json:"username"`
+	// Password 密码哈希，格式同 htpasswd，见 HashPassword
+	Password string `json:"password"`
+	// Disabled 是否停用
+	Disabled bool `json:"disabled,omitempty"`
+	// ExpiresAt 过期时间，为空时不过期
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+	// DailyQuota 每日流量配额，单位字节，为 0 时不限制
+	DailyQuota int64 `json:"daily_quota,omitempty"`
+	// MonthlyQuota 每月流量配额，单位字节，为 0 时不限制
+	MonthlyQuota int64 `json:"monthly_quota,omitempty"`
+}
+
+// Active 账号是否可用
+func (a *Account) Active(now time.Time) bool {
+	return !a.Disabled && (a.ExpiresAt == nil || now.Before(*a.ExpiresAt))
+}
+
+// Accounts 带有效期和流量配额的用户名密码认证，停用或过期的账号鉴权失败
+type Accounts struct {
+	accounts map[string]*Account
+}
+
+// LoadAccounts 从 JSON 文件加载账号，文件内容为 Account 数组
+func LoadAccounts(file string) (*Accounts, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []*Account
+	if err := json.Unmarshal(data, &list); err != nil {
+		return nil, fmt.Errorf("parse accounts file %s: %v", file, err)
+	}
+	return NewAccounts(list)
+}
+
+func NewAccounts(list []*Account) (*Accounts, error) {
+	accounts := &Accounts{accounts: make(map[string]*Account, len(list))}
+	for i, a := range list {
+		if a.Username == "" {
+			return nil, fmt.Errorf("account %d: username required", i)
+		}
+		if hashAlgorithm(a.Password) == "" {
+			return nil, fmt.Errorf("account %s: %v", a.Username, unsupportedHash)
+		}
+		if _, ok := accounts.accounts[a.Username]; ok {
+			return nil, fmt.Errorf("account %s: duplicated", a.Username)
+		}
+		accounts.accounts[a.Username] = a
+	}
+	return accounts, nil
+}
+
+// Len 账号数
+func (a *Accounts) Len() int {
+	return len(a.accounts)
+}
+
+func (a *Accounts) Valid(user, password string) bool {
+	account, ok := a.accounts[user]
+	if !ok {
+		compareDummyHash(password)
+		return false
+	}
+	// 先校验密码，避免通过响应时间判断账号状态
+	if !VerifyPassword(account.Password, password) {
+		return false
+	}
+	return account.Active(time.Now())
+}
+
+// UserActive 账号是否存在且可用，用于中断已停用、过期或被删除账号的连接
+func (a *Accounts) UserActive(user string) bool {
+	account, ok := a.accounts[user]
+	return ok && account.Active(time.Now())
+}
+
+// Quotas 各账号的流量配额
+func (a *Accounts) Quotas() map[string]Quota {
+	quotas := make(map[string]Quota)
+	for user, account := range a.accounts {
+		if account.DailyQuota > 0 || account.MonthlyQuota > 0 {
+			quotas[user] = Quota{Daily: account.DailyQuota, Monthly: account.MonthlyQuota}
+		}
+	}
+	return quotas
+}
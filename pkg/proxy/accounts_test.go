@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAccounts(t *testing.T) {
+	hashed, err := HashPassword(HashSHA256, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data := `[
+		{"username": "alice", "password": "` + hashed + `", "monthly_quota": 1024},
+		{"username": "bob", "password": "` + hashed + `", "disabled": true},
+		{"username": "carol", "password": "` + hashed + `", "expires_at": "2020-01-01T00:00:00Z"},
+		{"username": "dave", "password": "` + hashed + `", "expires_at": "2999-01-01T00:00:00Z", "daily_quota": 512}
+	]`
+	file := filepath.Join(t.TempDir(), "accounts.json")
+	if err := os.WriteFile(file, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	accounts, err := LoadAccounts(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		user, password string
+		expected       bool
+	}{
+		{"alice", "secret", true},
+		{"alice", "wrong", false},
+		{"bob", "secret", false},
+		{"carol", "secret", false},
+		{"dave", "secret", true},
+		{"eve", "secret", false},
+	}
+	for _, tt := range tests {
+		if got := accounts.Valid(tt.user, tt.password); got != tt.expected {
+			t.Errorf("Valid(%q, %q) = %v, expected %v", tt.user, tt.password, got, tt.expected)
+		}
+	}
+
+	quotas := accounts.Quotas()
+	if len(quotas) != 2 || quotas["alice"].Monthly != 1024 || quotas["dave"].Daily != 512 {
+		t.Errorf("unexpected quotas: %v", quotas)
+	}
+}
+
+func TestAccountsInvalid(t *testing.T) {
+	for _, list := range [][]*Account{
+		{{Username: "", Password: "$5$salt$hash"}},
+		{{Username: "alice", Password: "plaintext"}},
+		{{Username: "alice", Password: "$5$salt$hash"}, {Username: "alice", Password: "$5$salt$hash"}},
+	} {
+		if _, err := NewAccounts(list); err == nil {
+			t.Errorf("expected error for %v", list)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strings"
+)
+
+// Apache htpasswd 默认使用的 APR1（MD5-crypt）实现，格式为 $apr1$salt$hash
+// 仅用于校验已有的哈希，新密码使用更安全的算法
+
+const (
+	apr1Prefix  = "$apr1$"
+	apr1MaxSalt = 8
+	apr1Rounds  = 1000
+)
+
+// apr1Crypt 使用 hashed 中的盐计算 password 的 APR1 哈希
+func apr1Crypt(password, hashed string) (string, error) {
+	if !strings.HasPrefix(hashed, apr1Prefix) {
+		return "", fmt.Errorf("not an apr1 hash")
+	}
+	salt := strings.TrimPrefix(hashed, apr1Prefix)
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > apr1MaxSalt {
+		salt = salt[:apr1MaxSalt]
+	}
+	pw := []byte(password)
+
+	alt := md5.New()
+	alt.Write(pw)
+	alt.Write([]byte(salt))
+	alt.Write(pw)
+	altSum := alt.Sum(nil)
+
+	h := md5.New()
+	h.Write(pw)
+	h.Write([]byte(apr1Prefix))
+	h.Write([]byte(salt))
+	h.Write(repeatBytes(altSum, len(pw)))
+	for i := len(pw); i > 0; i >>= 1 {
+		if i&1 != 0 {
+			h.Write([]byte{0})
+		} else {
+			h.Write(pw[:1])
+		}
+	}
+	sum := h.Sum(nil)
+
+	for i := 0; i < apr1Rounds; i++ {
+		h := md5.New()
+		if i&1 != 0 {
+			h.Write(pw)
+		} else {
+			h.Write(sum)
+		}
+		if i%3 != 0 {
+			h.Write([]byte(salt))
+		}
+		if i%7 != 0 {
+			h.Write(pw)
+		}
+		if i&1 != 0 {
+			h.Write(sum)
+		} else {
+			h.Write(pw)
+		}
+		sum = h.Sum(nil)
+	}
+
+	var sb strings.Builder
+	sb.WriteString(apr1Prefix)
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	for i := 0; i < 4; i++ {
+		encodeCrypt24(&sb, sum[i], sum[i+6], sum[i+12], 4)
+	}
+	encodeCrypt24(&sb, sum[4], sum[10], sum[5], 4)
+	encodeCrypt24(&sb, 0, 0, sum[11], 2)
+	return sb.String(), nil
+}
@@ -17,3 +17,18 @@ func NewSimpleCopier() Copier {
 func (c *simpleCopier) Copy(dst io.Writer, src io.Reader) (int64, error) {
 	return io.Copy(dst, src)
 }
+
+// UserCopier 可按用户区分的数据转发器
+type UserCopier interface {
+	Copier
+	// CopyUser 将用户 userIdentifier 的数据从 src 复制到 dst
+	CopyUser(userIdentifier string, dst io.Writer, src io.Reader) (int64, error)
+}
+
+// CopyUser 使用 copier 转发用户数据，copier 不区分用户时直接转发
+func CopyUser(copier Copier, userIdentifier string, dst io.Writer, src io.Reader) (int64, error) {
+	if c, ok := copier.(UserCopier); ok {
+		return c.CopyUser(userIdentifier, dst, src)
+	}
+	return copier.Copy(dst, src)
+}
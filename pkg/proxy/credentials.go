@@ -1,10 +1,57 @@
 package proxy
 
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// CredentialsUnavailable 鉴权服务不可用，无法判断用户名密码是否正确
+var CredentialsUnavailable = fmt.Errorf("credential store unavailable")
+
 // CredentialStore 用于用户名密码认证
 type CredentialStore interface {
 	Valid(user, password string) bool
 }
 
+// AttributeCredentialStore 鉴权成功时可返回用户属性的用户名密码认证
+type AttributeCredentialStore interface {
+	CredentialStore
+	// ValidAttributes 鉴权成功时返回用户属性
+	ValidAttributes(user, password string) (map[string]string, bool)
+}
+
+// CheckedCredentialStore 可区分鉴权失败和鉴权服务不可用的用户名密码认证
+type CheckedCredentialStore interface {
+	AttributeCredentialStore
+	// CheckAttributes 鉴权成功时返回用户属性，鉴权服务不可用时返回 CredentialsUnavailable
+	CheckAttributes(user, password string) (map[string]string, bool, error)
+}
+
+// ActiveCredentialStore 可检查已鉴权用户当前是否仍可用的用户名密码认证
+type ActiveCredentialStore interface {
+	CredentialStore
+	UserActive(user string) bool
+}
+
+// ValidAttributes 使用 store 鉴权，store 不提供用户属性时属性为空
+func ValidAttributes(store CredentialStore, user, password string) (map[string]string, bool) {
+	if s, ok := store.(AttributeCredentialStore); ok {
+		return s.ValidAttributes(user, password)
+	}
+	return nil, store.Valid(user, password)
+}
+
+// CheckAttributes 使用 store 鉴权，鉴权服务不可用时返回 CredentialsUnavailable，此时不应视为用户名密码错误
+func CheckAttributes(store CredentialStore, user, password string) (map[string]string, bool, error) {
+	if s, ok := store.(CheckedCredentialStore); ok {
+		return s.CheckAttributes(user, password)
+	}
+	attributes, ok := ValidAttributes(store, user, password)
+	return attributes, ok, nil
+}
+
 // StaticCredentials 使用内存实现用户名密码认证
 type StaticCredentials map[string]string
 
@@ -15,3 +62,86 @@ func (s StaticCredentials) Valid(user, password string) bool {
 	}
 	return password == pass
 }
+
+// LoadCredentialsFile 从文件加载用户名密码，每行格式为 user:password，# 开头的行为注释
+// 所有密码均为支持的哈希时按 htpasswd 格式处理，均不是哈希时按明文处理，两者混用时报错
+func LoadCredentialsFile(file string) (store CredentialStore, users int, err error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	passwords := make(map[string]string)
+	hashed := 0
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		splits := strings.SplitN(line, ":", 2)
+		if len(splits) != 2 || splits[0] == "" || splits[1] == "" {
+			return nil, 0, fmt.Errorf("%s:%d: bad credential format", file, i+1)
+		}
+		if strings.HasPrefix(splits[1], htpasswdSHAPrefix) {
+			return nil, 0, fmt.Errorf("%s:%d: %v for user %s", file, i+1, shaHashInsecure, splits[0])
+		}
+		passwords[splits[0]] = splits[1]
+		if hashAlgorithm(splits[1]) != "" {
+			hashed++
+		}
+	}
+
+	switch hashed {
+	case 0:
+		return StaticCredentials(passwords), len(passwords), nil
+	case len(passwords):
+		return &HtpasswdCredentials{hashes: passwords}, len(passwords), nil
+	default:
+		return nil, 0, fmt.Errorf("%s: plaintext passwords and hashes can not be mixed", file)
+	}
+}
+
+// ReloadableCredentials 可在运行时原子替换的用户名密码认证
+type ReloadableCredentials struct {
+	store atomic.Value // credentialsHolder
+}
+
+// credentialsHolder atomic.Value 要求每次存入的类型一致
+type credentialsHolder struct {
+	store CredentialStore
+}
+
+func NewReloadableCredentials(store CredentialStore) *ReloadableCredentials {
+	c := &ReloadableCredentials{}
+	c.Store(store)
+	return c
+}
+
+// Store 替换用户名密码认证，已鉴权的连接不受影响
+func (c *ReloadableCredentials) Store(store CredentialStore) {
+	c.store.Store(credentialsHolder{store})
+}
+
+func (c *ReloadableCredentials) Valid(user, password string) bool {
+	_, ok := c.ValidAttributes(user, password)
+	return ok
+}
+
+func (c *ReloadableCredentials) ValidAttributes(user, password string) (map[string]string, bool) {
+	attributes, ok, _ := c.CheckAttributes(user, password)
+	return attributes, ok
+}
+
+// UserActive 当前认证不支持检查账号状态时视为可用
+func (c *ReloadableCredentials) UserActive(user string) bool {
+	store, ok := c.store.Load().(credentialsHolder).store.(ActiveCredentialStore)
+	return !ok || store.UserActive(user)
+}
+
+func (c *ReloadableCredentials) CheckAttributes(user, password string) (map[string]string, bool, error) {
+	store := c.store.Load().(credentialsHolder).store
+	if store == nil {
+		return nil, false, nil
+	}
+	return CheckAttributes(store, user, password)
+}
@@ -0,0 +1,72 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReloadableCredentials(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "credentials")
+	if err := os.WriteFile(file, []byte("# users\nalice:secret\n\nbob:p:ss\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, users, err := LoadCredentialsFile(file)
+	if err != nil || users != 2 {
+		t.Fatalf("unexpected load result: %d, %v", users, err)
+	}
+	creds := NewReloadableCredentials(store)
+	if !creds.Valid("alice", "secret") || !creds.Valid("bob", "p:ss") {
+		t.Fatal("expected loaded users to be valid")
+	}
+
+	creds.Store(StaticCredentials{"carol": "pass"})
+	if creds.Valid("alice", "secret") || !creds.Valid("carol", "pass") {
+		t.Fatal("expected credentials to be replaced")
+	}
+
+	if err := os.WriteFile(file, []byte("alice\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadCredentialsFile(file); err == nil {
+		t.Fatal("expected error for bad format")
+	}
+}
+
+func TestLoadCredentialsFileFormat(t *testing.T) {
+	hashed, err := HashPassword(HashSHA256, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "credentials")
+
+	// 全部为哈希时按 htpasswd 处理
+	if err := os.WriteFile(file, []byte("alice:"+hashed+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store, _, err := LoadCredentialsFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !store.Valid("alice", "secret") || store.Valid("alice", hashed) {
+		t.Fatal("expected hashed password to be verified")
+	}
+
+	// 明文和哈希混用时报错
+	if err := os.WriteFile(file, []byte("alice:"+hashed+"\nbob:secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadCredentialsFile(file); err == nil {
+		t.Fatal("expected error for mixed formats")
+	}
+
+	// {SHA} 哈希不按明文处理
+	if err := os.WriteFile(file, []byte("dave:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := LoadCredentialsFile(file); err == nil || !strings.Contains(err.Error(), "dave") {
+		t.Fatalf("expected {SHA} error for dave, got %v", err)
+	}
+}
@@ -0,0 +1,247 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/sync/singleflight"
+)
+
+// TTLResolver 可返回记录有效期的域名解析，有效期为 0 时表示未知
+type TTLResolver interface {
+	ResolveTTL(ctx context.Context, name string) (context.Context, net.IP, time.Duration, error)
+}
+
+// ResolveTTL 解析域名，resolver 未实现 TTLResolver 时有效期为 0
+func ResolveTTL(resolver NameResolver, ctx context.Context, name string) (context.Context, net.IP, time.Duration, error) {
+	if r, ok := resolver.(TTLResolver); ok {
+		return r.ResolveTTL(ctx, name)
+	}
+	ctx, ip, err := resolver.Resolve(ctx, name)
+	return ctx, ip, 0, err
+}
+
+// CachingResolverConfig 域名解析缓存配置
+type CachingResolverConfig struct {
+	// DefaultTTL 无法获取记录有效期时的缓存时间，默认 1 分钟
+	DefaultTTL time.Duration
+
+	// MinTTL 最短缓存时间，为 0 时不限制
+	MinTTL time.Duration
+
+	// MaxTTL 最长缓存时间，默认 1 小时
+	MaxTTL time.Duration
+
+	// NegativeTTL 域名不存在时的缓存时间，默认 30 秒
+	NegativeTTL time.Duration
+
+	// MaxEntries 最大缓存条数，默认 10000
+	MaxEntries int
+
+	// Timeout 单次解析的超时时间，默认 10 秒
+	// 同一域名的解析由所有等待者共享，不受发起请求的上下文取消影响
+	Timeout time.Duration
+}
+
+// CacheStats 缓存命中统计
+type CacheStats struct {
+	Hits         int64 // 命中解析成功的缓存
+	NegativeHits int64 // 命中域名不存在的缓存
+	Misses       int64 // 未命中，需要解析
+	Shared       int64 // 未命中，但与同时进行的相同解析共享结果
+	Entries      int   // 当前缓存条数
+}
+
+// CachingResolver 缓存解析结果的域名解析，同一域名同时只解析一次，解析失败时仅缓存域名不存在的结果
+// 被包装的域名解析实现 AddrsResolver 时缓存域名的所有地址
+type CachingResolver struct {
+	config   CachingResolverConfig
+	resolver NameResolver
+	group    singleflight.Group
+
+	mu    sync.Mutex
+	cache map[string]*dnsCacheEntry
+
+	hits, negativeHits, misses, shared int64
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	err     error
+	expires time.Time
+}
+
+type dnsResult struct {
+	ips []net.IP
+	ttl time.Duration
+}
+
+// detachedContext 保留上下文中的值，但不随其取消
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+func NewCachingResolver(resolver NameResolver, conf CachingResolverConfig) *CachingResolver {
+	if conf.DefaultTTL <= 0 {
+		conf.DefaultTTL = time.Minute
+	}
+	if conf.MaxTTL <= 0 {
+		conf.MaxTTL = time.Hour
+	}
+	if conf.NegativeTTL <= 0 {
+		conf.NegativeTTL = 30 * time.Second
+	}
+	if conf.MaxEntries <= 0 {
+		conf.MaxEntries = 10000
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 10 * time.Second
+	}
+	return &CachingResolver{
+		config:   conf,
+		resolver: resolver,
+		cache:    make(map[string]*dnsCacheEntry),
+	}
+}
+
+func (r *CachingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ips, _, err := r.ResolveAddrs(ctx, name)
+	if err != nil {
+		return ctx, nil, err
+	}
+	return ctx, ips[0], nil
+}
+
+// ResolveAddrs 解析域名的所有地址，命中缓存时返回剩余有效期
+func (r *CachingResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if entry, ok := r.lookup(name); ok {
+		if entry.err != nil {
+			atomic.AddInt64(&r.negativeHits, 1)
+			return ctx, nil, 0, entry.err
+		}
+		atomic.AddInt64(&r.hits, 1)
+		return ctx, entry.ips, time.Until(entry.expires), nil
+	}
+
+	// 解析使用独立的超时，等待者各自在上下文结束时返回
+	ch := r.group.DoChan(name, func() (interface{}, error) {
+		lookupCtx, cancel := context.WithTimeout(detachedContext{ctx}, r.config.Timeout)
+		defer cancel()
+		_, ips, ttl, err := ResolveAddrs(r.resolver, lookupCtx, name)
+		if err == nil && len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+		}
+		if err != nil {
+			if isNotFound(err) {
+				r.store(name, &dnsCacheEntry{err: err, expires: time.Now().Add(r.config.NegativeTTL)})
+			}
+			return nil, err
+		}
+		ttl = r.ttl(ttl)
+		r.store(name, &dnsCacheEntry{ips: ips, expires: time.Now().Add(ttl)})
+		return &dnsResult{ips: ips, ttl: ttl}, nil
+	})
+
+	var res singleflight.Result
+	select {
+	case res = <-ch:
+	case <-ctx.Done():
+		return ctx, nil, 0, ctx.Err()
+	}
+	if res.Shared {
+		atomic.AddInt64(&r.shared, 1)
+	} else {
+		atomic.AddInt64(&r.misses, 1)
+	}
+	if res.Err != nil {
+		return ctx, nil, 0, res.Err
+	}
+	result := res.Val.(*dnsResult)
+	return ctx, result.ips, result.ttl, nil
+}
+
+// Stats 缓存命中统计
+func (r *CachingResolver) Stats() CacheStats {
+	r.mu.Lock()
+	entries := len(r.cache)
+	r.mu.Unlock()
+
+	return CacheStats{
+		Hits:         atomic.LoadInt64(&r.hits),
+		NegativeHits: atomic.LoadInt64(&r.negativeHits),
+		Misses:       atomic.LoadInt64(&r.misses),
+		Shared:       atomic.LoadInt64(&r.shared),
+		Entries:      entries,
+	}
+}
+
+// Flush 清空缓存
+func (r *CachingResolver) Flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.cache = make(map[string]*dnsCacheEntry)
+}
+
+func (r *CachingResolver) ttl(ttl time.Duration) time.Duration {
+	if ttl <= 0 {
+		ttl = r.config.DefaultTTL
+	}
+	if ttl < r.config.MinTTL {
+		ttl = r.config.MinTTL
+	}
+	if ttl > r.config.MaxTTL {
+		ttl = r.config.MaxTTL
+	}
+	return ttl
+}
+
+func (r *CachingResolver) lookup(name string) (*dnsCacheEntry, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry, ok := r.cache[name]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(entry.expires) {
+		delete(r.cache, name)
+		return nil, false
+	}
+	return entry, true
+}
+
+func (r *CachingResolver) store(name string, entry *dnsCacheEntry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// 缓存已满时先清除过期的缓存，仍然已满时随机淘汰
+	if _, ok := r.cache[name]; !ok && len(r.cache) >= r.config.MaxEntries {
+		now := time.Now()
+		for k, e := range r.cache {
+			if now.After(e.expires) {
+				delete(r.cache, k)
+			}
+		}
+		for k := range r.cache {
+			if len(r.cache) < r.config.MaxEntries {
+				break
+			}
+			delete(r.cache, k)
+		}
+	}
+	r.cache[name] = entry
+}
+
+// isNotFound 是否为域名不存在的错误
+func isNotFound(err error) bool {
+	var dnsErr *net.DNSError
+	return errors.As(err, &dnsErr) && dnsErr.IsNotFound
+}
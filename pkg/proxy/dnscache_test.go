@@ -0,0 +1,135 @@
+package proxy
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+type countingResolver struct {
+	calls int64
+	ttl   time.Duration
+	delay time.Duration
+}
+
+func (r *countingResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ip, _, err := r.ResolveTTL(ctx, name)
+	return ctx, ip, err
+}
+
+func (r *countingResolver) ResolveTTL(ctx context.Context, name string) (context.Context, net.IP, time.Duration, error) {
+	atomic.AddInt64(&r.calls, 1)
+	select {
+	case <-time.After(r.delay):
+	case <-ctx.Done():
+		return ctx, nil, 0, ctx.Err()
+	}
+	if name == "missing.example" {
+		return ctx, nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	if name == "timeout.example" {
+		return ctx, nil, 0, &net.DNSError{Err: "i/o timeout", Name: name, IsTimeout: true}
+	}
+	return ctx, net.IPv4(10, 0, 0, 1), r.ttl, nil
+}
+
+func TestCachingResolver(t *testing.T) {
+	upstream := &countingResolver{ttl: 50 * time.Millisecond}
+	r := NewCachingResolver(upstream, CachingResolverConfig{NegativeTTL: time.Hour})
+
+	for i := 0; i < 3; i++ {
+		if _, ip, err := r.Resolve(context.Background(), "example.com"); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+			t.Fatalf("unexpected result: %v, %v", ip, err)
+		}
+		if _, _, err := r.Resolve(context.Background(), "missing.example"); !isNotFound(err) {
+			t.Fatalf("expected not found, got %v", err)
+		}
+		if _, _, err := r.Resolve(context.Background(), "timeout.example"); err == nil {
+			t.Fatal("expected timeout")
+		}
+	}
+	// 超时不缓存
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 5 {
+		t.Fatalf("expected 5 upstream calls, got %d", calls)
+	}
+	stats := r.Stats()
+	if stats.Hits != 2 || stats.NegativeHits != 2 || stats.Misses != 5 || stats.Entries != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+
+	// 记录过期后重新解析
+	time.Sleep(100 * time.Millisecond)
+	_, _, _ = r.Resolve(context.Background(), "example.com")
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 6 {
+		t.Fatalf("expected 6 upstream calls, got %d", calls)
+	}
+}
+
+func TestCachingResolverTTLBounds(t *testing.T) {
+	r := NewCachingResolver(&countingResolver{}, CachingResolverConfig{DefaultTTL: time.Minute, MinTTL: 2 * time.Minute, MaxTTL: time.Hour})
+	tests := []struct {
+		ttl, expected time.Duration
+	}{
+		{0, 2 * time.Minute},
+		{time.Second, 2 * time.Minute},
+		{10 * time.Minute, 10 * time.Minute},
+		{24 * time.Hour, time.Hour},
+	}
+	for _, tt := range tests {
+		if got := r.ttl(tt.ttl); got != tt.expected {
+			t.Errorf("ttl(%v) = %v, expected %v", tt.ttl, got, tt.expected)
+		}
+	}
+}
+
+func TestCachingResolverSingleflight(t *testing.T) {
+	upstream := &countingResolver{delay: 100 * time.Millisecond}
+	r := NewCachingResolver(upstream, CachingResolverConfig{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, _, err := r.Resolve(context.Background(), "example.com"); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", calls)
+	}
+	if stats := r.Stats(); stats.Misses+stats.Shared+stats.Hits != 10 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestCachingResolverDetachedLookup(t *testing.T) {
+	upstream := &countingResolver{delay: 100 * time.Millisecond}
+	r := NewCachingResolver(upstream, CachingResolverConfig{})
+
+	// 发起解析的请求取消后，共享解析的等待者仍得到结果
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	first := make(chan error, 1)
+	go func() {
+		_, _, err := r.Resolve(ctx, "example.com")
+		first <- err
+	}()
+	time.Sleep(5 * time.Millisecond)
+	if _, ip, err := r.Resolve(context.Background(), "example.com"); err != nil || !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("unexpected result: %v, %v", ip, err)
+	}
+	if err := <-first; err != context.DeadlineExceeded {
+		t.Fatalf("expected first caller to time out, got %v", err)
+	}
+	if calls := atomic.LoadInt64(&upstream.calls); calls != 1 {
+		t.Fatalf("expected 1 upstream call, got %d", calls)
+	}
+}
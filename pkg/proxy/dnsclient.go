@@ -0,0 +1,407 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liamylian/lsocks/pkg/log"
+)
+
+const (
+	dnsNetworkUDP   = "udp"
+	dnsNetworkTCP   = "tcp"
+	dnsNetworkHTTPS = "https"
+
+	// dnsMaxMessageSize DNS 消息最大长度
+	dnsMaxMessageSize = 65535
+	// dohContentType DNS-over-HTTPS 消息类型，见 RFC 8484
+	dohContentType = "application/dns-message"
+)
+
+// UpstreamDNSConfig 上游 DNS 服务器配置
+type UpstreamDNSConfig struct {
+	// Servers 按顺序使用的 DNS 服务器，前一个出错时使用下一个，格式如
+	// 1.1.1.1、udp://1.1.1.1:53、tcp://8.8.8.8、https://dns.google/dns-query，未指定端口时为 53
+	Servers []string
+
+	// Timeout 每个服务器的查询超时时间，默认 5 秒
+	Timeout time.Duration
+
+	// Client DNS-over-HTTPS 使用的客户端，默认使用 Timeout 创建，DoH 服务器的域名由系统解析
+	Client *http.Client
+}
+
+// UpstreamDNSResolver 通过指定的 DNS 服务器解析域名，支持 UDP、TCP 和 DNS-over-HTTPS
+// Resolve 优先返回 IPv4 地址，没有时返回 IPv6 地址
+type UpstreamDNSResolver struct {
+	config  UpstreamDNSConfig
+	servers []*dnsServer
+}
+
+// dnsServer DNS 服务器，network 为 udp、tcp 或 https，https 时 addr 为 URL
+type dnsServer struct {
+	network string
+	addr    string
+}
+
+func (s *dnsServer) String() string {
+	if s.network == dnsNetworkHTTPS {
+		return s.addr
+	}
+	return s.network + "://" + s.addr
+}
+
+func NewUpstreamDNSResolver(conf UpstreamDNSConfig) (*UpstreamDNSResolver, error) {
+	if len(conf.Servers) == 0 {
+		return nil, fmt.Errorf("dns servers required")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{Timeout: conf.Timeout}
+	}
+
+	servers := make([]*dnsServer, 0, len(conf.Servers))
+	for _, s := range conf.Servers {
+		server, err := parseDNSServer(s)
+		if err != nil {
+			return nil, err
+		}
+		servers = append(servers, server)
+	}
+	return &UpstreamDNSResolver{config: conf, servers: servers}, nil
+}
+
+func parseDNSServer(s string) (*dnsServer, error) {
+	s = strings.TrimSpace(s)
+	network := dnsNetworkUDP
+	if i := strings.Index(s, "://"); i >= 0 {
+		network = s[:i]
+		switch network {
+		case "https", "http":
+			if _, err := url.Parse(s); err != nil {
+				return nil, fmt.Errorf("bad dns server %s: %v", s, err)
+			}
+			return &dnsServer{network: dnsNetworkHTTPS, addr: s}, nil
+		case dnsNetworkUDP, dnsNetworkTCP:
+			s = s[i+3:]
+		default:
+			return nil, fmt.Errorf("unsupported dns server scheme: %s", network)
+		}
+	}
+	if s == "" {
+		return nil, fmt.Errorf("bad dns server: empty address")
+	}
+	if _, _, err := net.SplitHostPort(s); err != nil {
+		s = net.JoinHostPort(strings.Trim(s, "[]"), "53")
+	}
+	return &dnsServer{network: network, addr: s}, nil
+}
+
+func (r *UpstreamDNSResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	ctx, ip, _, err := r.ResolveTTL(ctx, name)
+	return ctx, ip, err
+}
+
+func (r *UpstreamDNSResolver) ResolveTTL(ctx context.Context, name string) (context.Context, net.IP, time.Duration, error) {
+	ctx, ips, ttl, err := r.ResolveAddrs(ctx, name)
+	if err != nil {
+		return ctx, nil, 0, err
+	}
+	return ctx, ips[0], ttl, nil
+}
+
+// ResolveAddrs 同时查询 A 和 AAAA 记录，IPv4 地址在前，有效期为记录中最短的 TTL
+func (r *UpstreamDNSResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if ip := net.ParseIP(name); ip != nil {
+		return ctx, []net.IP{ip}, 0, nil
+	}
+
+	type answer struct {
+		ips []net.IP
+		ttl time.Duration
+		err error
+	}
+	qtypes := []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA}
+	answers := make([]answer, len(qtypes))
+	var wg sync.WaitGroup
+	for i, qtype := range qtypes {
+		wg.Add(1)
+		go func(a *answer, qtype dnsmessage.Type) {
+			defer wg.Done()
+			a.ips, a.ttl, a.err = r.lookup(ctx, name, qtype)
+		}(&answers[i], qtype)
+	}
+	wg.Wait()
+
+	// 任一地址族有结果即成功，否则优先返回域名不存在以外的错误
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	for _, a := range answers {
+		if a.err != nil {
+			if err == nil || isNotFound(err) {
+				err = a.err
+			}
+			continue
+		}
+		if len(a.ips) > 0 && (len(ips) == 0 || a.ttl < ttl) {
+			ttl = a.ttl
+		}
+		ips = append(ips, a.ips...)
+	}
+	if len(ips) > 0 {
+		return ctx, ips, ttl, nil
+	}
+	if err == nil {
+		err = &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return ctx, nil, 0, err
+}
+
+// lookup 依次查询各服务器，域名不存在时不再查询其他服务器
+func (r *UpstreamDNSResolver) lookup(ctx context.Context, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	var lastErr error
+	for _, server := range r.servers {
+		ips, ttl, err := r.query(ctx, server, name, qtype)
+		if err == nil || isNotFound(err) {
+			return ips, ttl, err
+		}
+		if ctx.Err() != nil {
+			return nil, 0, ctx.Err()
+		}
+		log.WithError(err).Warnf("dns query failed: server=%s, name=%s", server, name)
+		lastErr = err
+	}
+	return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: name, IsTemporary: true}
+}
+
+func (r *UpstreamDNSResolver) query(ctx context.Context, server *dnsServer, name string, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, r.config.Timeout)
+	defer cancel()
+
+	// DNS-over-HTTPS 的 ID 应为 0，以便 HTTP 缓存
+	var id uint16
+	if server.network != dnsNetworkHTTPS {
+		b := make([]byte, 2)
+		if _, err := rand.Read(b); err != nil {
+			return nil, 0, err
+		}
+		id = binary.BigEndian.Uint16(b)
+	}
+	query, err := newDNSQuery(id, name, qtype)
+	if err != nil {
+		return nil, 0, &net.DNSError{Err: err.Error(), Name: name}
+	}
+
+	var resp []byte
+	switch server.network {
+	case dnsNetworkHTTPS:
+		resp, err = r.exchangeHTTPS(ctx, server.addr, query)
+	case dnsNetworkTCP:
+		resp, err = exchangeTCP(ctx, server.addr, query)
+	default:
+		resp, err = exchangeUDP(ctx, server.addr, query)
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	return parseDNSResponse(id, name, qtype, resp)
+}
+
+func newDNSQuery(id uint16, name string, qtype dnsmessage.Type) ([]byte, error) {
+	if !strings.HasSuffix(name, ".") {
+		name += "."
+	}
+	n, err := dnsmessage.NewName(name)
+	if err != nil {
+		return nil, err
+	}
+	msg := dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: n, Type: qtype, Class: dnsmessage.ClassINET}},
+	}
+	return msg.Pack()
+}
+
+// parseDNSResponse 解析响应中的地址，有效期为记录中最短的 TTL
+func parseDNSResponse(id uint16, name string, qtype dnsmessage.Type, resp []byte) ([]net.IP, time.Duration, error) {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, fmt.Errorf("bad dns response: %v", err)
+	}
+	if msg.ID != id || !msg.Response {
+		return nil, 0, fmt.Errorf("bad dns response: mismatched id")
+	}
+	switch msg.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, 0, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	default:
+		return nil, 0, fmt.Errorf("dns server returned %v", msg.RCode)
+	}
+
+	var ips []net.IP
+	var ttl uint32
+	for _, answer := range msg.Answers {
+		if answer.Header.Type != qtype {
+			continue
+		}
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue
+		}
+		if len(ips) == 1 || answer.Header.TTL < ttl {
+			ttl = answer.Header.TTL
+		}
+	}
+	return ips, time.Duration(ttl) * time.Second, nil
+}
+
+// exchangeUDP 通过 UDP 查询，响应被截断时改用 TCP
+func exchangeUDP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, dnsMaxMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// 忽略 ID 不匹配的响应
+		if n < 12 || !bytes.Equal(buf[:2], query[:2]) {
+			continue
+		}
+		var header dnsmessage.Header
+		var p dnsmessage.Parser
+		if header, err = p.Start(buf[:n]); err == nil && header.Truncated {
+			return exchangeTCP(ctx, addr, query)
+		}
+		return buf[:n], nil
+	}
+}
+
+// exchangeTCP 通过 TCP 查询，消息前有 2 字节长度
+func exchangeTCP(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+
+	msg := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(msg, uint16(len(query)))
+	copy(msg[2:], query)
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(conn, length); err != nil {
+		return nil, err
+	}
+	resp := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
+
+// exchangeHTTPS 通过 DNS-over-HTTPS 查询，见 RFC 8484
+func (r *UpstreamDNSResolver) exchangeHTTPS(ctx context.Context, addr string, query []byte) ([]byte, error) {
+	req, err := http.NewRequest(http.MethodPost, addr, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+
+	resp, err := r.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected doh status: %s", resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize))
+}
+
+// SplitResolver 按域名后缀选择域名解析，如 corp.example 匹配 corp.example 及其子域名，最长后缀优先
+type SplitResolver struct {
+	defaultResolver NameResolver
+	routes          map[string]NameResolver
+}
+
+// NewSplitResolver 创建按域名后缀选择的域名解析，未匹配的域名使用 defaultResolver
+func NewSplitResolver(defaultResolver NameResolver, routes map[string]NameResolver) *SplitResolver {
+	normalized := make(map[string]NameResolver, len(routes))
+	for suffix, resolver := range routes {
+		normalized[normalizeDomain(suffix)] = resolver
+	}
+	return &SplitResolver{defaultResolver: defaultResolver, routes: normalized}
+}
+
+func (r *SplitResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return r.route(name).Resolve(ctx, name)
+}
+
+func (r *SplitResolver) ResolveTTL(ctx context.Context, name string) (context.Context, net.IP, time.Duration, error) {
+	return ResolveTTL(r.route(name), ctx, name)
+}
+
+func (r *SplitResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	return ResolveAddrs(r.route(name), ctx, name)
+}
+
+func (r *SplitResolver) route(name string) NameResolver {
+	name = normalizeDomain(name)
+	for {
+		if resolver, ok := r.routes[name]; ok {
+			return resolver
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			return r.defaultResolver
+		}
+		name = name[i+1:]
+	}
+}
+
+func normalizeDomain(name string) string {
+	return strings.ToLower(strings.Trim(name, "."))
+}
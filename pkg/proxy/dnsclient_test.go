@@ -0,0 +1,222 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// fakeDNS 根据查询生成响应，records 中没有的域名返回 NXDOMAIN
+type fakeDNS struct {
+	records  map[string]net.IP
+	rcode    dnsmessage.RCode
+	truncate bool // UDP 响应设置截断标志
+}
+
+func (d *fakeDNS) answer(query []byte, udp bool) []byte {
+	var msg dnsmessage.Message
+	if err := msg.Unpack(query); err != nil {
+		return nil
+	}
+	msg.Response = true
+	msg.RCode = d.rcode
+	if udp && d.truncate {
+		msg.Truncated = true
+	} else if d.rcode == dnsmessage.RCodeSuccess {
+		q := msg.Questions[0]
+		ip, ok := d.records[strings.ToLower(q.Name.String())]
+		switch {
+		case !ok:
+			msg.RCode = dnsmessage.RCodeNameError
+		case q.Type == dnsmessage.TypeA && ip.To4() != nil:
+			var a [4]byte
+			copy(a[:], ip.To4())
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 300},
+				Body:   &dnsmessage.AResource{A: a},
+			})
+		case q.Type == dnsmessage.TypeAAAA && ip.To4() == nil:
+			var aaaa [16]byte
+			copy(aaaa[:], ip)
+			msg.Answers = append(msg.Answers, dnsmessage.Resource{
+				Header: dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: 60},
+				Body:   &dnsmessage.AAAAResource{AAAA: aaaa},
+			})
+		}
+	}
+	resp, _ := msg.Pack()
+	return resp
+}
+
+// serve 在同一端口提供 UDP 和 TCP 服务，返回地址
+func (d *fakeDNS) serve(t *testing.T) string {
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		tcp.Close()
+		udp.Close()
+	})
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := udp.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = udp.WriteTo(d.answer(buf[:n], true), addr)
+		}
+	}()
+	go func() {
+		for {
+			conn, err := tcp.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				length := make([]byte, 2)
+				if _, err := io.ReadFull(conn, length); err != nil {
+					return
+				}
+				query := make([]byte, binary.BigEndian.Uint16(length))
+				if _, err := io.ReadFull(conn, query); err != nil {
+					return
+				}
+				resp := d.answer(query, false)
+				binary.BigEndian.PutUint16(length, uint16(len(resp)))
+				_, _ = conn.Write(append(length, resp...))
+			}()
+		}
+	}()
+	return tcp.Addr().String()
+}
+
+var testRecords = map[string]net.IP{
+	"example.com.":    net.IPv4(10, 0, 0, 1),
+	"v6.example.":     net.ParseIP("2001:db8::1"),
+	"corp.example.":   net.IPv4(172, 16, 0, 1),
+	"a.corp.example.": net.IPv4(172, 16, 0, 2),
+}
+
+func TestUpstreamDNSResolver(t *testing.T) {
+	addr := (&fakeDNS{records: testRecords}).serve(t)
+	doh := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Type") != dohContentType {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		query, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write((&fakeDNS{records: testRecords}).answer(query, false))
+	}))
+	defer doh.Close()
+
+	for _, server := range []string{addr, "udp://" + addr, "tcp://" + addr, doh.URL} {
+		r, err := NewUpstreamDNSResolver(UpstreamDNSConfig{Servers: []string{server}, Timeout: time.Second})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, ip, ttl, err := r.ResolveTTL(context.Background(), "example.com")
+		if err != nil || !ip.Equal(net.IPv4(10, 0, 0, 1)) || ttl != 300*time.Second {
+			t.Errorf("%s: unexpected result: %v, %v, %v", server, ip, ttl, err)
+		}
+		_, ip, ttl, err = r.ResolveTTL(context.Background(), "v6.example")
+		if err != nil || !ip.Equal(net.ParseIP("2001:db8::1")) || ttl != time.Minute {
+			t.Errorf("%s: unexpected result: %v, %v, %v", server, ip, ttl, err)
+		}
+		if _, _, err := r.Resolve(context.Background(), "missing.example"); !isNotFound(err) {
+			t.Errorf("%s: expected not found, got %v", server, err)
+		}
+	}
+}
+
+func TestUpstreamDNSResolverFailover(t *testing.T) {
+	broken := (&fakeDNS{rcode: dnsmessage.RCodeServerFailure}).serve(t)
+	truncated := (&fakeDNS{records: testRecords, truncate: true}).serve(t)
+
+	// 第一个服务器拒绝连接，第二个返回 SERVFAIL，第三个的 UDP 响应被截断后改用 TCP
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+
+	r, err := NewUpstreamDNSResolver(UpstreamDNSConfig{
+		Servers: []string{"tcp://" + closed.Addr().String(), broken, truncated},
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, ip, err := r.Resolve(context.Background(), "example.com")
+	if err != nil || !ip.Equal(net.IPv4(10, 0, 0, 1)) {
+		t.Fatalf("unexpected result: %v, %v", ip, err)
+	}
+
+	r, _ = NewUpstreamDNSResolver(UpstreamDNSConfig{Servers: []string{broken}, Timeout: time.Second})
+	if _, _, err := r.Resolve(context.Background(), "example.com"); err == nil || isNotFound(err) {
+		t.Fatalf("expected server failure, got %v", err)
+	}
+}
+
+func TestParseDNSServer(t *testing.T) {
+	tests := []struct {
+		server, network, addr string
+	}{
+		{"1.1.1.1", "udp", "1.1.1.1:53"},
+		{"udp://1.1.1.1:5353", "udp", "1.1.1.1:5353"},
+		{"tcp://8.8.8.8", "tcp", "8.8.8.8:53"},
+		{"2001:db8::53", "udp", "[2001:db8::53]:53"},
+		{"tcp://[2001:db8::53]", "tcp", "[2001:db8::53]:53"},
+		{"https://dns.google/dns-query", "https", "https://dns.google/dns-query"},
+	}
+	for _, tt := range tests {
+		server, err := parseDNSServer(tt.server)
+		if err != nil || server.network != tt.network || server.addr != tt.addr {
+			t.Errorf("parseDNSServer(%q) = %v, %v, expected %s %s", tt.server, server, err, tt.network, tt.addr)
+		}
+	}
+	if _, err := parseDNSServer("tls://1.1.1.1"); err == nil {
+		t.Error("expected unsupported scheme error")
+	}
+}
+
+func TestSplitResolver(t *testing.T) {
+	corp := (&fakeDNS{records: testRecords}).serve(t)
+	corpResolver, err := NewUpstreamDNSResolver(UpstreamDNSConfig{Servers: []string{corp}, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fallback := &countingResolver{}
+	r := NewSplitResolver(fallback, map[string]NameResolver{".Corp.Example": corpResolver})
+
+	for name, expected := range map[string]net.IP{
+		"corp.example":    net.IPv4(172, 16, 0, 1),
+		"A.corp.example.": net.IPv4(172, 16, 0, 2),
+		"example.com":     net.IPv4(10, 0, 0, 1),
+		"xcorp.example":   net.IPv4(10, 0, 0, 1),
+	} {
+		if _, ip, err := r.Resolve(context.Background(), name); err != nil || !ip.Equal(expected) {
+			t.Errorf("Resolve(%q) = %v, %v, expected %v", name, ip, err, expected)
+		}
+	}
+	if fallback.calls != 2 {
+		t.Errorf("expected 2 fallback calls, got %d", fallback.calls)
+	}
+}
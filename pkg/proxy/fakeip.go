@@ -0,0 +1,102 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// FakeIPPool 从保留地址段中为域名分配伪 IP，并可由伪 IP 还原域名
+// 每个地址记录分配给了哪些使用者，只为这些使用者还原，地址用尽时循环复用最早分配的地址
+type FakeIPPool struct {
+	network *net.IPNet
+	first   uint32
+	size    uint32
+
+	mu     sync.Mutex
+	names  map[string]uint32 // 域名到地址偏移
+	slots  []*fakeIPSlot     // 地址偏移到域名
+	cursor uint32
+}
+
+// fakeIPSlot 一个已分配的伪 IP
+type fakeIPSlot struct {
+	name   string
+	owners map[string]struct{}
+}
+
+// NewFakeIPPool 创建伪 IP 地址池，如 198.18.0.0/15，仅支持 IPv4，不使用网络地址和广播地址
+func NewFakeIPPool(cidr string) (*FakeIPPool, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return nil, err
+	}
+	ip := network.IP.To4()
+	ones, bits := network.Mask.Size()
+	if ip == nil || bits != 32 {
+		return nil, fmt.Errorf("fake ip range must be ipv4: %s", cidr)
+	}
+	if ones > 30 {
+		return nil, fmt.Errorf("fake ip range too small: %s", cidr)
+	}
+	size := uint32(1)<<uint(32-ones) - 2
+	return &FakeIPPool{
+		network: network,
+		first:   binary.BigEndian.Uint32(ip) + 1,
+		size:    size,
+		names:   make(map[string]uint32),
+	}, nil
+}
+
+// Allocate 返回域名对应的伪 IP，未分配时分配新地址，并记录地址分配给了 owner
+func (p *FakeIPPool) Allocate(name, owner string) net.IP {
+	name = normalizeDomain(name)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	offset, ok := p.names[name]
+	if !ok {
+		offset = p.cursor
+		p.cursor = (p.cursor + 1) % p.size
+		slot := &fakeIPSlot{name: name, owners: make(map[string]struct{})}
+		if int(offset) < len(p.slots) {
+			delete(p.names, p.slots[offset].name)
+			p.slots[offset] = slot
+		} else {
+			p.slots = append(p.slots, slot)
+		}
+		p.names[name] = offset
+	}
+	p.slots[offset].owners[owner] = struct{}{}
+
+	ip := make(net.IP, net.IPv4len)
+	binary.BigEndian.PutUint32(ip, p.first+offset)
+	return ip
+}
+
+// Lookup 由伪 IP 还原域名，地址未分配给 owner 时不还原
+func (p *FakeIPPool) Lookup(ip net.IP, owner string) (string, bool) {
+	if !p.Contains(ip) {
+		return "", false
+	}
+	offset := binary.BigEndian.Uint32(ip.To4()) - p.first
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if offset >= p.size || int(offset) >= len(p.slots) {
+		return "", false
+	}
+	slot := p.slots[offset]
+	if _, ok := slot.owners[owner]; !ok {
+		return "", false
+	}
+	return slot.name, true
+}
+
+// Contains 地址是否属于地址池
+func (p *FakeIPPool) Contains(ip net.IP) bool {
+	return len(ip) > 0 && p.network.Contains(ip)
+}
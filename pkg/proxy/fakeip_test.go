@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"net"
+	"testing"
+)
+
+func TestFakeIPPool(t *testing.T) {
+	pool, err := NewFakeIPPool("198.18.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := pool.Allocate("a.example", "alice")
+	if !a.Equal(net.IPv4(198, 18, 0, 1)) || !pool.Allocate("A.example.", "alice").Equal(a) {
+		t.Fatalf("unexpected address: %v", a)
+	}
+	b := pool.Allocate("b.example", "alice")
+	if name, ok := pool.Lookup(b, "alice"); !ok || name != "b.example" {
+		t.Fatalf("Lookup(%v) = %q, %v", b, name, ok)
+	}
+
+	// 只为分配过该地址的使用者还原
+	if _, ok := pool.Lookup(b, "bob"); ok {
+		t.Fatalf("unexpected lookup result for bob")
+	}
+	pool.Allocate("b.example", "bob")
+	if name, ok := pool.Lookup(b, "bob"); !ok || name != "b.example" {
+		t.Fatalf("Lookup(%v) = %q, %v", b, name, ok)
+	}
+
+	// 地址用尽后复用最早分配的地址，原使用者不再还原
+	c := pool.Allocate("c.example", "bob")
+	if !c.Equal(a) {
+		t.Fatalf("expected %v reused, got %v", a, c)
+	}
+	if name, ok := pool.Lookup(a, "bob"); !ok || name != "c.example" {
+		t.Fatalf("expected c.example, got %q", name)
+	}
+	if _, ok := pool.Lookup(a, "alice"); ok {
+		t.Fatalf("unexpected lookup result for alice")
+	}
+
+	for _, ip := range []net.IP{net.IPv4(198, 18, 0, 0), net.IPv4(198, 18, 0, 3), net.IPv4(10, 0, 0, 1), nil} {
+		if _, ok := pool.Lookup(ip, "alice"); ok {
+			t.Errorf("unexpected lookup result for %v", ip)
+		}
+	}
+	if _, err := NewFakeIPPool("2001:db8::/64"); err == nil {
+		t.Error("expected ipv6 range error")
+	}
+}
@@ -0,0 +1,192 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// DefaultConnectionAttemptDelay 前一个连接尝试未完成时开始下一个的等待时间，见 RFC 8305 第 5 节
+const DefaultConnectionAttemptDelay = 250 * time.Millisecond
+
+var NoAllowedAddress = fmt.Errorf("no address of the allowed address family")
+
+// AddressFamily 地址族
+type AddressFamily int
+
+const (
+	FamilyAny AddressFamily = iota
+	FamilyIPv4
+	FamilyIPv6
+)
+
+// ParseAddressFamily 解析地址族，可选 ipv4、ipv6，为空或 any 时不限
+func ParseAddressFamily(s string) (AddressFamily, error) {
+	switch strings.ToLower(s) {
+	case "", "any":
+		return FamilyAny, nil
+	case "ipv4", "ip4", "4":
+		return FamilyIPv4, nil
+	case "ipv6", "ip6", "6":
+		return FamilyIPv6, nil
+	default:
+		return FamilyAny, fmt.Errorf("unknown address family: %s", s)
+	}
+}
+
+func (f AddressFamily) String() string {
+	switch f {
+	case FamilyIPv4:
+		return "ipv4"
+	case FamilyIPv6:
+		return "ipv6"
+	default:
+		return "any"
+	}
+}
+
+func familyOf(ip net.IP) AddressFamily {
+	if ip.To4() != nil {
+		return FamilyIPv4
+	}
+	return FamilyIPv6
+}
+
+// FamilyPolicy 拨号时的地址族策略
+type FamilyPolicy struct {
+	// Prefer 首选地址族，为 FamilyAny 时以第一个解析结果的地址族为首选
+	Prefer AddressFamily
+	// Only 仅使用该地址族，为 FamilyAny 时不限
+	Only AddressFamily
+}
+
+type familyPolicyKey struct{}
+
+// WithFamilyPolicy 在上下文中设置地址族策略，如由 RuleSet 按规则设置
+func WithFamilyPolicy(ctx context.Context, policy FamilyPolicy) context.Context {
+	return context.WithValue(ctx, familyPolicyKey{}, policy)
+}
+
+// FamilyPolicyFromContext 获取上下文中的地址族策略
+func FamilyPolicyFromContext(ctx context.Context) (FamilyPolicy, bool) {
+	policy, ok := ctx.Value(familyPolicyKey{}).(FamilyPolicy)
+	return policy, ok
+}
+
+// SortAddrs 按策略过滤地址，并从首选地址族开始交替排列两个地址族，见 RFC 8305 第 4 节
+// 不修改 ips
+func (p FamilyPolicy) SortAddrs(ips []net.IP) []net.IP {
+	var v4, v6 []net.IP
+	for _, ip := range ips {
+		if familyOf(ip) == FamilyIPv4 {
+			v4 = append(v4, ip)
+		} else {
+			v6 = append(v6, ip)
+		}
+	}
+	switch p.Only {
+	case FamilyIPv4:
+		return v4
+	case FamilyIPv6:
+		return v6
+	}
+
+	prefer := p.Prefer
+	if prefer == FamilyAny && len(ips) > 0 {
+		prefer = familyOf(ips[0])
+	}
+	first, second := v6, v4
+	if prefer == FamilyIPv4 {
+		first, second = v4, v6
+	}
+	sorted := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			sorted = append(sorted, first[i])
+		}
+		if i < len(second) {
+			sorted = append(sorted, second[i])
+		}
+	}
+	return sorted
+}
+
+// DialFunc 拨号函数
+type DialFunc func(ctx context.Context, network, addr string) (net.Conn, error)
+
+// DialHappyEyeballs 按顺序尝试连接各地址，前一个尝试失败或超过 delay 未完成时开始下一个，
+// 返回第一个成功的连接并取消其他尝试，全部失败时返回第一个错误，见 RFC 8305 第 5 节
+// ips 应已由 FamilyPolicy.SortAddrs 排序，delay 为 0 时使用 DefaultConnectionAttemptDelay
+func DialHappyEyeballs(ctx context.Context, dial DialFunc, network string, ips []net.IP, port int, delay time.Duration) (net.Conn, error) {
+	if len(ips) == 0 {
+		return nil, NoAllowedAddress
+	}
+	if delay <= 0 {
+		delay = DefaultConnectionAttemptDelay
+	}
+	if len(ips) == 1 {
+		return dial(ctx, network, net.JoinHostPort(ips[0].String(), strconv.Itoa(port)))
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(ips))
+	var timer *time.Timer
+	next, pending := 0, 0
+	start := func() {
+		addr := net.JoinHostPort(ips[next].String(), strconv.Itoa(port))
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, network, addr)
+			results <- result{conn, err}
+		}()
+		if timer != nil {
+			timer.Stop()
+		}
+		timer = time.NewTimer(delay)
+	}
+	defer func() {
+		timer.Stop()
+	}()
+
+	start()
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// 关闭同时成功的其他连接
+				go func(pending int) {
+					for ; pending > 0; pending-- {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(ips) {
+				start()
+			}
+		case <-timer.C:
+			if next < len(ips) {
+				start()
+			}
+		}
+	}
+	return nil, firstErr
+}
@@ -0,0 +1,110 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+func TestFamilyPolicySortAddrs(t *testing.T) {
+	v4a, v4b := net.IPv4(10, 0, 0, 1), net.IPv4(10, 0, 0, 2)
+	v6a, v6b := net.ParseIP("2001:db8::1"), net.ParseIP("2001:db8::2")
+	ips := []net.IP{v4a, v4b, v6a, v6b}
+
+	tests := []struct {
+		policy   FamilyPolicy
+		expected []net.IP
+	}{
+		{FamilyPolicy{}, []net.IP{v4a, v6a, v4b, v6b}},
+		{FamilyPolicy{Prefer: FamilyIPv6}, []net.IP{v6a, v4a, v6b, v4b}},
+		{FamilyPolicy{Only: FamilyIPv6}, []net.IP{v6a, v6b}},
+		{FamilyPolicy{Prefer: FamilyIPv6, Only: FamilyIPv4}, []net.IP{v4a, v4b}},
+	}
+	for _, tt := range tests {
+		got := tt.policy.SortAddrs(ips)
+		if len(got) != len(tt.expected) {
+			t.Errorf("%+v: got %v, expected %v", tt.policy, got, tt.expected)
+			continue
+		}
+		for i := range got {
+			if !got[i].Equal(tt.expected[i]) {
+				t.Errorf("%+v: got %v, expected %v", tt.policy, got, tt.expected)
+				break
+			}
+		}
+	}
+	if got := (FamilyPolicy{Only: FamilyIPv6}).SortAddrs([]net.IP{v4a}); len(got) != 0 {
+		t.Errorf("expected no address, got %v", got)
+	}
+}
+
+// fakeDialer 按地址模拟拨号结果：hang 一直等待到取消，fail 立即失败，其他成功
+type fakeDialer struct {
+	hang, fail map[string]bool
+
+	mu     sync.Mutex
+	dialed []string
+}
+
+func (d *fakeDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
+	d.mu.Lock()
+	d.dialed = append(d.dialed, addr)
+	d.mu.Unlock()
+
+	switch {
+	case d.hang[addr]:
+		<-ctx.Done()
+		return nil, ctx.Err()
+	case d.fail[addr]:
+		return nil, errors.New("connection refused: " + addr)
+	}
+	client, _ := net.Pipe()
+	return client, nil
+}
+
+func TestDialHappyEyeballs(t *testing.T) {
+	v6, v4 := net.ParseIP("2001:db8::1"), net.IPv4(10, 0, 0, 1)
+	ips := []net.IP{v6, v4}
+
+	// 首选地址无响应，等待 delay 后尝试下一个
+	d := &fakeDialer{hang: map[string]bool{"[2001:db8::1]:80": true}}
+	begin := time.Now()
+	conn, err := DialHappyEyeballs(context.Background(), d.dial, "tcp", ips, 80, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed < 50*time.Millisecond || elapsed > time.Second {
+		t.Errorf("unexpected elapsed time: %v", elapsed)
+	}
+
+	// 首选地址立即失败时不等待 delay
+	d = &fakeDialer{fail: map[string]bool{"[2001:db8::1]:80": true}}
+	begin = time.Now()
+	conn, err = DialHappyEyeballs(context.Background(), d.dial, "tcp", ips, 80, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if elapsed := time.Since(begin); elapsed > time.Second {
+		t.Errorf("unexpected elapsed time: %v", elapsed)
+	}
+
+	// 全部失败时返回第一个错误
+	d = &fakeDialer{fail: map[string]bool{"[2001:db8::1]:80": true, "10.0.0.1:80": true}}
+	_, err = DialHappyEyeballs(context.Background(), d.dial, "tcp", ips, 80, time.Minute)
+	if err == nil || err.Error() != "connection refused: [2001:db8::1]:80" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(d.dialed) != 2 {
+		t.Fatalf("expected 2 attempts, got %v", d.dialed)
+	}
+
+	if _, err := DialHappyEyeballs(context.Background(), d.dial, "tcp", nil, 80, 0); err != NoAllowedAddress {
+		t.Fatalf("expected no address error, got %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// Hosts hosts 文件格式的静态域名解析，每行格式为 IP 域名 [域名...]，# 之后为注释
+// 域名可使用通配符，如 *.staging.example 匹配其所有子域名，精确匹配优先，通配符按文件顺序匹配
+type Hosts struct {
+	exact     map[string][]net.IP
+	wildcards []*hostsWildcard
+}
+
+type hostsWildcard struct {
+	pattern string
+	ips     []net.IP
+}
+
+// LoadHosts 从文件加载静态域名解析
+func LoadHosts(file string) (*Hosts, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h, err := ReadHosts(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return h, nil
+}
+
+// ReadHosts 读取静态域名解析，同一域名出现多次时保留所有地址，按文件顺序排列
+func ReadHosts(r io.Reader) (*Hosts, error) {
+	h := &Hosts{exact: make(map[string][]net.IP)}
+	wildcards := make(map[string]*hostsWildcard)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 {
+			return nil, fmt.Errorf("line %d: bad hosts format", line)
+		}
+		ip := net.ParseIP(fields[0])
+		if ip == nil {
+			return nil, fmt.Errorf("line %d: bad ip: %s", line, fields[0])
+		}
+		for _, name := range fields[1:] {
+			name = normalizeDomain(name)
+			if strings.ContainsAny(name, "*?[") {
+				if _, err := path.Match(name, ""); err != nil {
+					return nil, fmt.Errorf("line %d: bad wildcard: %s", line, name)
+				}
+				w, ok := wildcards[name]
+				if !ok {
+					w = &hostsWildcard{pattern: name}
+					wildcards[name] = w
+					h.wildcards = append(h.wildcards, w)
+				}
+				w.ips = appendIP(w.ips, ip)
+			} else {
+				h.exact[name] = appendIP(h.exact[name], ip)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Len 条目数
+func (h *Hosts) Len() int {
+	return len(h.exact) + len(h.wildcards)
+}
+
+// Lookup 查找域名对应的所有地址
+func (h *Hosts) Lookup(name string) ([]net.IP, bool) {
+	name = normalizeDomain(name)
+	if ips, ok := h.exact[name]; ok {
+		return ips, true
+	}
+	for _, w := range h.wildcards {
+		if ok, _ := path.Match(w.pattern, name); ok {
+			return w.ips, true
+		}
+	}
+	return nil, false
+}
+
+// appendIP 添加不重复的地址
+func appendIP(ips []net.IP, ip net.IP) []net.IP {
+	for _, existing := range ips {
+		if existing.Equal(ip) {
+			return ips
+		}
+	}
+	return append(ips, ip)
+}
+
+// HostsResolver 优先使用静态域名解析，未匹配时使用 next，静态解析可在运行时原子替换
+type HostsResolver struct {
+	hosts atomic.Value // *Hosts
+	next  NameResolver
+}
+
+func NewHostsResolver(hosts *Hosts, next NameResolver) *HostsResolver {
+	r := &HostsResolver{next: next}
+	r.Store(hosts)
+	return r
+}
+
+// Store 替换静态域名解析
+func (r *HostsResolver) Store(hosts *Hosts) {
+	r.hosts.Store(hosts)
+}
+
+func (r *HostsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ips, ok := r.hosts.Load().(*Hosts).Lookup(name); ok {
+		return ctx, ips[0], nil
+	}
+	return r.next.Resolve(ctx, name)
+}
+
+func (r *HostsResolver) ResolveTTL(ctx context.Context, name string) (context.Context, net.IP, time.Duration, error) {
+	if ips, ok := r.hosts.Load().(*Hosts).Lookup(name); ok {
+		return ctx, ips[0], 0, nil
+	}
+	return ResolveTTL(r.next, ctx, name)
+}
+
+func (r *HostsResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if ips, ok := r.hosts.Load().(*Hosts).Lookup(name); ok {
+		return ctx, ips, 0, nil
+	}
+	return ResolveAddrs(r.next, ctx, name)
+}
@@ -0,0 +1,59 @@
+package proxy
+
+import (
+	"net"
+	"strings"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestHostsResolver(t *testing.T) {
+	hosts, err := ReadHosts(strings.NewReader(`
+# staging hosts
+10.0.0.1   api.staging.example   web.staging.example
+10.0.0.2   *.staging.example     # everything else in staging
+10.0.0.3   API.staging.example
+2001:db8::1 v6.example.
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	upstream := &countingResolver{}
+	r := NewHostsResolver(hosts, upstream)
+	for name, expected := range map[string]net.IP{
+		"api.staging.example":  net.IPv4(10, 0, 0, 1),
+		"Web.Staging.Example.": net.IPv4(10, 0, 0, 1),
+		"db.staging.example":   net.IPv4(10, 0, 0, 2),
+		"a.b.staging.example":  net.IPv4(10, 0, 0, 2),
+		"v6.example":           net.ParseIP("2001:db8::1"),
+		"staging.example":      net.IPv4(10, 0, 0, 1), // 由 countingResolver 解析
+	} {
+		if _, ip, err := r.Resolve(context.Background(), name); err != nil || !ip.Equal(expected) {
+			t.Errorf("Resolve(%q) = %v, %v, expected %v", name, ip, err, expected)
+		}
+	}
+	if upstream.calls != 1 {
+		t.Errorf("expected 1 upstream call, got %d", upstream.calls)
+	}
+
+	// 同一域名的所有地址均返回
+	if _, ips, _, err := r.ResolveAddrs(context.Background(), "api.staging.example"); err != nil || len(ips) != 2 ||
+		!ips[0].Equal(net.IPv4(10, 0, 0, 1)) || !ips[1].Equal(net.IPv4(10, 0, 0, 3)) {
+		t.Errorf("unexpected addresses: %v, %v", ips, err)
+	}
+
+	// 替换后立即生效
+	reloaded, _ := ReadHosts(strings.NewReader("10.0.0.9 api.staging.example"))
+	r.Store(reloaded)
+	if _, ip, _ := r.Resolve(context.Background(), "api.staging.example"); !ip.Equal(net.IPv4(10, 0, 0, 9)) {
+		t.Errorf("expected reloaded address, got %v", ip)
+	}
+
+	for _, bad := range []string{"10.0.0.1", "not-an-ip example.com", "10.0.0.1 [bad"} {
+		if _, err := ReadHosts(strings.NewReader(bad)); err == nil {
+			t.Errorf("expected error for %q", bad)
+		}
+	}
+}
@@ -0,0 +1,325 @@
+package proxy
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// 支持的密码哈希算法
+const (
+	HashBcrypt   = "bcrypt"
+	HashArgon2id = "argon2id"
+	HashSHA256   = "sha256"
+	HashSHA512   = "sha512"
+
+	hashArgon2i = "argon2i"
+	hashAPR1    = "apr1"
+
+	// htpasswdSHAPrefix htpasswd -s 生成的无盐 SHA-1 哈希前缀
+	htpasswdSHAPrefix = "{SHA}"
+)
+
+var (
+	unsupportedHash = fmt.Errorf("unsupported password hash")
+	shaHashInsecure = fmt.Errorf("unsalted {SHA} password hash is insecure and not supported, rehash with bcrypt")
+)
+
+var (
+	dummyHash     []byte
+	dummyHashOnce sync.Once
+)
+
+// HtpasswdCredentials 使用 htpasswd 格式文件的用户名密码认证，每行格式为 user:hash
+// 支持 bcrypt（$2y$、$2a$、$2b$）、Apache MD5（$apr1$）、SHA-crypt（$5$、$6$）和 argon2（$argon2id$、$argon2i$），
+// 不支持 htpasswd -s 生成的 {SHA}、-d 生成的 crypt 和 -p 生成的明文
+type HtpasswdCredentials struct {
+	hashes map[string]string
+	// lines 读取时的行，写出时保持顺序和注释
+	lines []htpasswdLine
+}
+
+// htpasswdLine 用户行仅记录用户名，写出时使用当前的哈希；其他行原样保留
+type htpasswdLine struct {
+	user string
+	text string
+}
+
+// LoadHtpasswd 从文件加载用户名和密码哈希
+func LoadHtpasswd(file string) (*HtpasswdCredentials, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	c, err := ReadHtpasswd(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", file, err)
+	}
+	return c, nil
+}
+
+// NewHtpasswd 创建空的 htpasswd 认证
+func NewHtpasswd() *HtpasswdCredentials {
+	return &HtpasswdCredentials{hashes: make(map[string]string)}
+}
+
+// ReadHtpasswd 读取用户名和密码哈希，# 开头的行为注释
+func ReadHtpasswd(r io.Reader) (*HtpasswdCredentials, error) {
+	c := NewHtpasswd()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			c.lines = append(c.lines, htpasswdLine{text: scanner.Text()})
+			continue
+		}
+		splits := strings.SplitN(text, ":", 2)
+		if len(splits) != 2 || splits[0] == "" {
+			return nil, fmt.Errorf("line %d: bad htpasswd format", line)
+		}
+		if err := checkHash(splits[1]); err != nil {
+			return nil, fmt.Errorf("line %d: %v for user %s", line, err, splits[0])
+		}
+		if _, ok := c.hashes[splits[0]]; !ok {
+			c.lines = append(c.lines, htpasswdLine{user: splits[0]})
+		}
+		c.hashes[splits[0]] = splits[1]
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// Len 用户数
+func (c *HtpasswdCredentials) Len() int {
+	return len(c.hashes)
+}
+
+// Has 用户是否存在
+func (c *HtpasswdCredentials) Has(user string) bool {
+	_, ok := c.hashes[user]
+	return ok
+}
+
+// Set 设置用户的密码哈希
+func (c *HtpasswdCredentials) Set(user, hashed string) error {
+	if user == "" || strings.ContainsAny(user, ":\r\n") {
+		return fmt.Errorf("bad user name: %q", user)
+	}
+	if err := checkHash(hashed); err != nil {
+		return err
+	}
+	if _, ok := c.hashes[user]; !ok {
+		c.lines = append(c.lines, htpasswdLine{user: user})
+	}
+	c.hashes[user] = hashed
+	return nil
+}
+
+// Delete 删除用户
+func (c *HtpasswdCredentials) Delete(user string) {
+	delete(c.hashes, user)
+}
+
+// WriteTo 写出 htpasswd 格式内容，保持读取时的顺序和注释，新用户按用户名顺序写在最后
+func (c *HtpasswdCredentials) WriteTo(w io.Writer) (int64, error) {
+	var out []string
+	done := make(map[string]bool, len(c.hashes))
+	for _, line := range c.lines {
+		if line.user == "" {
+			out = append(out, line.text)
+			continue
+		}
+		if hashed, ok := c.hashes[line.user]; ok && !done[line.user] {
+			out = append(out, line.user+":"+hashed)
+			done[line.user] = true
+		}
+	}
+	users := make([]string, 0, len(c.hashes)-len(done))
+	for user := range c.hashes {
+		if !done[user] {
+			users = append(users, user)
+		}
+	}
+	sort.Strings(users)
+	for _, user := range users {
+		out = append(out, user+":"+c.hashes[user])
+	}
+
+	var written int64
+	for _, line := range out {
+		n, err := fmt.Fprintln(w, line)
+		written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (c *HtpasswdCredentials) Valid(user, password string) bool {
+	hashed, ok := c.hashes[user]
+	if !ok {
+		compareDummyHash(password)
+		return false
+	}
+	return VerifyPassword(hashed, password)
+}
+
+// compareDummyHash 用户不存在时仍进行一次比较，使响应时间与用户存在时一致
+func compareDummyHash(password string) {
+	dummyHashOnce.Do(func() {
+		dummyHash, _ = bcrypt.GenerateFromPassword([]byte("lsocks"), bcrypt.DefaultCost)
+	})
+	_ = bcrypt.CompareHashAndPassword(dummyHash, []byte(password))
+}
+
+// VerifyPassword 检查密码与哈希是否匹配，比较耗时与密码内容无关
+func VerifyPassword(hashed, password string) bool {
+	switch hashAlgorithm(hashed) {
+	case HashBcrypt:
+		return bcrypt.CompareHashAndPassword([]byte(hashed), []byte(password)) == nil
+	case HashSHA256, HashSHA512:
+		computed, err := shaCrypt(password, hashed)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+	case hashAPR1:
+		computed, err := apr1Crypt(password, hashed)
+		if err != nil {
+			return false
+		}
+		return subtle.ConstantTimeCompare([]byte(computed), []byte(hashed)) == 1
+	case HashArgon2id, hashArgon2i:
+		return verifyArgon2(hashed, password)
+	default:
+		return false
+	}
+}
+
+// HashPassword 使用指定算法计算密码哈希
+func HashPassword(algorithm, password string) (string, error) {
+	switch algorithm {
+	case HashBcrypt, "":
+		hashed, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		return string(hashed), err
+	case HashSHA256, HashSHA512:
+		salt, err := randomCryptSalt(shaCryptMaxSalt)
+		if err != nil {
+			return "", err
+		}
+		prefix := "$5$"
+		if algorithm == HashSHA512 {
+			prefix = "$6$"
+		}
+		return shaCrypt(password, prefix+salt)
+	case HashArgon2id:
+		salt := make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return "", err
+		}
+		key := argon2.IDKey([]byte(password), salt, argon2Time, argon2Memory, argon2Threads, argon2KeyLen)
+		return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version, argon2Memory, argon2Time, argon2Threads,
+			argon2Encoding.EncodeToString(salt), argon2Encoding.EncodeToString(key)), nil
+	default:
+		return "", fmt.Errorf("%v: %s", unsupportedHash, algorithm)
+	}
+}
+
+// checkHash 检查哈希格式是否支持
+func checkHash(hashed string) error {
+	if strings.HasPrefix(hashed, htpasswdSHAPrefix) {
+		return shaHashInsecure
+	}
+	if hashAlgorithm(hashed) == "" {
+		return unsupportedHash
+	}
+	return nil
+}
+
+func hashAlgorithm(hashed string) string {
+	switch {
+	case strings.HasPrefix(hashed, "$2a$"), strings.HasPrefix(hashed, "$2b$"), strings.HasPrefix(hashed, "$2y$"):
+		return HashBcrypt
+	case strings.HasPrefix(hashed, apr1Prefix):
+		return hashAPR1
+	case strings.HasPrefix(hashed, "$5$"):
+		return HashSHA256
+	case strings.HasPrefix(hashed, "$6$"):
+		return HashSHA512
+	case strings.HasPrefix(hashed, "$argon2id$"):
+		return HashArgon2id
+	case strings.HasPrefix(hashed, "$argon2i$"):
+		return hashArgon2i
+	default:
+		return ""
+	}
+}
+
+// 生成 argon2id 哈希的参数
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024
+	argon2Threads = 2
+	argon2KeyLen  = 32
+)
+
+var argon2Encoding = base64.RawStdEncoding
+
+// verifyArgon2 校验 PHC 格式的 argon2 哈希：$argon2id$v=19$m=65536,t=3,p=2$salt$hash
+func verifyArgon2(hashed, password string) bool {
+	parts := strings.Split(hashed, "$")
+	if len(parts) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil || time < 1 || threads < 1 {
+		return false
+	}
+	salt, err := argon2Encoding.DecodeString(parts[4])
+	if err != nil {
+		return false
+	}
+	key, err := argon2Encoding.DecodeString(parts[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+
+	var computed []byte
+	if parts[1] == "argon2id" {
+		computed = argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	} else {
+		computed = argon2.Key([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	}
+	return subtle.ConstantTimeCompare(computed, key) == 1
+}
+
+func randomCryptSalt(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i := range b {
+		b[i] = cryptAlphabet[int(b[i])%len(cryptAlphabet)]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,134 @@
+package proxy
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestShaCrypt(t *testing.T) {
+	tests := []struct {
+		salt, password, expected string
+	}{
+		{"$5$saltstring", "Hello world!", "$5$saltstring$5B8vYYiY.CVt1RlTTf8KbXBH3hsxY/GNooZaBBGWEc5"},
+		{"$6$saltstring", "Hello world!", "$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1"},
+		{"$5$rounds=10000$saltstringsaltstring", "Hello world!", "$5$rounds=10000$saltstringsaltst$3xv.VbSHBb41AL9AvLeujZkZRBAwqFMz2.opqey6IcA"},
+		{"$6$rounds=10$roundstoolow", "the minimum number is still observed", "$6$rounds=1000$roundstoolow$kUMsbe306n21p9R.FRkW3IGn.S9NPN0x50YhH1xhLsPuWGsUSklZt58jaTfF4ZEQpyUNGc0dqbpBYYBaHHrsX."},
+	}
+	for _, tt := range tests {
+		got, err := shaCrypt(tt.password, tt.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.expected {
+			t.Errorf("shaCrypt(%q, %q) = %q, expected %q", tt.password, tt.salt, got, tt.expected)
+		}
+	}
+}
+
+func TestAPR1Crypt(t *testing.T) {
+	// Generated by htpasswd -m and openssl passwd -apr1
+	tests := []struct {
+		password, expected string
+	}{
+		{"myPassword", "$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/"},
+		{"", "$apr1$abcdefgh$L.PT565ESX4Tp2bqNs7Ie."},
+		{"a much longer password than sixteen bytes", "$apr1$xy$KWmjAYxMqmqTjytotPjDu."},
+	}
+	for _, tt := range tests {
+		got, err := apr1Crypt(tt.password, tt.expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.expected {
+			t.Errorf("apr1Crypt(%q) = %q, expected %q", tt.password, got, tt.expected)
+		}
+	}
+}
+
+func TestHtpasswdFile(t *testing.T) {
+	file := "# managed by ops\n" +
+		"bob:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" +
+		"\n" +
+		"# contractors\n" +
+		"alice:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n"
+	c, err := ReadHtpasswd(strings.NewReader(file))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.Valid("bob", "myPassword") || c.Valid("bob", "wrong") {
+		t.Error("unexpected apr1 verification result")
+	}
+
+	// 修改后保持原有顺序和注释，新用户写在最后
+	c.Delete("alice")
+	hashed, err := HashPassword(HashSHA256, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Set("carol", hashed); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	expected := "# managed by ops\n" +
+		"bob:$apr1$r31.....$HqJZimcKQFAMYayBlzkrA/\n" +
+		"\n" +
+		"# contractors\n" +
+		"carol:" + hashed + "\n"
+	if buf.String() != expected {
+		t.Errorf("unexpected output:\n%s", buf.String())
+	}
+
+	// htpasswd -s 生成的 {SHA} 哈希报错并指明用户
+	_, err = ReadHtpasswd(strings.NewReader("dave:{SHA}5en6G6MezRroT3XKqkdPOmY/BfQ=\n"))
+	if err == nil || !strings.Contains(err.Error(), "{SHA}") || !strings.Contains(err.Error(), "dave") {
+		t.Errorf("expected {SHA} error for dave, got %v", err)
+	}
+}
+
+func TestHtpasswd(t *testing.T) {
+	c := NewHtpasswd()
+	for _, algorithm := range []string{HashBcrypt, HashSHA256, HashSHA512, HashArgon2id} {
+		hashed, err := HashPassword(algorithm, "secret-"+algorithm)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Set(algorithm, hashed); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if _, err := c.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	// Entry generated by openssl passwd -6
+	buf.WriteString("# external\n")
+	buf.WriteString("external-sha512:$6$saltstring$svn8UoSVapNtMuq1ukKS4tPQd8iKwSMHWjl/O817G3uBnIFNjnQJuesI68u4OTLiBFdcbYEdFCoEOfaS35inz1\n")
+
+	loaded, err := ReadHtpasswd(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, algorithm := range []string{HashBcrypt, HashSHA256, HashSHA512, HashArgon2id} {
+		if !loaded.Valid(algorithm, "secret-"+algorithm) {
+			t.Errorf("expected %s password to be valid", algorithm)
+		}
+		if loaded.Valid(algorithm, "wrong") {
+			t.Errorf("expected wrong %s password to be invalid", algorithm)
+		}
+	}
+	if !loaded.Valid("external-sha512", "Hello world!") {
+		t.Error("expected external sha512 password to be valid")
+	}
+	if loaded.Valid("nobody", "secret") {
+		t.Error("expected unknown user to be invalid")
+	}
+
+	if _, err := ReadHtpasswd(strings.NewReader("alice:plaintext\n")); err == nil {
+		t.Error("expected error for plaintext password")
+	}
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+var QuotaExceeded = fmt.Errorf("traffic quota exceeded")
+
+const (
+	quotaDayFormat   = "20060102"
+	quotaMonthFormat = "200601"
+)
+
+// Quota 流量配额，单位字节，为 0 时不限制
+type Quota struct {
+	Daily   int64
+	Monthly int64
+}
+
+// QuotaEnforcer 统计用户当日和当月流量，超出配额后拒绝新的隧道并中断正在转发的隧道
+type QuotaEnforcer struct {
+	mu     sync.Mutex
+	quotas map[string]Quota
+	usages map[string]*quotaUsage
+}
+
+type quotaUsage struct {
+	day     string
+	daily   int64
+	month   string
+	monthly int64
+}
+
+func NewQuotaEnforcer(quotas map[string]Quota) *QuotaEnforcer {
+	e := &QuotaEnforcer{usages: make(map[string]*quotaUsage)}
+	e.SetQuotas(quotas)
+	return e
+}
+
+// SetQuotas 替换所有用户的配额，已统计的流量保留
+func (e *QuotaEnforcer) SetQuotas(quotas map[string]Quota) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.quotas = quotas
+}
+
+// Add 统计用户在 t 时产生的流量，不属于当日或当月的流量被忽略
+func (e *QuotaEnforcer) Add(user string, t time.Time, bytes int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	u := e.usage(user, time.Now())
+	if t.Format(quotaMonthFormat) == u.month {
+		u.monthly += bytes
+	}
+	if t.Format(quotaDayFormat) == u.day {
+		u.daily += bytes
+	}
+}
+
+// Usage 用户当日和当月流量
+func (e *QuotaEnforcer) Usage(user string) (daily, monthly int64) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	u := e.usage(user, time.Now())
+	return u.daily, u.monthly
+}
+
+// Exceeded 用户是否超出配额
+func (e *QuotaEnforcer) Exceeded(user string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	quota, ok := e.quotas[user]
+	if !ok {
+		return false
+	}
+	u := e.usage(user, time.Now())
+	return (quota.Daily > 0 && u.daily >= quota.Daily) || (quota.Monthly > 0 && u.monthly >= quota.Monthly)
+}
+
+// usage 返回用户流量统计，跨日或跨月时清零
+func (e *QuotaEnforcer) usage(user string, now time.Time) *quotaUsage {
+	day, month := now.Format(quotaDayFormat), now.Format(quotaMonthFormat)
+	u, ok := e.usages[user]
+	if !ok {
+		u = &quotaUsage{day: day, month: month}
+		e.usages[user] = u
+	}
+	if u.day != day {
+		u.day, u.daily = day, 0
+	}
+	if u.month != month {
+		u.month, u.monthly = month, 0
+	}
+	return u
+}
+
+// Copier 返回统计流量并在超出配额时中断转发的 Copier，实际转发由 next 完成，next 为空时直接转发
+func (e *QuotaEnforcer) Copier(next Copier) Copier {
+	if next == nil {
+		next = NewSimpleCopier()
+	}
+	return &quotaCopier{enforcer: e, next: next}
+}
+
+type quotaCopier struct {
+	enforcer *QuotaEnforcer
+	next     Copier
+}
+
+func (c *quotaCopier) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return c.next.Copy(dst, src)
+}
+
+func (c *quotaCopier) CopyUser(userIdentifier string, dst io.Writer, src io.Reader) (int64, error) {
+	if userIdentifier == "" {
+		return CopyUser(c.next, userIdentifier, dst, src)
+	}
+	return CopyUser(c.next, userIdentifier, &quotaWriter{writer: dst, enforcer: c.enforcer, user: userIdentifier}, src)
+}
+
+// quotaWriter 写入前检查配额，写入后统计流量
+type quotaWriter struct {
+	writer   io.Writer
+	enforcer *QuotaEnforcer
+	user     string
+}
+
+func (w *quotaWriter) Write(b []byte) (int, error) {
+	if w.enforcer.Exceeded(w.user) {
+		return 0, QuotaExceeded
+	}
+	n, err := w.writer.Write(b)
+	w.enforcer.Add(w.user, time.Now(), int64(n))
+	return n, err
+}
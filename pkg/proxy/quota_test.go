@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestQuotaEnforcer(t *testing.T) {
+	e := NewQuotaEnforcer(map[string]Quota{"alice": {Daily: 100, Monthly: 1000}})
+
+	now := time.Now()
+	e.Add("alice", now.AddDate(0, -1, 0), 5000) // 上月流量不计入
+	e.Add("alice", now, 60)
+	if daily, monthly := e.Usage("alice"); daily != 60 || monthly < 60 {
+		t.Fatalf("unexpected usage: daily=%d, monthly=%d", daily, monthly)
+	}
+	if e.Exceeded("alice") {
+		t.Fatal("alice should not exceed quota")
+	}
+	e.Add("alice", now, 40)
+	if !e.Exceeded("alice") {
+		t.Fatal("alice should exceed daily quota")
+	}
+	e.Add("bob", now, 1<<30)
+	if e.Exceeded("bob") {
+		t.Fatal("bob has no quota")
+	}
+
+	e.SetQuotas(map[string]Quota{"alice": {Monthly: 1 << 20}})
+	if e.Exceeded("alice") {
+		t.Fatal("alice should not exceed raised quota")
+	}
+}
+
+func TestQuotaCopier(t *testing.T) {
+	e := NewQuotaEnforcer(map[string]Quota{"alice": {Daily: 1024}})
+	copier := e.Copier(nil)
+
+	// 以小块写入，超出配额后中断
+	src := io.LimitReader(bytes.NewReader(make([]byte, 4096)), 4096)
+	var dst bytes.Buffer
+	n, err := CopyUser(copier, "alice", &dst, &chunkReader{r: src, size: 256})
+	if err != QuotaExceeded {
+		t.Fatalf("expected quota exceeded, got %d, %v", n, err)
+	}
+	if n != 1024 || dst.Len() != 1024 {
+		t.Errorf("unexpected copied bytes: %d, %d", n, dst.Len())
+	}
+
+	// 无配额的用户不受影响
+	n, err = CopyUser(copier, "bob", io.Discard, bytes.NewReader(make([]byte, 4096)))
+	if err != nil || n != 4096 {
+		t.Errorf("unexpected copy result: %d, %v", n, err)
+	}
+}
+
+type chunkReader struct {
+	r    io.Reader
+	size int
+}
+
+func (r *chunkReader) Read(b []byte) (int, error) {
+	if len(b) > r.size {
+		b = b[:r.size]
+	}
+	return r.r.Read(b)
+}
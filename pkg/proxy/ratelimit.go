@@ -0,0 +1,161 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const (
+	// rateLimitBufSize 限速转发时单次读取的最大字节数
+	rateLimitBufSize = 32 * 1024
+)
+
+// tokenBucket 令牌桶，容量为一秒的令牌数
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64 // 每秒令牌数（字节）
+	tokens float64
+	last   time.Time
+
+	refs int // 使用中的连接数，由 RateLimitCopier.mu 保护
+}
+
+func newTokenBucket(rate int64) *tokenBucket {
+	return &tokenBucket{
+		rate:   float64(rate),
+		tokens: float64(rate),
+		last:   time.Now(),
+	}
+}
+
+// take 取出 n 个令牌，返回需等待的时间，令牌不足时预支
+func (b *tokenBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.rate {
+		b.tokens = b.rate
+	}
+	b.last = now
+
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// full 令牌桶是否已填满，填满的空闲令牌桶可以丢弃
+func (b *tokenBucket) full(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tokens+now.Sub(b.last).Seconds()*b.rate >= b.rate
+}
+
+// RateLimitCopier 按用户限速的数据转发器，同一用户的所有连接共享一个令牌桶
+// 上传和下载需使用不同的 RateLimitCopier
+type RateLimitCopier struct {
+	mu           sync.Mutex
+	defaultLimit int64            // 未单独配置的用户的限速，单位字节每秒，为 0 时不限速
+	limits       map[string]int64 // 用户 => 限速，为 0 时不限速
+	buckets      map[string]*tokenBucket
+	lastPurge    time.Time
+}
+
+// NewRateLimitCopier 创建限速转发器，limits 为用户限速，未配置的用户使用 defaultLimit
+func NewRateLimitCopier(defaultLimit int64, limits map[string]int64) *RateLimitCopier {
+	c := &RateLimitCopier{
+		defaultLimit: defaultLimit,
+		limits:       make(map[string]int64),
+		buckets:      make(map[string]*tokenBucket),
+	}
+	for user, limit := range limits {
+		c.limits[user] = limit
+	}
+	return c
+}
+
+func (c *RateLimitCopier) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	return c.CopyUser("", dst, src)
+}
+
+func (c *RateLimitCopier) CopyUser(userIdentifier string, dst io.Writer, src io.Reader) (int64, error) {
+	bucket := c.acquire(userIdentifier)
+	if bucket == nil {
+		return io.Copy(dst, src)
+	}
+	defer c.release(bucket)
+
+	buf := make([]byte, rateLimitBufSize)
+	var written int64
+	for {
+		// 单次读取不超过令牌桶容量
+		size := len(buf)
+		if float64(size) > bucket.rate {
+			size = int(bucket.rate) + 1
+		}
+
+		nr, rerr := src.Read(buf[:size])
+		if nr > 0 {
+			if wait := bucket.take(nr); wait > 0 {
+				time.Sleep(wait)
+			}
+			nw, werr := dst.Write(buf[:nr])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != nr {
+				return written, io.ErrShortWrite
+			}
+		}
+		if rerr == io.EOF {
+			return written, nil
+		}
+		if rerr != nil {
+			return written, rerr
+		}
+	}
+}
+
+// acquire 获取并占用用户的令牌桶，不限速时返回 nil
+func (c *RateLimitCopier) acquire(userIdentifier string) *tokenBucket {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 每分钟最多一次清除已填满的空闲令牌桶，未填满的保留以免用户重连绕过限速
+	now := time.Now()
+	if now.Sub(c.lastPurge) > time.Minute {
+		c.lastPurge = now
+		for user, b := range c.buckets {
+			if b.refs == 0 && b.full(now) {
+				delete(c.buckets, user)
+			}
+		}
+	}
+
+	b, ok := c.buckets[userIdentifier]
+	if !ok {
+		limit, ok := c.limits[userIdentifier]
+		if !ok {
+			limit = c.defaultLimit
+		}
+		if limit <= 0 {
+			return nil
+		}
+		b = newTokenBucket(limit)
+		c.buckets[userIdentifier] = b
+	}
+	b.refs++
+	return b
+}
+
+// release 释放令牌桶
+func (c *RateLimitCopier) release(b *tokenBucket) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	b.refs--
+}
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRateLimitCopierSharedBucket(t *testing.T) {
+	const rate = 50 * 1024
+	copier := NewRateLimitCopier(0, map[string]int64{"alice": rate})
+
+	begin := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n, err := copier.CopyUser("alice", io.Discard, bytes.NewReader(make([]byte, rate)))
+			if err != nil || n != rate {
+				t.Errorf("unexpected copy result: %d, %v", n, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// Two tunnels share one bucket: 2s worth of data, minus the 1s burst
+	if elapsed := time.Since(begin); elapsed < 800*time.Millisecond {
+		t.Fatalf("copies not limited: %v", elapsed)
+	}
+
+	// Users without a limit are not throttled
+	begin = time.Now()
+	if _, err := copier.CopyUser("bob", io.Discard, bytes.NewReader(make([]byte, 10*rate))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(begin); elapsed > 500*time.Millisecond {
+		t.Fatalf("unlimited copy throttled: %v", elapsed)
+	}
+}
+
+func TestRateLimitCopierPurge(t *testing.T) {
+	copier := NewRateLimitCopier(1024, nil)
+	for user, size := range map[string]int{"alice": 1000, "bob": 10} {
+		if _, err := copier.CopyUser(user, io.Discard, bytes.NewReader(make([]byte, size))); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 空闲且已填满的令牌桶被清除
+	copier.lastPurge = time.Time{}
+	copier.buckets["bob"].last = time.Now().Add(-time.Second)
+	copier.release(copier.acquire("carol"))
+	if _, ok := copier.buckets["bob"]; ok {
+		t.Fatal("idle bucket not purged")
+	}
+	if _, ok := copier.buckets["alice"]; !ok {
+		t.Fatal("bucket with debt purged")
+	}
+}
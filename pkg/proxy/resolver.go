@@ -2,6 +2,7 @@ package proxy
 
 import (
 	"net"
+	"time"
 
 	"golang.org/x/net/context"
 )
@@ -11,6 +12,23 @@ type NameResolver interface {
 	Resolve(ctx context.Context, name string) (context.Context, net.IP, error)
 }
 
+// AddrsResolver 可返回域名所有 A/AAAA 记录的域名解析，有效期为 0 时表示未知
+type AddrsResolver interface {
+	ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error)
+}
+
+// ResolveAddrs 解析域名的所有地址，resolver 未实现 AddrsResolver 时仅返回一个地址
+func ResolveAddrs(resolver NameResolver, ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	if r, ok := resolver.(AddrsResolver); ok {
+		return r.ResolveAddrs(ctx, name)
+	}
+	ctx, ip, ttl, err := ResolveTTL(resolver, ctx, name)
+	if err != nil {
+		return ctx, nil, 0, err
+	}
+	return ctx, []net.IP{ip}, ttl, nil
+}
+
 // DNSResolver 系统域名解析
 type DNSResolver struct{}
 
@@ -21,3 +39,15 @@ func (d DNSResolver) Resolve(ctx context.Context, name string) (context.Context,
 	}
 	return ctx, addr.IP, err
 }
+
+func (d DNSResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, name)
+	if err != nil {
+		return ctx, nil, 0, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		ips = append(ips, addr.IP)
+	}
+	return ctx, ips, 0, nil
+}
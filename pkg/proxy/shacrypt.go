@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+// SHA-crypt 实现，参考 https://www.akkadia.org/drepper/SHA-crypt.txt
+// 格式为 $5$[rounds=N$]salt$hash（SHA-256）或 $6$[rounds=N$]salt$hash（SHA-512）
+
+const (
+	shaCryptDefaultRounds = 5000
+	shaCryptMinRounds     = 1000
+	shaCryptMaxRounds     = 999999999
+	shaCryptMaxSalt       = 16
+
+	cryptAlphabet = "./0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
+)
+
+var (
+	// 输出时按以下顺序每三个字节编码为四个字符
+	sha256CryptOrder = []int{
+		0, 10, 20, 21, 1, 11, 12, 22, 2, 3, 13, 23, 24, 4, 14,
+		15, 25, 5, 6, 16, 26, 27, 7, 17, 18, 28, 8, 9, 19, 29,
+	}
+	sha512CryptOrder = []int{
+		0, 21, 42, 22, 43, 1, 44, 2, 23, 3, 24, 45, 25, 46, 4,
+		47, 5, 26, 6, 27, 48, 28, 49, 7, 50, 8, 29, 9, 30, 51,
+		31, 52, 10, 53, 11, 32, 12, 33, 54, 34, 55, 13, 56, 14, 35,
+		15, 36, 57, 37, 58, 16, 59, 17, 38, 18, 39, 60, 40, 61, 19,
+		62, 20, 41,
+	}
+)
+
+// shaCrypt 使用 hashed 中的算法、轮数和盐计算 password 的 SHA-crypt 哈希
+func shaCrypt(password, hashed string) (string, error) {
+	var newHash func() hash.Hash
+	var order []int
+	var prefix string
+	switch {
+	case strings.HasPrefix(hashed, "$5$"):
+		newHash, order, prefix = sha256.New, sha256CryptOrder, "$5$"
+	case strings.HasPrefix(hashed, "$6$"):
+		newHash, order, prefix = sha512.New, sha512CryptOrder, "$6$"
+	default:
+		return "", fmt.Errorf("not a sha-crypt hash")
+	}
+
+	rest := strings.TrimPrefix(hashed, prefix)
+	rounds, customRounds := shaCryptDefaultRounds, false
+	if strings.HasPrefix(rest, "rounds=") {
+		i := strings.Index(rest, "$")
+		if i < 0 {
+			return "", fmt.Errorf("bad sha-crypt rounds")
+		}
+		n, err := strconv.Atoi(strings.TrimPrefix(rest[:i], "rounds="))
+		if err != nil {
+			return "", fmt.Errorf("bad sha-crypt rounds")
+		}
+		if n < shaCryptMinRounds {
+			n = shaCryptMinRounds
+		} else if n > shaCryptMaxRounds {
+			n = shaCryptMaxRounds
+		}
+		rounds, customRounds, rest = n, true, rest[i+1:]
+	}
+	salt := rest
+	if i := strings.Index(salt, "$"); i >= 0 {
+		salt = salt[:i]
+	}
+	if len(salt) > shaCryptMaxSalt {
+		salt = salt[:shaCryptMaxSalt]
+	}
+
+	sum := shaCryptSum(newHash, []byte(password), []byte(salt), rounds)
+
+	var sb strings.Builder
+	sb.WriteString(prefix)
+	if customRounds {
+		sb.WriteString(fmt.Sprintf("rounds=%d$", rounds))
+	}
+	sb.WriteString(salt)
+	sb.WriteByte('$')
+	for i := 0; i+2 < len(order); i += 3 {
+		encodeCrypt24(&sb, sum[order[i]], sum[order[i+1]], sum[order[i+2]], 4)
+	}
+	if len(sum) == sha256.Size {
+		encodeCrypt24(&sb, 0, sum[31], sum[30], 3)
+	} else {
+		encodeCrypt24(&sb, 0, 0, sum[63], 2)
+	}
+	return sb.String(), nil
+}
+
+func shaCryptSum(newHash func() hash.Hash, password, salt []byte, rounds int) []byte {
+	// B = H(P S P)
+	h := newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(password)
+	b := h.Sum(nil)
+
+	// A = H(P S B... )
+	h = newHash()
+	h.Write(password)
+	h.Write(salt)
+	h.Write(repeatBytes(b, len(password)))
+	for n := len(password); n > 0; n >>= 1 {
+		if n&1 != 0 {
+			h.Write(b)
+		} else {
+			h.Write(password)
+		}
+	}
+	a := h.Sum(nil)
+
+	// DP = H(P...), P' = DP 截取至 P 的长度
+	h = newHash()
+	for i := 0; i < len(password); i++ {
+		h.Write(password)
+	}
+	p := repeatBytes(h.Sum(nil), len(password))
+
+	// DS = H(S...), S' = DS 截取至 S 的长度
+	h = newHash()
+	for i := 0; i < 16+int(a[0]); i++ {
+		h.Write(salt)
+	}
+	s := repeatBytes(h.Sum(nil), len(salt))
+
+	c := a
+	for i := 0; i < rounds; i++ {
+		h = newHash()
+		if i&1 != 0 {
+			h.Write(p)
+		} else {
+			h.Write(c)
+		}
+		if i%3 != 0 {
+			h.Write(s)
+		}
+		if i%7 != 0 {
+			h.Write(p)
+		}
+		if i&1 != 0 {
+			h.Write(c)
+		} else {
+			h.Write(p)
+		}
+		c = h.Sum(nil)
+	}
+	return c
+}
+
+// repeatBytes 重复 b 直到长度为 n
+func repeatBytes(b []byte, n int) []byte {
+	out := make([]byte, 0, n)
+	for len(out) < n {
+		if n-len(out) < len(b) {
+			return append(out, b[:n-len(out)]...)
+		}
+		out = append(out, b...)
+	}
+	return out
+}
+
+func encodeCrypt24(sb *strings.Builder, b2, b1, b0 byte, n int) {
+	w := uint(b2)<<16 | uint(b1)<<8 | uint(b0)
+	for i := 0; i < n; i++ {
+		sb.WriteByte(cryptAlphabet[w&0x3f])
+		w >>= 6
+	}
+}
@@ -0,0 +1,341 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const (
+	ACLAllow = "allow"
+	ACLDeny  = "deny"
+)
+
+// ACLConfig 访问控制配置，按顺序匹配规则，第一条匹配的规则决定是否允许
+// 没有规则匹配时使用 Default，为空时拒绝
+type ACLConfig struct {
+	Default string           `json:"default"`
+	Rules   []*ACLRuleConfig `json:"rules"`
+}
+
+// ACLRuleConfig 访问控制规则，各条件同时满足时规则匹配，条件为空时不限制
+type ACLRuleConfig struct {
+	// Action allow 或 deny
+	Action string `json:"action"`
+	// Commands 请求命令，可选 connect、bind、associate
+	Commands []string `json:"commands,omitempty"`
+	// Users 用户名，匿名用户为空字符串
+	Users []string `json:"users,omitempty"`
+	// Sources 请求者地址，CIDR 或 IP
+	Sources []string `json:"sources,omitempty"`
+	// Destinations 目标地址，CIDR 或 IP，目标为域名时使用解析后的地址
+	Destinations []string `json:"destinations,omitempty"`
+	// Domains 目标域名，支持：
+	//   example.com        完全匹配
+	//   .example.com       example.com 及其子域名
+	//   *.example.com      通配符，* 可匹配多级
+	//   regexp:^ad\d+\.    正则表达式
+	Domains []string `json:"domains,omitempty"`
+	// Ports 目标端口，如 443 或 8000-9000
+	Ports []string `json:"ports,omitempty"`
+
+	// PreferFamily 允许 connect 时首选的地址族，ipv4 或 ipv6，为空时以第一个解析结果为首选
+	PreferFamily string `json:"prefer_family,omitempty"`
+	// Family 允许 connect 时仅使用的地址族，ipv4 或 ipv6，为空时不限
+	Family string `json:"family,omitempty"`
+}
+
+// ACL 基于规则的访问控制
+type ACL struct {
+	allowByDefault bool
+	rules          []*aclRule
+}
+
+type aclRule struct {
+	allow        bool
+	commands     map[uint8]bool
+	users        map[string]bool
+	sources      []*net.IPNet
+	destinations []*net.IPNet
+	domains      []domainMatcher
+	ports        []portRange
+	policy       *proxy.FamilyPolicy
+}
+
+type domainMatcher func(domain string) bool
+
+type portRange struct {
+	from, to int
+}
+
+// LoadACL 从 JSON 文件加载访问控制规则
+func LoadACL(file string) (*ACL, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &ACLConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("parse acl file %s: %v", file, err)
+	}
+	return NewACL(conf)
+}
+
+// NewACL 创建访问控制
+func NewACL(conf *ACLConfig) (*ACL, error) {
+	allowByDefault, err := parseACLAction(conf.Default)
+	if err != nil {
+		return nil, err
+	}
+
+	acl := &ACL{allowByDefault: allowByDefault}
+	for i, rc := range conf.Rules {
+		rule, err := newACLRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("acl rule %d: %v", i, err)
+		}
+		acl.rules = append(acl.rules, rule)
+	}
+	return acl, nil
+}
+
+func (a *ACL) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	for _, rule := range a.rules {
+		if rule.match(req) {
+			if rule.allow && rule.policy != nil {
+				ctx = proxy.WithFamilyPolicy(ctx, *rule.policy)
+			}
+			return ctx, rule.allow
+		}
+	}
+	return ctx, a.allowByDefault
+}
+
+func newACLRule(conf *ACLRuleConfig) (*aclRule, error) {
+	if conf.Action == "" {
+		return nil, fmt.Errorf("action required")
+	}
+	allow, err := parseACLAction(conf.Action)
+	if err != nil {
+		return nil, err
+	}
+
+	rule := &aclRule{allow: allow}
+	if len(conf.Commands) > 0 {
+		rule.commands = make(map[uint8]bool)
+		for _, c := range conf.Commands {
+			switch strings.ToLower(c) {
+			case "connect":
+				rule.commands[CommandConnect] = true
+			case "bind":
+				rule.commands[CommandBind] = true
+			case "associate":
+				rule.commands[CommandUDPAssociate] = true
+			default:
+				return nil, fmt.Errorf("unknown command: %s", c)
+			}
+		}
+	}
+	if len(conf.Users) > 0 {
+		rule.users = make(map[string]bool)
+		for _, u := range conf.Users {
+			rule.users[u] = true
+		}
+	}
+	if rule.sources, err = parseCIDRs(conf.Sources); err != nil {
+		return nil, err
+	}
+	if rule.destinations, err = parseCIDRs(conf.Destinations); err != nil {
+		return nil, err
+	}
+	for _, d := range conf.Domains {
+		m, err := parseDomainMatcher(d)
+		if err != nil {
+			return nil, err
+		}
+		rule.domains = append(rule.domains, m)
+	}
+	for _, p := range conf.Ports {
+		r, err := parsePortRange(p)
+		if err != nil {
+			return nil, err
+		}
+		rule.ports = append(rule.ports, r)
+	}
+	if conf.PreferFamily != "" || conf.Family != "" {
+		policy := &proxy.FamilyPolicy{}
+		if policy.Prefer, err = proxy.ParseAddressFamily(conf.PreferFamily); err != nil {
+			return nil, err
+		}
+		if policy.Only, err = proxy.ParseAddressFamily(conf.Family); err != nil {
+			return nil, err
+		}
+		rule.policy = policy
+	}
+	return rule, nil
+}
+
+func (r *aclRule) match(req *Request) bool {
+	if r.commands != nil && !r.commands[req.Command] {
+		return false
+	}
+	if r.users != nil {
+		user := ""
+		if req.AuthContext != nil {
+			user = req.AuthContext.UserIdentifier
+		}
+		if !r.users[user] {
+			return false
+		}
+	}
+	if r.sources != nil && (req.RemoteAddr == nil || !containsIP(r.sources, req.RemoteAddr.IP)) {
+		return false
+	}
+	if r.destinations != nil && (req.DestAddr == nil || !containsIP(r.destinations, req.DestAddr.IP)) {
+		return false
+	}
+	if r.domains != nil {
+		if req.DestAddr == nil || req.DestAddr.FQDN == "" {
+			return false
+		}
+		domain := strings.ToLower(strings.TrimSuffix(req.DestAddr.FQDN, "."))
+		matched := false
+		for _, m := range r.domains {
+			if m(domain) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if r.ports != nil {
+		if req.DestAddr == nil {
+			return false
+		}
+		matched := false
+		for _, p := range r.ports {
+			if req.DestAddr.Port >= p.from && req.DestAddr.Port <= p.to {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// parseACLAction 解析动作，为空时拒绝
+func parseACLAction(action string) (bool, error) {
+	switch strings.ToLower(action) {
+	case "", ACLDeny:
+		return false, nil
+	case ACLAllow:
+		return true, nil
+	default:
+		return false, fmt.Errorf("unknown action: %s", action)
+	}
+}
+
+// parseCIDRs 解析 CIDR 列表，单个 IP 视为主机地址
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, c := range cidrs {
+		if !strings.Contains(c, "/") {
+			ip := net.ParseIP(c)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip: %s", c)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, fmt.Errorf("bad cidr: %s", c)
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	if len(ip) == 0 {
+		return false
+	}
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func parseDomainMatcher(pattern string) (domainMatcher, error) {
+	if strings.HasPrefix(pattern, "regexp:") {
+		re, err := regexp.Compile(strings.TrimPrefix(pattern, "regexp:"))
+		if err != nil {
+			return nil, fmt.Errorf("bad domain regexp: %s", pattern)
+		}
+		return re.MatchString, nil
+	}
+
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	switch {
+	case pattern == "":
+		return nil, fmt.Errorf("empty domain")
+	case strings.HasPrefix(pattern, "."):
+		return func(domain string) bool {
+			return domain == pattern[1:] || strings.HasSuffix(domain, pattern)
+		}, nil
+	case strings.ContainsAny(pattern, "*?["):
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("bad domain wildcard: %s", pattern)
+		}
+		return func(domain string) bool {
+			ok, _ := path.Match(pattern, domain)
+			return ok
+		}, nil
+	default:
+		return func(domain string) bool {
+			return domain == pattern
+		}, nil
+	}
+}
+
+func parsePortRange(s string) (portRange, error) {
+	from, to := s, s
+	if i := strings.Index(s, "-"); i >= 0 {
+		from, to = s[:i], s[i+1:]
+	}
+
+	f, err := strconv.Atoi(strings.TrimSpace(from))
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port: %s", s)
+	}
+	t, err := strconv.Atoi(strings.TrimSpace(to))
+	if err != nil {
+		return portRange{}, fmt.Errorf("bad port: %s", s)
+	}
+	if f < 0 || t > 65535 || f > t {
+		return portRange{}, fmt.Errorf("bad port range: %s", s)
+	}
+	return portRange{from: f, to: t}, nil
+}
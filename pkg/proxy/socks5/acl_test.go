@@ -0,0 +1,95 @@
+package socks5
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestACL(t *testing.T) {
+	acl, err := NewACL(&ACLConfig{
+		Default: ACLAllow,
+		Rules: []*ACLRuleConfig{
+			{Action: ACLDeny, Destinations: []string{"10.0.0.0/8", "127.0.0.1"}},
+			{Action: ACLDeny, Commands: []string{"bind"}},
+			{Action: ACLAllow, Users: []string{"alice"}, Domains: []string{".example.com"}, Ports: []string{"443", "8000-9000"}},
+			{Action: ACLDeny, Users: []string{"alice"}},
+			{Action: ACLDeny, Sources: []string{"192.168.1.0/24"}, Domains: []string{"*.ads.net", "regexp:^tracker\\d+\\."}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		command uint8
+		user    string
+		source  string
+		fqdn    string
+		ip      string
+		port    int
+		allow   bool
+	}{
+		{"internal range", CommandConnect, "", "1.1.1.1", "", "10.1.2.3", 80, false},
+		{"internal host", CommandConnect, "", "1.1.1.1", "localhost", "127.0.0.1", 80, false},
+		{"bind", CommandBind, "", "1.1.1.1", "", "8.8.8.8", 80, false},
+		{"user suffix", CommandConnect, "alice", "1.1.1.1", "www.example.com", "93.184.216.34", 443, true},
+		{"user exact suffix", CommandConnect, "alice", "1.1.1.1", "EXAMPLE.com", "93.184.216.34", 8080, true},
+		{"user bad port", CommandConnect, "alice", "1.1.1.1", "www.example.com", "93.184.216.34", 80, false},
+		{"user bad domain", CommandConnect, "alice", "1.1.1.1", "example.org", "93.184.216.34", 443, false},
+		{"wildcard", CommandConnect, "bob", "192.168.1.9", "x.y.ads.net", "8.8.8.8", 443, false},
+		{"regexp", CommandConnect, "bob", "192.168.1.9", "tracker12.io", "8.8.8.8", 443, false},
+		{"other source", CommandConnect, "bob", "192.168.2.9", "x.ads.net", "8.8.8.8", 443, true},
+		{"default", CommandUDPAssociate, "", "1.1.1.1", "", "8.8.8.8", 53, true},
+	}
+	for _, tt := range tests {
+		req := &Request{
+			Command:     tt.command,
+			AuthContext: &AuthContext{UserIdentifier: tt.user},
+			RemoteAddr:  &AddrSpec{IP: net.ParseIP(tt.source), Port: 50000},
+			DestAddr:    &AddrSpec{FQDN: tt.fqdn, IP: net.ParseIP(tt.ip), Port: tt.port},
+		}
+		if _, allow := acl.Allow(context.Background(), req); allow != tt.allow {
+			t.Errorf("%s: expected allow=%v, got %v", tt.name, tt.allow, allow)
+		}
+	}
+}
+
+func TestLoadACL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "acl.json")
+	data := `{"rules": [{"action": "allow", "commands": ["connect"], "ports": ["80"]}]}`
+	if err := os.WriteFile(file, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	acl, err := LoadACL(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := &Request{Command: CommandConnect, DestAddr: &AddrSpec{IP: net.ParseIP("8.8.8.8"), Port: 80}}
+	if _, allow := acl.Allow(context.Background(), req); !allow {
+		t.Fatal("expected connect to port 80 to be allowed")
+	}
+	req.DestAddr.Port = 81
+	if _, allow := acl.Allow(context.Background(), req); allow {
+		t.Fatal("expected default to deny")
+	}
+
+	for _, bad := range []string{
+		`{"rules": [{"action": "maybe"}]}`,
+		`{"rules": [{"action": "deny", "ports": ["90-80"]}]}`,
+		`{"rules": [{"action": "deny", "sources": ["10.0.0.0/33"]}]}`,
+		`{"rules": [{"action": "deny", "domains": ["regexp:("]}]}`,
+	} {
+		if err := os.WriteFile(file, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := LoadACL(file); err == nil {
+			t.Errorf("expected error for %s", bad)
+		}
+	}
+}
@@ -3,6 +3,7 @@ package socks5
 import (
 	"fmt"
 	"io"
+	"net"
 
 	"github.com/liamylian/lsocks/pkg/proxy"
 )
@@ -16,6 +17,7 @@ const (
 	userAuthVersion = uint8(1)
 	authSuccess     = uint8(0)
 	authFailure     = uint8(1)
+	authUnavailable = uint8(2) // 鉴权服务不可用，RFC 1929 中非 0 即为失败，使用不同的值以便客户端区分
 )
 
 var (
@@ -27,7 +29,7 @@ var (
 type AuthContext struct {
 	Method         uint8             // 认证方法
 	UserIdentifier string            // 用户标识
-	Payload        map[string]string // 认证过程载荷，对于 Method = MethodUserPassAuth，为用户名和密码
+	Payload        map[string]string // 认证过程载荷，对于 Method = MethodUserPassAuth，为用户名和 CredentialStore 提供的用户属性
 }
 
 // Authenticator 鉴权器
@@ -51,6 +53,8 @@ func (a NoAuthAuthenticator) Authenticate(reader io.Reader, writer io.Writer) (*
 // UserPassAuthenticator 用户名密码鉴权
 type UserPassAuthenticator struct {
 	Credentials proxy.CredentialStore
+	// Guard 鉴权失败限制，为空时不限制
+	Guard *AuthGuard
 }
 
 func (a UserPassAuthenticator) GetCode() uint8 {
@@ -94,17 +98,69 @@ func (a UserPassAuthenticator) Authenticate(reader io.Reader, writer io.Writer)
 	}
 
 	// Verify the password
-	if a.Credentials.Valid(string(user), string(pass)) {
-		if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
-			return nil, err
+	attributes, err := a.verify(remoteIP(writer), string(user), string(pass))
+	if err != nil {
+		status := authFailure
+		if err == proxy.CredentialsUnavailable {
+			status = authUnavailable
 		}
-	} else {
-		if _, err := writer.Write([]byte{userAuthVersion, authFailure}); err != nil {
+		if _, err := writer.Write([]byte{userAuthVersion, status}); err != nil {
 			return nil, err
 		}
-		return nil, UserAuthFailed
+		return nil, err
+	}
+	if _, err := writer.Write([]byte{userAuthVersion, authSuccess}); err != nil {
+		return nil, err
 	}
 
 	// Done
-	return &AuthContext{MethodUserPassAuth, string(user), map[string]string{"Username": string(user)}}, nil
+	return &AuthContext{MethodUserPassAuth, string(user), userPassPayload(string(user), attributes)}, nil
+}
+
+// verify 校验用户名密码，成功时返回用户属性，配置了 Guard 时，退避或锁定期间直接拒绝
+// 鉴权服务不可用时返回 proxy.CredentialsUnavailable，不计入鉴权失败
+func (a UserPassAuthenticator) verify(ip net.IP, user, pass string) (map[string]string, error) {
+	if a.Guard != nil {
+		if err := a.Guard.check(ip, user); err != nil {
+			return nil, fmt.Errorf("%v: ip=%v, user=%s", err, ip, user)
+		}
+	}
+
+	attributes, ok, err := proxy.CheckAttributes(a.Credentials, user, pass)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		if a.Guard != nil {
+			a.Guard.fail(ip, user)
+		}
+		return nil, UserAuthFailed
+	}
+
+	if a.Guard != nil {
+		a.Guard.succeed(ip, user)
+	}
+	return attributes, nil
+}
+
+// userPassPayload 用户名密码鉴权载荷，包含用户名和鉴权服务提供的用户属性
+func userPassPayload(user string, attributes map[string]string) map[string]string {
+	payload := make(map[string]string, len(attributes)+1)
+	for k, v := range attributes {
+		payload[k] = v
+	}
+	payload["Username"] = user
+	return payload
+}
+
+// remoteIP 返回连接的来源 IP，无法获取时为空
+func remoteIP(conn interface{}) net.IP {
+	c, ok := conn.(interface{ RemoteAddr() net.Addr })
+	if !ok {
+		return nil
+	}
+	if addr, ok := c.RemoteAddr().(*net.TCPAddr); ok {
+		return addr.IP
+	}
+	return nil
 }
@@ -0,0 +1,346 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+var _ proxy.Dialer = (*Client)(nil)
+
+// ReplyError 代理服务返回的失败响应
+type ReplyError struct {
+	Reply uint8
+}
+
+func (e *ReplyError) Error() string {
+	return fmt.Sprintf("socks5 request failed with reply %d", e.Reply)
+}
+
+// Client SOCKS5 客户端，支持 CONNECT、BIND 和 UDP ASSOCIATE
+type Client struct {
+	// ProxyAddr 代理服务地址
+	ProxyAddr string
+
+	// Username 用户名，为空时无需鉴权
+	Username string
+
+	// Password 密码
+	Password string
+
+	// Forward 连接代理服务的拨号器，默认直接拨号
+	Forward proxy.Dialer
+}
+
+// NewClient 创建客户端，username 为空时无需鉴权
+func NewClient(proxyAddr, username, password string) *Client {
+	return &Client{
+		ProxyAddr: proxyAddr,
+		Username:  username,
+		Password:  password,
+	}
+}
+
+// Dial 通过代理连接到 addr
+func (c *Client) Dial(network, addr string) (net.Conn, error) {
+	return c.DialContext(context.Background(), network, addr)
+}
+
+// DialContext 通过代理连接到 addr，仅支持 TCP，UDP 请使用 ListenPacket
+func (c *Client) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4", "tcp6":
+	default:
+		return nil, fmt.Errorf("network %s not supported by socks5 client", network)
+	}
+
+	dest, err := ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, _, err := c.request(ctx, CommandConnect, dest)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Bind 请求代理服务监听，通过 Binding.Addr 获取对端应连接的地址
+// addr 为期望连入的对端地址
+func (c *Client) Bind(ctx context.Context, addr string) (*Binding, error) {
+	dest, err := ParseAddrSpec(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, bind, err := c.request(ctx, CommandBind, dest)
+	if err != nil {
+		return nil, err
+	}
+	return &Binding{conn: conn, addr: bind}, nil
+}
+
+// ListenPacket 建立 UDP 关联，返回的 PacketConn 通过代理收发数据报
+// 关闭 PacketConn 时将结束 UDP 关联
+func (c *Client) ListenPacket(ctx context.Context) (net.PacketConn, error) {
+	ctrl, err := c.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// 使用与控制连接相同的本地地址收发数据报
+	local := ctrl.LocalAddr().(*net.TCPAddr)
+	packetConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		ctrl.Close()
+		return nil, err
+	}
+
+	udpLocal := packetConn.LocalAddr().(*net.UDPAddr)
+	bind, err := c.sendRequest(ctx, ctrl, CommandUDPAssociate, &AddrSpec{IP: udpLocal.IP, Port: udpLocal.Port})
+	if err != nil {
+		packetConn.Close()
+		ctrl.Close()
+		return nil, err
+	}
+
+	// 代理服务监听在未指定地址时，使用代理服务地址
+	relay := &net.UDPAddr{IP: bind.IP, Port: bind.Port}
+	if len(bind.IP) == 0 || bind.IP.IsUnspecified() {
+		relay.IP = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+
+	return &clientPacketConn{UDPConn: packetConn, ctrl: ctrl, relay: relay}, nil
+}
+
+// request 连接代理服务并发送请求，返回连接和响应中的地址
+func (c *Client) request(ctx context.Context, command uint8, dest *AddrSpec) (net.Conn, *AddrSpec, error) {
+	conn, err := c.connect(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	bind, err := c.sendRequest(ctx, conn, command, dest)
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, bind, nil
+}
+
+// connect 连接代理服务并完成鉴权
+func (c *Client) connect(ctx context.Context) (net.Conn, error) {
+	forward := c.Forward
+	if forward == nil {
+		forward = proxy.Direct
+	}
+	conn, err := forward.DialContext(ctx, "tcp", c.ProxyAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	setContextDeadline(ctx, conn)
+	if err := c.authenticate(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// authenticate 协商鉴权方式并鉴权
+func (c *Client) authenticate(conn net.Conn) error {
+	methods := []byte{MethodNoAuth}
+	if c.Username != "" {
+		methods = append(methods, MethodUserPassAuth)
+	}
+	msg := append([]byte{socks5Version, byte(len(methods))}, methods...)
+	if _, err := conn.Write(msg); err != nil {
+		return err
+	}
+
+	resp := []byte{0, 0}
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		return err
+	}
+	if resp[0] != socks5Version {
+		return fmt.Errorf("unsupported SOCKS version: %v", resp[0])
+	}
+
+	switch resp[1] {
+	case MethodNoAuth:
+		return nil
+	case MethodUserPassAuth:
+		if c.Username == "" {
+			return NoSupportedAuth
+		}
+		if len(c.Username) > 255 || len(c.Password) > 255 {
+			return fmt.Errorf("username or password too long")
+		}
+		msg := []byte{userAuthVersion, byte(len(c.Username))}
+		msg = append(msg, c.Username...)
+		msg = append(msg, byte(len(c.Password)))
+		msg = append(msg, c.Password...)
+		if _, err := conn.Write(msg); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return err
+		}
+		if resp[1] != authSuccess {
+			return UserAuthFailed
+		}
+		return nil
+	default:
+		return NoSupportedAuth
+	}
+}
+
+// sendRequest 发送请求并读取响应
+func (c *Client) sendRequest(ctx context.Context, conn net.Conn, command uint8, dest *AddrSpec) (*AddrSpec, error) {
+	msg, err := appendAddrSpec([]byte{socks5Version, command, 0}, dest)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := conn.Write(msg); err != nil {
+		return nil, err
+	}
+
+	bind, err := readReply(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	// 请求完成，清除握手超时
+	if _, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(time.Time{})
+	}
+	return bind, nil
+}
+
+// readReply 读取响应，非成功响应返回 ReplyError
+func readReply(r io.Reader) (*AddrSpec, error) {
+	header := []byte{0, 0, 0}
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if header[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported reply version: %v", header[0])
+	}
+
+	addr, err := readAddrSpec(r)
+	if err != nil {
+		return nil, err
+	}
+	if header[1] != ReplySuccess {
+		return nil, &ReplyError{Reply: header[1]}
+	}
+	return addr, nil
+}
+
+// setContextDeadline 握手过程受上下文超时限制
+func setContextDeadline(ctx context.Context, conn net.Conn) {
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+}
+
+// Binding BIND 请求的结果
+type Binding struct {
+	conn net.Conn
+	addr *AddrSpec
+}
+
+// Addr 代理服务监听的地址，对端应连接到该地址
+func (b *Binding) Addr() *AddrSpec {
+	return b.addr
+}
+
+// Accept 等待对端连入，返回与对端通信的连接及对端地址
+// 仅可调用一次
+func (b *Binding) Accept() (net.Conn, *AddrSpec, error) {
+	peer, err := readReply(b.conn)
+	if err != nil {
+		b.conn.Close()
+		return nil, nil, err
+	}
+	return b.conn, peer, nil
+}
+
+// Close 放弃等待对端连入
+func (b *Binding) Close() error {
+	return b.conn.Close()
+}
+
+// clientPacketConn 通过 UDP 关联收发数据报
+type clientPacketConn struct {
+	*net.UDPConn
+	ctrl  net.Conn
+	relay *net.UDPAddr
+}
+
+// clientPacketAddr 数据报的来源地址，可能为域名
+type clientPacketAddr struct {
+	*AddrSpec
+}
+
+func (a clientPacketAddr) Network() string {
+	return "udp"
+}
+
+func (a clientPacketAddr) String() string {
+	return a.Address()
+}
+
+func (c *clientPacketConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	buf := make([]byte, udpBufSize)
+	for {
+		n, from, err := c.UDPConn.ReadFromUDP(buf)
+		if err != nil {
+			return 0, nil, err
+		}
+		if !from.IP.Equal(c.relay.IP) || from.Port != c.relay.Port {
+			continue
+		}
+
+		addr, data, err := readUDPDatagram(buf[:n])
+		if err != nil {
+			continue
+		}
+		if addr.FQDN == "" {
+			return copy(b, data), &net.UDPAddr{IP: addr.IP, Port: addr.Port}, nil
+		}
+		return copy(b, data), clientPacketAddr{addr}, nil
+	}
+}
+
+func (c *clientPacketConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	var dest *AddrSpec
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		dest = &AddrSpec{IP: udpAddr.IP, Port: udpAddr.Port}
+	} else {
+		var err error
+		if dest, err = ParseAddrSpec(addr.String()); err != nil {
+			return 0, err
+		}
+	}
+
+	pkt, err := packUDPDatagram(dest, b)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := c.UDPConn.WriteToUDP(pkt, c.relay); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (c *clientPacketConn) Close() error {
+	c.ctrl.Close()
+	return c.UDPConn.Close()
+}
@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func TestClientConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{Credentials: proxy.StaticCredentials{"alice": "secret"}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := NewClient(addr, "alice", "wrong").DialContext(ctx, "tcp", echo.String()); err != UserAuthFailed {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+
+	conn, err := NewClient(addr, "alice", "secret").DialContext(ctx, "tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q, %v", buf, err)
+	}
+}
+
+func TestClientConnectBlocked(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{Rules: PermitNone()})
+
+	_, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+}
+
+func TestClientBind(t *testing.T) {
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1")})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	binding, err := NewClient(addr, "", "").Bind(ctx, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binding.Close()
+
+	peer, err := net.Dial("tcp", binding.Addr().Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	conn, remote, err := binding.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remote.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("unexpected peer address: %v", remote)
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected data from peer: %q, %v", buf, err)
+	}
+}
+
+func TestClientListenPacket(t *testing.T) {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1")})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := NewClient(addr, "", "").ListenPacket(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.WriteTo([]byte("ping"), echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, from, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.String() != echo.LocalAddr().String() || string(buf[:n]) != "ping" {
+		t.Fatalf("unexpected datagram from %v: %q", from, buf[:n])
+	}
+}
@@ -0,0 +1,101 @@
+package socks5
+
+import (
+	"errors"
+	"net"
+	"syscall"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+// ClassifyDialError 返回与连接目标失败原因对应的响应码
+//
+//	超时（包括上下文超时、ETIMEDOUT、DNS 超时）  ReplyTTLExpired
+//	ECONNREFUSED                                  ReplyConnectionRefused
+//	ENETUNREACH                                   ReplyNetworkUnreachable
+//	EHOSTUNREACH、域名不存在等 DNS 错误           ReplyHostUnreachable
+//	EACCES、EPERM（如被本机防火墙拒绝）           ReplyRuleFailure
+//	没有允许的地址族的地址                        ReplyAddrTypeNotSupported
+//	上下文被取消（如服务关闭）                    ReplyServerFailure
+//	上级 SOCKS5 代理的失败响应                    原响应码，无法识别时为 ReplyServerFailure
+//
+// 其他错误为 ReplyHostUnreachable
+func ClassifyDialError(err error) uint8 {
+	if err == nil {
+		return ReplySuccess
+	}
+
+	var errno syscall.Errno
+	var dnsErr *net.DNSError
+	var upstreamErr *proxy.UpstreamReplyError
+	switch {
+	case errors.As(err, &upstreamErr):
+		if upstreamErr.Reply > ReplySuccess && upstreamErr.Reply <= ReplyAddrTypeNotSupported {
+			return upstreamErr.Reply
+		}
+		return ReplyServerFailure
+	case errors.Is(err, context.DeadlineExceeded):
+		return ReplyTTLExpired
+	case errors.Is(err, context.Canceled):
+		return ReplyServerFailure
+	case errors.Is(err, proxy.NoAllowedAddress):
+		return ReplyAddrTypeNotSupported
+	case errors.As(err, &errno):
+		switch errno {
+		case syscall.ECONNREFUSED:
+			return ReplyConnectionRefused
+		case syscall.ENETUNREACH:
+			return ReplyNetworkUnreachable
+		case syscall.EHOSTUNREACH:
+			return ReplyHostUnreachable
+		case syscall.ETIMEDOUT:
+			return ReplyTTLExpired
+		case syscall.EACCES, syscall.EPERM:
+			return ReplyRuleFailure
+		}
+	case errors.As(err, &dnsErr):
+		if dnsErr.IsTimeout {
+			return ReplyTTLExpired
+		}
+		return ReplyHostUnreachable
+	}
+	if isTimeout(err) {
+		return ReplyTTLExpired
+	}
+	return ReplyHostUnreachable
+}
+
+// ReplyReason 响应码对应的原因，用于日志和统计，如 connection_refused
+func ReplyReason(reply uint8) string {
+	switch reply {
+	case ReplySuccess:
+		return "succeeded"
+	case ReplyServerFailure:
+		return "server_failure"
+	case ReplyRuleFailure:
+		return "not_allowed"
+	case ReplyNetworkUnreachable:
+		return "network_unreachable"
+	case ReplyHostUnreachable:
+		return "host_unreachable"
+	case ReplyConnectionRefused:
+		return "connection_refused"
+	case ReplyTTLExpired:
+		return "ttl_expired"
+	case ReplyCommandNotSupported:
+		return "command_not_supported"
+	case ReplyAddrTypeNotSupported:
+		return "address_type_not_supported"
+	default:
+		return "unknown"
+	}
+}
+
+// reportFailure 上报连接目标失败的原因
+func (s *Server) reportFailure(reply uint8) {
+	if s.config.FailureReporter != nil {
+		_ = s.config.FailureReporter.Report(ReplyReason(reply), 1)
+	}
+}
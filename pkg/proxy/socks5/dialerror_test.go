@@ -0,0 +1,100 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func TestClassifyDialError(t *testing.T) {
+	opErr := func(errno syscall.Errno) error {
+		return &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)}
+	}
+	tests := []struct {
+		err    error
+		expect uint8
+	}{
+		{opErr(syscall.ECONNREFUSED), ReplyConnectionRefused},
+		{opErr(syscall.ENETUNREACH), ReplyNetworkUnreachable},
+		{opErr(syscall.EHOSTUNREACH), ReplyHostUnreachable},
+		{opErr(syscall.ETIMEDOUT), ReplyTTLExpired},
+		{opErr(syscall.EACCES), ReplyRuleFailure},
+		{fmt.Errorf("dial upstream: %w", opErr(syscall.ECONNREFUSED)), ReplyConnectionRefused},
+		{&net.DNSError{Err: "no such host", Name: "a.test", IsNotFound: true}, ReplyHostUnreachable},
+		{&net.DNSError{Err: "i/o timeout", Name: "a.test", IsTimeout: true}, ReplyTTLExpired},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: context.DeadlineExceeded}, ReplyTTLExpired},
+		{context.Canceled, ReplyServerFailure},
+		{proxy.NoAllowedAddress, ReplyAddrTypeNotSupported},
+		{&proxy.UpstreamReplyError{Reply: ReplyRuleFailure}, ReplyRuleFailure},
+		{&proxy.UpstreamReplyError{Reply: 0x5b}, ReplyServerFailure},
+		{fmt.Errorf("unknown"), ReplyHostUnreachable},
+	}
+	for _, tt := range tests {
+		if got := ClassifyDialError(tt.err); got != tt.expect {
+			t.Errorf("ClassifyDialError(%v) = %s, expected %s", tt.err, ReplyReason(got), ReplyReason(tt.expect))
+		}
+	}
+}
+
+func TestClassifyChainDialError(t *testing.T) {
+	closed, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed.Close()
+	_, parent := newTestServer(t, &Config{})
+	_, denying := newTestServer(t, &Config{Rules: PermitNone()})
+
+	tests := []struct {
+		upstream string
+		expect   uint8
+	}{
+		// 连接上级代理被拒绝
+		{closed.Addr().String(), ReplyConnectionRefused},
+		// 上级代理连接目标被拒绝
+		{parent, ReplyConnectionRefused},
+		// 上级代理的规则拒绝
+		{denying, ReplyRuleFailure},
+	}
+	for _, tt := range tests {
+		upstream, err := proxy.ParseUpstream("socks5://" + tt.upstream)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, err = proxy.NewChainDialer(nil, upstream).DialContext(ctx, "tcp", closed.Addr().String())
+		cancel()
+		if got := ClassifyDialError(err); got != tt.expect {
+			t.Errorf("ClassifyDialError(%v) = %s, expected %s", err, ReplyReason(got), ReplyReason(tt.expect))
+		}
+	}
+
+	// 握手超时
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			defer conn.Close()
+			_, _ = io.Copy(io.Discard, conn)
+		}
+	}()
+	upstream, _ := proxy.ParseUpstream("socks5://" + l.Addr().String())
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	_, err = proxy.NewChainDialer(nil, upstream).DialContext(ctx, "tcp", "192.0.2.1:80")
+	if got := ClassifyDialError(err); got != ReplyTTLExpired {
+		t.Errorf("ClassifyDialError(%v) = %s, expected %s", err, ReplyReason(got), ReplyReason(ReplyTTLExpired))
+	}
+}
@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+// fakeDNSTTL 伪 IP 应答的 TTL，地址可能被复用，客户端不应长期缓存
+const fakeDNSTTL = 1
+
+// fakeDNSAnswer 以伪 IP 应答 DNS 查询，仅处理单个 A 或 AAAA 查询，其他报文返回 false 由调用方正常转发
+// A 查询返回分配给 owner 的伪 IP，AAAA 查询返回空应答，使客户端使用 IPv4
+func fakeDNSAnswer(pool *proxy.FakeIPPool, owner string, query []byte) ([]byte, bool) {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response || header.OpCode != 0 {
+		return nil, false
+	}
+	questions, err := p.AllQuestions()
+	if err != nil || len(questions) != 1 {
+		return nil, false
+	}
+	q := questions[0]
+	if q.Class != dnsmessage.ClassINET || q.Type != dnsmessage.TypeA && q.Type != dnsmessage.TypeAAAA {
+		return nil, false
+	}
+
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 header.ID,
+		Response:           true,
+		RecursionDesired:   header.RecursionDesired,
+		RecursionAvailable: true,
+	})
+	b.EnableCompression()
+	if err := b.StartQuestions(); err != nil {
+		return nil, false
+	}
+	if err := b.Question(q); err != nil {
+		return nil, false
+	}
+	if q.Type == dnsmessage.TypeA {
+		var a dnsmessage.AResource
+		copy(a.A[:], pool.Allocate(q.Name.String(), owner).To4())
+		if err := b.StartAnswers(); err != nil {
+			return nil, false
+		}
+		rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: q.Class, TTL: fakeDNSTTL}
+		if err := b.AResource(rh, a); err != nil {
+			return nil, false
+		}
+	}
+	resp, err := b.Finish()
+	if err != nil {
+		return nil, false
+	}
+	return resp, true
+}
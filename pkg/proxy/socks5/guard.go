@@ -0,0 +1,223 @@
+package socks5
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const (
+	// authGuardMaxRecords 来源 IP 和用户名各自最多保留的失败记录数
+	authGuardMaxRecords = 10000
+)
+
+var (
+	authThrottled = fmt.Errorf("too many authentication failures, retry later")
+	authLockedOut = fmt.Errorf("locked out after too many authentication failures")
+)
+
+// AuthGuardConfig 鉴权失败限制配置
+type AuthGuardConfig struct {
+	// MaxFailures 连续失败次数达到后锁定，默认 5
+	MaxFailures int
+
+	// BaseDelay 首次失败后需等待的时间，之后每次失败翻倍，默认 1 秒
+	BaseDelay time.Duration
+
+	// MaxDelay 等待时间上限，默认 1 分钟
+	MaxDelay time.Duration
+
+	// Lockout 锁定时长，超过该时长没有失败时清除失败记录，默认 15 分钟
+	Lockout time.Duration
+
+	// Allowlist 不受限制的来源地址，CIDR 或 IP
+	Allowlist []string
+
+	// Reporter 用于统计锁定次数，标识为用户名或来源 IP
+	Reporter proxy.TrafficReporter
+
+	// Logger 记录锁定事件，为空时使用服务日志
+	Logger *log.Logger
+}
+
+// AuthGuard 按来源 IP 和用户名记录鉴权失败，失败后指数退避，失败次数过多时临时锁定
+type AuthGuard struct {
+	config    AuthGuardConfig
+	allowlist []*net.IPNet
+
+	mu        sync.Mutex
+	ips       map[string]*authFailures
+	users     map[string]*authFailures
+	lastPurge time.Time
+}
+
+type authFailures struct {
+	count        int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+func NewAuthGuard(conf AuthGuardConfig) (*AuthGuard, error) {
+	if conf.MaxFailures <= 0 {
+		conf.MaxFailures = 5
+	}
+	if conf.BaseDelay <= 0 {
+		conf.BaseDelay = time.Second
+	}
+	if conf.MaxDelay <= 0 {
+		conf.MaxDelay = time.Minute
+	}
+	if conf.Lockout <= 0 {
+		conf.Lockout = 15 * time.Minute
+	}
+
+	allowlist, err := parseCIDRs(conf.Allowlist)
+	if err != nil {
+		return nil, err
+	}
+
+	return &AuthGuard{
+		config:    conf,
+		allowlist: allowlist,
+		ips:       make(map[string]*authFailures),
+		users:     make(map[string]*authFailures),
+	}, nil
+}
+
+// check 检查是否允许尝试鉴权，退避或锁定期间返回错误
+func (g *AuthGuard) check(ip net.IP, user string) error {
+	if g.allowed(ip) {
+		return nil
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	for _, f := range []*authFailures{g.ips[ipKey(ip)], g.users[user]} {
+		if f == nil || !now.Before(f.blockedUntil) {
+			continue
+		}
+		if f.count >= g.config.MaxFailures {
+			return authLockedOut
+		}
+		return authThrottled
+	}
+	return nil
+}
+
+// fail 记录一次鉴权失败
+func (g *AuthGuard) fail(ip net.IP, user string) {
+	if g.allowed(ip) {
+		return
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	g.purge(now)
+	if key := ipKey(ip); key != "" {
+		if g.record(g.ips, key, now) {
+			g.lockout("ip", key)
+		}
+	}
+	if user != "" {
+		if g.record(g.users, user, now) {
+			g.lockout("user", user)
+		}
+	}
+}
+
+// succeed 鉴权成功，清除用户名的失败记录
+// 来源 IP 的失败记录保留，避免攻击者用一个已知账号重置计数后继续尝试其他用户名
+func (g *AuthGuard) succeed(ip net.IP, user string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	delete(g.users, user)
+}
+
+// record 记录失败并计算退避时间，达到锁定次数时返回 true
+func (g *AuthGuard) record(failures map[string]*authFailures, key string, now time.Time) bool {
+	f, ok := failures[key]
+	if !ok && len(failures) >= authGuardMaxRecords {
+		g.evict(failures, now)
+	}
+	if !ok || now.Sub(f.lastFailure) > g.config.Lockout {
+		f = &authFailures{}
+		failures[key] = f
+	}
+	f.count++
+	f.lastFailure = now
+
+	if f.count >= g.config.MaxFailures {
+		f.blockedUntil = now.Add(g.config.Lockout)
+		return f.count == g.config.MaxFailures
+	}
+
+	delay := g.config.BaseDelay << uint(f.count-1)
+	if delay > g.config.MaxDelay || delay <= 0 {
+		delay = g.config.MaxDelay
+	}
+	f.blockedUntil = now.Add(delay)
+	return false
+}
+
+func (g *AuthGuard) lockout(kind, key string) {
+	if g.config.Logger != nil {
+		g.config.Logger.Printf("[WARN] socks: %s %s locked out for %v after %d authentication failures",
+			kind, key, g.config.Lockout, g.config.MaxFailures)
+	}
+	if g.config.Reporter != nil {
+		_ = g.config.Reporter.Report(key, 1)
+	}
+}
+
+// purge 每分钟最多一次清除过期的失败记录
+func (g *AuthGuard) purge(now time.Time) {
+	if now.Sub(g.lastPurge) < time.Minute {
+		return
+	}
+	g.lastPurge = now
+	for _, failures := range []map[string]*authFailures{g.ips, g.users} {
+		for key, f := range failures {
+			if now.Sub(f.lastFailure) > g.config.Lockout {
+				delete(failures, key)
+			}
+		}
+	}
+}
+
+// evict 失败记录达到上限时清除过期记录，仍达到上限时清除最早失败的记录
+func (g *AuthGuard) evict(failures map[string]*authFailures, now time.Time) {
+	var oldestKey string
+	var oldest time.Time
+	for key, f := range failures {
+		if now.Sub(f.lastFailure) > g.config.Lockout {
+			delete(failures, key)
+			continue
+		}
+		if oldestKey == "" || f.lastFailure.Before(oldest) {
+			oldestKey, oldest = key, f.lastFailure
+		}
+	}
+	if len(failures) >= authGuardMaxRecords {
+		delete(failures, oldestKey)
+	}
+}
+
+func (g *AuthGuard) allowed(ip net.IP) bool {
+	return containsIP(g.allowlist, ip)
+}
+
+func ipKey(ip net.IP) string {
+	if len(ip) == 0 {
+		return ""
+	}
+	return ip.String()
+}
@@ -0,0 +1,152 @@
+package socks5
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func TestAuthGuard(t *testing.T) {
+	reporter := &countReporter{}
+	guard, err := NewAuthGuard(AuthGuardConfig{
+		MaxFailures: 3,
+		BaseDelay:   20 * time.Millisecond,
+		Lockout:     time.Hour,
+		Allowlist:   []string{"10.0.0.0/8"},
+		Reporter:    reporter,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cator := UserPassAuthenticator{Credentials: proxy.StaticCredentials{"alice": "secret"}, Guard: guard}
+	attacker := net.ParseIP("1.2.3.4")
+
+	if _, err := cator.verify(attacker, "alice", "wrong"); err != UserAuthFailed {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+	// Backoff rejects even the right password
+	if _, err := cator.verify(attacker, "bob", "secret"); err == nil || err == UserAuthFailed {
+		t.Fatalf("expected throttled, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := cator.verify(attacker, "bob", "wrong"); err != UserAuthFailed {
+		t.Fatalf("expected auth failure after backoff, got %v", err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, err := cator.verify(attacker, "carol", "wrong"); err != UserAuthFailed {
+		t.Fatalf("expected auth failure after backoff, got %v", err)
+	}
+
+	// Third failure from the same IP locks it out
+	time.Sleep(100 * time.Millisecond)
+	if err := guard.check(attacker, "dave"); err != authLockedOut {
+		t.Fatalf("expected locked out, got %v", err)
+	}
+	if n := reporter.get(attacker.String()); n != 1 {
+		t.Fatalf("expected 1 lockout reported, got %d", n)
+	}
+
+	// Other IPs are only affected through the username
+	if _, err := cator.verify(net.ParseIP("5.6.7.8"), "alice", "secret"); err != nil {
+		t.Fatalf("expected success from other ip, got %v", err)
+	}
+
+	// A successful login does not reset the failures of its source IP
+	sprayer := net.ParseIP("9.9.9.9")
+	if _, err := cator.verify(sprayer, "bob", "wrong"); err != UserAuthFailed {
+		t.Fatalf("expected auth failure, got %v", err)
+	}
+	time.Sleep(30 * time.Millisecond)
+	if _, err := cator.verify(sprayer, "alice", "secret"); err != nil {
+		t.Fatalf("expected success, got %v", err)
+	}
+	for _, user := range []string{"carol", "dave"} {
+		time.Sleep(50 * time.Millisecond)
+		if _, err := cator.verify(sprayer, user, "wrong"); err != UserAuthFailed {
+			t.Fatalf("expected auth failure, got %v", err)
+		}
+	}
+	if err := guard.check(sprayer, "erin"); err != authLockedOut {
+		t.Fatalf("expected locked out, got %v", err)
+	}
+
+	// Allowlisted IPs are never throttled
+	trusted := net.ParseIP("10.1.1.1")
+	for i := 0; i < 5; i++ {
+		if _, err := cator.verify(trusted, "erin", "wrong"); err != UserAuthFailed {
+			t.Fatalf("expected auth failure for trusted ip, got %v", err)
+		}
+	}
+}
+
+func TestAuthGuardMaxRecords(t *testing.T) {
+	guard, err := NewAuthGuard(AuthGuardConfig{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < authGuardMaxRecords+10; i++ {
+		guard.fail(nil, strconv.Itoa(i))
+	}
+	if n := len(guard.users); n != authGuardMaxRecords {
+		t.Fatalf("expected %d user records, got %d", authGuardMaxRecords, n)
+	}
+	if _, ok := guard.users[strconv.Itoa(authGuardMaxRecords+9)]; !ok {
+		t.Fatal("expected latest failure to be recorded")
+	}
+}
+
+// unavailableCredentials 模拟不可用的鉴权服务
+type unavailableCredentials struct{}
+
+func (unavailableCredentials) Valid(user, password string) bool { return false }
+
+func (unavailableCredentials) ValidAttributes(user, password string) (map[string]string, bool) {
+	return nil, false
+}
+
+func (unavailableCredentials) CheckAttributes(user, password string) (map[string]string, bool, error) {
+	return nil, false, proxy.CredentialsUnavailable
+}
+
+func TestAuthGuardUnavailable(t *testing.T) {
+	guard, err := NewAuthGuard(AuthGuardConfig{MaxFailures: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cator := UserPassAuthenticator{Credentials: unavailableCredentials{}, Guard: guard}
+	client := net.ParseIP("1.2.3.4")
+
+	// 鉴权服务不可用不计入失败次数
+	for i := 0; i < 3; i++ {
+		if _, err := cator.verify(client, "alice", "secret"); err != proxy.CredentialsUnavailable {
+			t.Fatalf("expected unavailable, got %v", err)
+		}
+	}
+	if err := guard.check(client, "alice"); err != nil {
+		t.Fatalf("expected no lockout, got %v", err)
+	}
+
+	_, addr := newTestServer(t, &Config{Credentials: unavailableCredentials{}})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	req := "CONNECT example.com:443 HTTP/1.1\r\nProxy-Authorization: Basic YWxpY2U6c2VjcmV0\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
@@ -0,0 +1,365 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const (
+	// httpVersion HTTP 代理请求的协议标识，区别于 SOCKS 版本号
+	httpVersion = uint8('H')
+
+	httpProxyRealm = "lsocks"
+)
+
+var (
+	httpProxyAuthRequired = fmt.Errorf("proxy authentication required")
+	httpHeaderTooLarge    = fmt.Errorf("http request header too large")
+
+	// httpHopHeaders 逐跳首部，转发时需移除
+	httpHopHeaders = []string{
+		"Connection",
+		"Keep-Alive",
+		"Proxy-Authenticate",
+		"Proxy-Authorization",
+		"Proxy-Connection",
+		"Te",
+		"Trailer",
+		"Upgrade",
+	}
+)
+
+// handleHTTP 处理 HTTP 代理请求，支持 CONNECT 隧道和绝对 URI 转发
+// 每个连接仅处理一个请求，转发的请求会带上 Connection: close，同一连接上的后续请求不会转发
+func (s *Server) handleHTTP(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) {
+	header, err := readHTTPHeader(bufConn, http.DefaultMaxHeaderBytes)
+	if err != nil {
+		if err == httpHeaderTooLarge {
+			_ = writeHTTPStatus(conn, http.StatusRequestHeaderFieldsTooLarge, nil)
+		}
+		s.config.Logger.Printf("[ERR] socks: failed to read http request: %v", withTimeoutReason(err, handshakeTimeout))
+		return
+	}
+	reader := bufio.NewReader(io.MultiReader(bytes.NewReader(header), bufConn))
+	httpReq, err := http.ReadRequest(reader)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		s.config.Logger.Printf("[ERR] socks: failed to read http request: %v", err)
+		return
+	}
+
+	// 请求头已完整读出，reader 未缓冲 bufConn 中的数据，CONNECT 隧道直接读取 bufConn 以便嗅探和零拷贝
+	src := io.Reader(reader)
+	if httpReq.Method == http.MethodConnect {
+		src = bufConn
+	}
+	request, err := NewHTTPRequest(httpReq, src)
+	if err != nil {
+		_ = writeHTTPStatus(conn, http.StatusBadRequest, nil)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return
+	}
+
+	// 认证请求
+	authContext, err := s.authenticateHTTP(httpReq, remoteIP(conn))
+	if err == proxy.CredentialsUnavailable {
+		_ = writeHTTPStatus(conn, http.StatusServiceUnavailable, nil)
+		s.config.Logger.Printf("[ERR] socks: failed to authenticate http request: %v", err)
+		return
+	}
+	if err != nil {
+		header := http.Header{"Proxy-Authenticate": {fmt.Sprintf("Basic realm=%q", httpProxyRealm)}}
+		_ = writeHTTPStatus(conn, http.StatusProxyAuthRequired, header)
+		s.config.Logger.Printf("[ERR] socks: failed to authenticate http request: %v", err)
+		return
+	}
+	request.AuthContext = authContext
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	// 握手完成，清除超时
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.config.Logger.Printf("[ERR] socks: failed to clear handshake deadline: %v", err)
+		return
+	}
+
+	// 处理请求
+	if err := s.handleRequest(ctx, request, conn); err != nil {
+		err = fmt.Errorf("failed to handle http request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return
+	}
+}
+
+// NewHTTPRequest 将 HTTP 代理请求转换为 Connect 请求
+// CONNECT 请求的隧道数据从 bufConn 读取；对于转发请求，改写后的请求头和请求体发送给目标，
+// 请求体从 httpReq.Body 读取，之后客户端再发送的数据不会转发
+func NewHTTPRequest(httpReq *http.Request, bufConn io.Reader) (*Request, error) {
+	if httpReq.Method == http.MethodConnect {
+		dest, err := parseHTTPHost(httpReq.URL.Host, 0)
+		if err != nil {
+			return nil, err
+		}
+		return &Request{
+			Version:  httpVersion,
+			Command:  CommandConnect,
+			DestAddr: dest,
+			bufConn:  bufConn,
+			reply:    sendHTTPConnectReply,
+		}, nil
+	}
+
+	if httpReq.URL.Scheme != "http" || httpReq.URL.Host == "" {
+		return nil, fmt.Errorf("unsupported http proxy request: %s %s", httpReq.Method, httpReq.RequestURI)
+	}
+	dest, err := parseHTTPHost(httpReq.URL.Host, 80)
+	if err != nil {
+		return nil, err
+	}
+
+	header := &bytes.Buffer{}
+	if err := writeForwardHeader(header, httpReq); err != nil {
+		return nil, err
+	}
+	var body io.Reader = httpReq.Body
+	if httpReq.Body == nil {
+		body = http.NoBody
+	} else if chunked(httpReq.TransferEncoding) {
+		body = &chunkedReader{body: httpReq.Body}
+	}
+	return &Request{
+		Version:  httpVersion,
+		Command:  CommandConnect,
+		DestAddr: dest,
+		bufConn:  io.MultiReader(header, body, keepAliveReader{bufConn}),
+		reply:    sendHTTPForwardReply,
+	}, nil
+}
+
+// readHTTPHeader 读取请求行和请求头，直到空行，超过 max 字节时返回 httpHeaderTooLarge
+func readHTTPHeader(r *bufio.Reader, max int) ([]byte, error) {
+	var header []byte
+	partial := false
+	for {
+		line, err := r.ReadSlice('\n')
+		if len(header)+len(line) > max {
+			return nil, httpHeaderTooLarge
+		}
+		header = append(header, line...)
+		if err == bufio.ErrBufferFull {
+			partial = true
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if !partial && (string(line) == "\r\n" || string(line) == "\n") {
+			return header, nil
+		}
+		partial = false
+	}
+}
+
+// chunked 是否为分块传输
+func chunked(te []string) bool {
+	return len(te) > 0 && te[0] == "chunked"
+}
+
+// chunkedReader 将已解码的请求体重新编码为分块传输格式，不转发 trailer
+type chunkedReader struct {
+	body io.Reader
+	buf  []byte
+	out  bytes.Buffer
+	done bool
+}
+
+func (r *chunkedReader) Read(p []byte) (int, error) {
+	for r.out.Len() == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+		if r.buf == nil {
+			r.buf = make([]byte, 32*1024)
+		}
+		n, err := r.body.Read(r.buf)
+		if n > 0 {
+			fmt.Fprintf(&r.out, "%x\r\n", n)
+			r.out.Write(r.buf[:n])
+			r.out.WriteString("\r\n")
+		}
+		if err == io.EOF {
+			r.out.WriteString("0\r\n\r\n")
+			r.done = true
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return r.out.Read(p)
+}
+
+// keepAliveReader 请求转发完毕后继续读取客户端，客户端发送后续请求时丢弃并结束转发，
+// 目标响应完毕后连接关闭
+type keepAliveReader struct {
+	reader io.Reader
+}
+
+func (r keepAliveReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	if n > 0 {
+		return 0, io.EOF
+	}
+	return 0, err
+}
+
+// authenticateHTTP 使用 Proxy-Authorization Basic 认证
+// 配置了用户名密码鉴权时，未提供认证信息的客户端仅在来源地址匹配 SourceAuth 时放行
+// 否则来源地址匹配 SourceAuth 或允许无需鉴权时放行
+func (s *Server) authenticateHTTP(httpReq *http.Request, ip net.IP) (*AuthContext, error) {
+	if cator, ok := s.authMethods[MethodUserPassAuth].(*UserPassAuthenticator); ok {
+		user, pass, ok := parseProxyAuthorization(httpReq.Header.Get("Proxy-Authorization"))
+		if !ok {
+			// 来源地址已知的客户端无需用户名密码
+			if authContext, ok := s.config.SourceAuth.authContext(ip, nil); ok {
+				return authContext, nil
+			}
+			return nil, httpProxyAuthRequired
+		}
+		attributes, err := cator.verify(ip, user, pass)
+		if err != nil {
+			return nil, err
+		}
+		return &AuthContext{MethodUserPassAuth, user, userPassPayload(user, attributes)}, nil
+	}
+
+	if authContext, ok := s.config.SourceAuth.authContext(ip, nil); ok {
+		return authContext, nil
+	}
+	if _, ok := s.authMethods[MethodNoAuth]; ok {
+		return &AuthContext{MethodNoAuth, "", nil}, nil
+	}
+	return nil, NoSupportedAuth
+}
+
+// parseProxyAuthorization 解析 Basic 认证首部
+func parseProxyAuthorization(auth string) (user, pass string, ok bool) {
+	const prefix = "Basic "
+	if len(auth) < len(prefix) || !strings.EqualFold(auth[:len(prefix)], prefix) {
+		return "", "", false
+	}
+	decoded, err := base64.StdEncoding.DecodeString(auth[len(prefix):])
+	if err != nil {
+		return "", "", false
+	}
+	return strings.Cut(string(decoded), ":")
+}
+
+// parseHTTPHost 解析 host:port，端口缺省时使用 defaultPort，端口不能为 0
+func parseHTTPHost(hostport string, defaultPort int) (*AddrSpec, error) {
+	if _, _, err := net.SplitHostPort(hostport); err != nil && defaultPort != 0 {
+		hostport = net.JoinHostPort(strings.Trim(hostport, "[]"), strconv.Itoa(defaultPort))
+	}
+	addr, err := ParseAddrSpec(hostport)
+	if err != nil {
+		return nil, err
+	}
+	if addr.Port == 0 {
+		return nil, fmt.Errorf("invalid port in '%s'", hostport)
+	}
+	return addr, nil
+}
+
+// writeForwardHeader 将绝对 URI 请求改写为发往目标的请求头，请求体原样转发
+func writeForwardHeader(w io.Writer, httpReq *http.Request) error {
+	header := httpReq.Header.Clone()
+	// Connection 中列出的首部同为逐跳首部
+	for _, v := range header.Values("Connection") {
+		for _, h := range strings.Split(v, ",") {
+			if h = textproto.TrimString(h); h != "" {
+				header.Del(h)
+			}
+		}
+	}
+	for _, h := range httpHopHeaders {
+		header.Del(h)
+	}
+	if len(httpReq.TransferEncoding) > 0 {
+		header.Set("Transfer-Encoding", strings.Join(httpReq.TransferEncoding, ", "))
+	}
+	header.Set("Connection", "close")
+
+	host := httpReq.Host
+	if host == "" {
+		host = httpReq.URL.Host
+	}
+	if _, err := fmt.Fprintf(w, "%s %s %s\r\nHost: %s\r\n", httpReq.Method, httpReq.URL.RequestURI(), httpReq.Proto, host); err != nil {
+		return err
+	}
+	if err := header.Write(w); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\r\n")
+	return err
+}
+
+// replyHTTPStatus 将 SOCKS 响应码转换为 HTTP 状态码
+func replyHTTPStatus(resp uint8) int {
+	switch resp {
+	case ReplySuccess:
+		return http.StatusOK
+	case ReplyRuleFailure:
+		return http.StatusForbidden
+	case ReplyNetworkUnreachable, ReplyHostUnreachable, ReplyConnectionRefused:
+		return http.StatusBadGateway
+	case ReplyTTLExpired:
+		return http.StatusGatewayTimeout
+	case ReplyCommandNotSupported, ReplyAddrTypeNotSupported:
+		return http.StatusNotImplemented
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// sendHTTPConnectReply 响应 CONNECT 请求
+func sendHTTPConnectReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if resp == ReplySuccess {
+		_, err := io.WriteString(w, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return err
+	}
+	return writeHTTPStatus(w, replyHTTPStatus(resp), nil)
+}
+
+// sendHTTPForwardReply 响应转发请求，成功时由目标响应，无需额外响应
+func sendHTTPForwardReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if resp == ReplySuccess {
+		return nil
+	}
+	return writeHTTPStatus(w, replyHTTPStatus(resp), nil)
+}
+
+// writeHTTPStatus 发送不带响应体的 HTTP 响应
+func writeHTTPStatus(w io.Writer, status int, header http.Header) error {
+	if _, err := fmt.Fprintf(w, "HTTP/1.1 %d %s\r\n", status, http.StatusText(status)); err != nil {
+		return err
+	}
+	if header != nil {
+		if err := header.Write(w); err != nil {
+			return err
+		}
+	}
+	_, err := io.WriteString(w, "Connection: close\r\nContent-Length: 0\r\n\r\n")
+	return err
+}
@@ -0,0 +1,92 @@
+package socks5
+
+import (
+	"fmt"
+	"sync"
+)
+
+var (
+	tooManyConns     = fmt.Errorf("too many connections")
+	tooManyUserConns = fmt.Errorf("too many connections for user")
+	tooManyIPConns   = fmt.Errorf("too many connections from source ip")
+)
+
+// connLimiter 限制同时转发的连接数，为 0 的限制不生效
+type connLimiter struct {
+	maxConns   int // 全局最大连接数
+	maxPerUser int // 每个用户最大连接数
+	maxPerIP   int // 每个来源 IP 最大连接数
+
+	mu    sync.Mutex
+	total int
+	users map[string]int
+	ips   map[string]int
+}
+
+func newConnLimiter(maxConns, maxPerUser, maxPerIP int) *connLimiter {
+	return &connLimiter{
+		maxConns:   maxConns,
+		maxPerUser: maxPerUser,
+		maxPerIP:   maxPerIP,
+		users:      make(map[string]int),
+		ips:        make(map[string]int),
+	}
+}
+
+// acquireConn 接受连接时占用全局和来源 IP 的连接名额，握手中的连接同样计入，成功时返回释放函数
+func (l *connLimiter) acquireConn(ip string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxConns > 0 && l.total >= l.maxConns {
+		return nil, tooManyConns
+	}
+	if l.maxPerIP > 0 && ip != "" && l.ips[ip] >= l.maxPerIP {
+		return nil, tooManyIPConns
+	}
+	l.total++
+	if ip != "" {
+		l.ips[ip]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.total--
+			if ip != "" {
+				if l.ips[ip]--; l.ips[ip] <= 0 {
+					delete(l.ips, ip)
+				}
+			}
+		})
+	}, nil
+}
+
+// acquire 握手完成后占用用户的连接名额，成功时返回释放函数
+// 匿名用户（user 为空）不受每用户限制
+func (l *connLimiter) acquire(user string) (func(), error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.maxPerUser > 0 && user != "" && l.users[user] >= l.maxPerUser {
+		return nil, tooManyUserConns
+	}
+	if user != "" {
+		l.users[user]++
+	}
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if user != "" {
+				if l.users[user]--; l.users[user] <= 0 {
+					delete(l.users, user)
+				}
+			}
+		})
+	}, nil
+}
@@ -1,13 +1,17 @@
 package socks5
 
 import (
+	"bufio"
 	"fmt"
 	"io"
 	"net"
 	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 
 	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
 )
 
 const (
@@ -34,6 +38,7 @@ const (
 
 var (
 	unrecognizedAddrType = fmt.Errorf("unrecognized address type")
+	blockedByRules       = fmt.Errorf("blocked by rules")
 )
 
 // AddressRewriter 用于透明重写目标地址
@@ -46,23 +51,48 @@ type AddrSpec struct {
 	FQDN string
 	IP   net.IP
 	Port int
+	// Unix unix socket 路径，仅用于重写后的目标地址
+	Unix string
 }
 
 func (a *AddrSpec) String() string {
+	if a.Unix != "" {
+		return "unix:" + a.Unix
+	}
 	if a.FQDN != "" {
 		return fmt.Sprintf("%s (%s):%d", a.FQDN, a.IP, a.Port)
 	}
 	return fmt.Sprintf("%s:%d", a.IP, a.Port)
 }
 
-// Address 返回用于拨号的地址，优先使用 IP 地址，回退用 FQDN
+// Address 返回用于拨号的地址，优先使用 IP 地址，回退用 FQDN，unix socket 返回路径
 func (a AddrSpec) Address() string {
+	if a.Unix != "" {
+		return a.Unix
+	}
 	if 0 != len(a.IP) {
 		return net.JoinHostPort(a.IP.String(), strconv.Itoa(a.Port))
 	}
 	return net.JoinHostPort(a.FQDN, strconv.Itoa(a.Port))
 }
 
+// ParseAddrSpec 解析 host:port 格式的地址
+func ParseAddrSpec(hostport string) (*AddrSpec, error) {
+	host, portStr, err := net.SplitHostPort(hostport)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address '%s': %v", hostport, err)
+	}
+	port, err := strconv.Atoi(portStr)
+	if err != nil || port < 0 || port > 0xffff {
+		return nil, fmt.Errorf("invalid port '%s'", portStr)
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return &AddrSpec{IP: ip, Port: port}, nil
+	}
+	return &AddrSpec{FQDN: host, Port: port}, nil
+}
+
 // Request 请求
 type Request struct {
 	// 协议版本
@@ -78,11 +108,20 @@ type Request struct {
 	// realDestAddr 实际目标地址（可能被重写）
 	realDestAddr *AddrSpec
 	bufConn      io.Reader
+	// destIPs 目标域名解析得到的所有地址
+	destIPs []net.IP
+	// reply 响应方式，为空时使用 SOCKS5 响应
+	reply replyFunc
 }
 
+// replyFunc 向客户端发送响应
+type replyFunc func(w io.Writer, resp uint8, addr *AddrSpec) error
+
 type conn interface {
 	Write([]byte) (int, error)
+	LocalAddr() net.Addr
 	RemoteAddr() net.Addr
+	SetReadDeadline(t time.Time) error
 }
 
 // NewRequest creates a new Request from the tcp connection
@@ -115,27 +154,54 @@ func NewRequest(bufConn io.Reader) (*Request, error) {
 }
 
 // handleRequest 处理认证成功后的请求
-func (s *Server) handleRequest(req *Request, conn conn) error {
-	ctx := context.Background()
+func (s *Server) handleRequest(ctx context.Context, req *Request, conn conn) error {
+	// Check the connection limits
+	release, err := s.admit(req)
+	if err != nil {
+		if err := req.sendReply(conn, ReplyRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("request to %v rejected: %v", req.DestAddr, err)
+	}
+	defer release()
+	defer s.watchSession(req, conn)()
 
 	// Resolve the address if we have a FQDN
 	dest := req.DestAddr
-	if dest.FQDN != "" {
-		ctx_, addr, err := s.config.Resolver.Resolve(ctx, dest.FQDN)
+	s.restoreFakeIP(fakeIPOwner(req), dest)
+	if dest.FQDN != "" && s.config.FakeIP != nil && req.Command == CommandConnect {
+		// 伪 IP 模式下拨号时再解析
+		dest.IP = s.config.FakeIP.Allocate(dest.FQDN, fakeIPOwner(req))
+	} else if dest.FQDN != "" {
+		ctx_, addrs, _, err := proxy.ResolveAddrs(s.config.Resolver, ctx, dest.FQDN)
+		if err == nil && len(addrs) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: dest.FQDN, IsNotFound: true}
+		}
 		if err != nil {
-			if err := sendReply(conn, ReplyHostUnreachable, nil); err != nil {
+			resp := ClassifyDialError(err)
+			s.reportFailure(resp)
+			if err := req.sendReply(conn, resp, nil); err != nil {
 				return fmt.Errorf("failed to send reply: %v", err)
 			}
-			return fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+			return fmt.Errorf("failed to resolve destination '%v' (%s): %v", dest.FQDN, ReplyReason(resp), err)
 		}
 		ctx = ctx_
-		dest.IP = addr
+		if len(addrs) > 1 {
+			// 多个地址都可能被连接，被规则拒绝的地址不再使用
+			if addrs = s.allowedIPs(ctx, req, addrs); len(addrs) == 0 {
+				if err := req.sendReply(conn, ReplyRuleFailure, nil); err != nil {
+					return fmt.Errorf("failed to send reply: %v", err)
+				}
+				return fmt.Errorf("request to %v blocked by rules", dest)
+			}
+		}
+		dest.IP = addrs[0]
+		req.destIPs = addrs
 	}
 
-	// Apply any address rewrites
-	req.realDestAddr = req.DestAddr
-	if s.config.Rewriter != nil {
-		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	// Apply any address rewrites, connect 在嗅探目标域名后重写
+	if req.Command != CommandConnect {
+		ctx = s.rewrite(ctx, req)
 	}
 
 	// Switch on the command
@@ -147,21 +213,192 @@ func (s *Server) handleRequest(req *Request, conn conn) error {
 	case CommandUDPAssociate:
 		return s.handleAssociate(ctx, conn, req)
 	default:
-		if err := sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
+		if err := req.sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
 		return fmt.Errorf("unsupported command: %v", req.Command)
 	}
 }
 
+// admit 检查流量配额和每用户的连接数限制，被拒绝时上报拒绝次数
+// 全局和每来源 IP 的连接数在接受连接时检查
+func (s *Server) admit(req *Request) (func(), error) {
+	var user string
+	if req.AuthContext != nil {
+		user = req.AuthContext.UserIdentifier
+	}
+
+	var release func()
+	var err error
+	if user != "" && s.config.Quota != nil && s.config.Quota.Exceeded(user) {
+		err = proxy.QuotaExceeded
+	} else {
+		release, err = s.limiter.acquire(user)
+	}
+	if err != nil {
+		s.reject(user)
+	}
+	return release, err
+}
+
+// reject 上报一次拒绝
+func (s *Server) reject(identifier string) {
+	if s.config.RejectReporter != nil {
+		_ = s.config.RejectReporter.Report(identifier, 1)
+	}
+}
+
+// allowedIPs 依次以各地址作为目标检查规则，返回允许的地址
+func (s *Server) allowedIPs(ctx context.Context, req *Request, ips []net.IP) []net.IP {
+	allowed := make([]net.IP, 0, len(ips))
+	for _, ip := range ips {
+		dest := *req.DestAddr
+		dest.IP = ip
+		r := *req
+		r.DestAddr = &dest
+		if _, ok := s.config.Rules.Allow(ctx, &r); ok {
+			allowed = append(allowed, ip)
+		}
+	}
+	return allowed
+}
+
+// restoreFakeIP 目标地址为分配给 owner 的伪 IP 时还原为域名，其他地址段内的地址按原地址处理
+func (s *Server) restoreFakeIP(owner string, dest *AddrSpec) {
+	if s.config.FakeIP == nil || dest.FQDN != "" {
+		return
+	}
+	if name, ok := s.config.FakeIP.Lookup(dest.IP, owner); ok {
+		dest.FQDN, dest.IP = name, nil
+	}
+}
+
+// fakeIPOwner 伪 IP 的使用者，匿名用户以来源 IP 区分
+func fakeIPOwner(req *Request) string {
+	if req.AuthContext != nil && req.AuthContext.UserIdentifier != "" {
+		return req.AuthContext.UserIdentifier
+	}
+	if req.RemoteAddr != nil {
+		return req.RemoteAddr.IP.String()
+	}
+	return ""
+}
+
+// dialIPs 返回拨号时依次尝试的地址，伪 IP 在此时解析为真实地址，并以真实地址检查规则
+// 目标主机未被重写时使用解析得到的所有地址，重写后的目标仅有域名时由 Resolver 解析
+func (s *Server) dialIPs(ctx context.Context, req *Request) ([]net.IP, error) {
+	addr := req.realDestAddr
+	if s.config.FakeIP != nil && addr.FQDN != "" && s.config.FakeIP.Contains(addr.IP) {
+		_, ips, _, err := proxy.ResolveAddrs(s.config.Resolver, ctx, addr.FQDN)
+		if err == nil && len(ips) == 0 {
+			err = &net.DNSError{Err: "no such host", Name: addr.FQDN, IsNotFound: true}
+		}
+		if err != nil {
+			return nil, err
+		}
+		if ips = s.allowedIPs(ctx, req, ips); len(ips) == 0 {
+			return nil, blockedByRules
+		}
+		return ips, nil
+	}
+	if len(req.destIPs) > 0 && !req.hostRewritten() {
+		return req.destIPs, nil
+	}
+	if len(addr.IP) > 0 {
+		return []net.IP{addr.IP}, nil
+	}
+	_, ips, _, err := proxy.ResolveAddrs(s.config.Resolver, ctx, addr.FQDN)
+	if err == nil && len(ips) == 0 {
+		err = &net.DNSError{Err: "no such host", Name: addr.FQDN, IsNotFound: true}
+	}
+	return ips, err
+}
+
+// rewrite 重写目标地址
+func (s *Server) rewrite(ctx context.Context, req *Request) context.Context {
+	req.realDestAddr = req.DestAddr
+	if s.config.Rewriter != nil {
+		ctx, req.realDestAddr = s.config.Rewriter.Rewrite(ctx, req)
+	}
+	return ctx
+}
+
+// sniff 先响应成功，再从客户端首个数据包中读取目标域名
+// 域名由客户端提供，仅在解析结果包含原 IP 时使用，避免冒用被允许的域名连接其他地址
+// 返回是否已响应，无法嗅探时不响应
+func (s *Server) sniff(ctx context.Context, conn conn, req *Request) (bool, error) {
+	br, ok := req.bufConn.(*bufio.Reader)
+	if !s.config.Sniff || !ok || req.DestAddr.FQDN != "" || len(req.DestAddr.IP) == 0 || !s.sniffPort(req.DestAddr.Port) {
+		return false, nil
+	}
+
+	// 客户端收到响应后才会发送数据，此时目标尚未连接，响应中的地址为空
+	if err := req.sendReply(conn, ReplySuccess, &AddrSpec{IP: net.IPv4zero}); err != nil {
+		return true, fmt.Errorf("failed to send reply: %v", err)
+	}
+	host := sniffHost(conn, br, s.config.SniffTimeout)
+	if host == "" {
+		return true, nil
+	}
+	if s.resolvesTo(ctx, host, req.DestAddr.IP) {
+		req.DestAddr.FQDN = host
+	} else {
+		s.config.Logger.Printf("[WARN] socks: sniffed host %s does not resolve to %v, ignored", host, req.DestAddr.IP)
+	}
+	return true, nil
+}
+
+// sniffPort 目标端口是否需要嗅探
+func (s *Server) sniffPort(port int) bool {
+	for _, p := range s.config.SniffPorts {
+		if p == port {
+			return true
+		}
+	}
+	return false
+}
+
+// resolvesTo 检查域名的解析结果是否包含指定地址
+func (s *Server) resolvesTo(ctx context.Context, name string, ip net.IP) bool {
+	ctx, cancel := context.WithTimeout(ctx, s.config.DialTimeout)
+	defer cancel()
+	_, ips, _, err := proxy.ResolveAddrs(s.config.Resolver, ctx, name)
+	if err != nil {
+		return false
+	}
+	for _, addr := range ips {
+		if addr.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleConnect 处理 Connect 命令
 func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) error {
+	// Sniff the domain of IP requests
+	replied, err := s.sniff(ctx, conn, req)
+	if err != nil {
+		return err
+	}
+	reply := func(resp uint8, addr *AddrSpec) error {
+		if replied {
+			// 已提前响应成功，客户端只能看到连接关闭
+			if resp != ReplySuccess {
+				s.config.Logger.Printf("[WARN] socks: connect to %v failed after early reply (%s), closing connection", req.DestAddr, ReplyReason(resp))
+			}
+			return nil
+		}
+		return req.sendReply(conn, resp, addr)
+	}
+	ctx = s.rewrite(ctx, req)
+
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+		if err := reply(ReplyRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("connect to %v blocked by rules", destString(ctx, req))
 	} else {
 		ctx = ctx_
 	}
@@ -169,90 +406,273 @@ func (s *Server) handleConnect(ctx context.Context, conn conn, req *Request) err
 	// Attempt to connect
 	dial := s.config.Dial
 	if dial == nil {
-		dial = func(ctx context.Context, net_, addr string) (net.Conn, error) {
-			return net.Dial(net_, addr)
+		dial = proxy.Direct.DialContext
+	}
+	dialCtx, cancel := context.WithTimeout(ctx, s.config.DialTimeout)
+	var target net.Conn
+	var ips []net.IP
+	if req.realDestAddr.Unix == "" {
+		ips, err = s.dialIPs(dialCtx, req)
+	}
+	if err == blockedByRules {
+		cancel()
+		if err := reply(ReplyRuleFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("connect to %v blocked by rules", destString(ctx, req))
+	}
+	if err != nil {
+		cancel()
+		resp := ClassifyDialError(err)
+		s.reportFailure(resp)
+		if err := reply(resp, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
 		}
+		return fmt.Errorf("failed to resolve destination '%v' (%s): %v", req.realDestAddr.FQDN, ReplyReason(resp), err)
+	}
+	if req.realDestAddr.Unix != "" {
+		// unix socket 在本机，不经过上游代理
+		target, err = proxy.Direct.DialContext(dialCtx, "unix", req.realDestAddr.Unix)
+	} else {
+		policy, _ := proxy.FamilyPolicyFromContext(ctx)
+		target, err = proxy.DialHappyEyeballs(dialCtx, dial, "tcp", policy.SortAddrs(ips), req.realDestAddr.Port, s.config.ConnectionAttemptDelay)
 	}
-	target, err := dial(ctx, "tcp", req.realDestAddr.Address())
+	cancel()
 	if err != nil {
-		msg := err.Error()
-		resp := ReplyHostUnreachable
-		if strings.Contains(msg, "refused") {
-			resp = ReplyConnectionRefused
-		} else if strings.Contains(msg, "network is unreachable") {
-			resp = ReplyNetworkUnreachable
-		}
-		if err := sendReply(conn, resp, nil); err != nil {
+		resp := ClassifyDialError(err)
+		if dialCtx.Err() == context.DeadlineExceeded {
+			resp = ReplyTTLExpired
+		}
+		if resp == ReplyTTLExpired {
+			err = fmt.Errorf("dial timeout: %v", err)
+		}
+		s.reportFailure(resp)
+		if err := reply(resp, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("connect to %v failed: %v", req.DestAddr, err)
+		return fmt.Errorf("connect to %v failed (%s): %v", destString(ctx, req), ReplyReason(resp), err)
 	}
 	defer target.Close()
 
 	// Send success
-	local := target.LocalAddr().(*net.TCPAddr)
-	bind := AddrSpec{IP: local.IP, Port: local.Port}
-	if err := sendReply(conn, ReplySuccess, &bind); err != nil {
+	bind := AddrSpec{IP: net.IPv4zero}
+	if local, ok := target.LocalAddr().(*net.TCPAddr); ok {
+		bind = AddrSpec{IP: local.IP, Port: local.Port}
+	}
+	if err := reply(ReplySuccess, &bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
 
 	// Start proxying
-	errCh := make(chan error, 2)
-	go s.forwardRequest(req, target, req.bufConn, errCh)
-	go s.forwardResponse(req, conn, target, errCh)
-
-	// Wait
-	for i := 0; i < 2; i++ {
-		e := <-errCh
-		if e != nil {
-			// return from this function closes target (and conn).
-			return e
-		}
-	}
-	return nil
+	return s.relay(req, conn, target)
 }
 
-// handleBind 处理 Connect 命令
+// handleBind 处理 Bind 命令
 func (s *Server) handleBind(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+		if err := req.sendReply(conn, ReplyRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("bind to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("bind to %v blocked by rules", destString(ctx, req))
 	} else {
 		ctx = ctx_
 	}
 
-	// TODO: Support bind
-	if err := sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
+	// Listen on the bind ip
+	listener, err := net.ListenTCP("tcp", &net.TCPAddr{IP: s.config.BindIP})
+	if err != nil {
+		if err := req.sendReply(conn, ReplyServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("bind for %v failed: %v", destString(ctx, req), err)
+	}
+	defer listener.Close()
+	go func() {
+		// Stop waiting for the peer when the connection is cancelled
+		<-ctx.Done()
+		listener.Close()
+	}()
+
+	// Send the first reply with the address the peer should connect to
+	local := listener.Addr().(*net.TCPAddr)
+	bind := s.boundAddr(conn, local.IP, local.Port)
+	if err := req.sendReply(conn, ReplySuccess, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
-	return nil
+
+	// Wait for the expected peer
+	if err := listener.SetDeadline(time.Now().Add(s.config.BindTimeout)); err != nil {
+		return fmt.Errorf("failed to set bind deadline: %v", err)
+	}
+	var peer *net.TCPConn
+	for {
+		peer, err = listener.AcceptTCP()
+		if err != nil {
+			resp := ReplyServerFailure
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				resp = ReplyTTLExpired
+			}
+			if err := req.sendReply(conn, resp, nil); err != nil {
+				return fmt.Errorf("failed to send reply: %v", err)
+			}
+			return fmt.Errorf("bind for %v failed to accept peer: %v", destString(ctx, req), err)
+		}
+
+		remote := peer.RemoteAddr().(*net.TCPAddr)
+		if isExpectedPeer(req.peerIPs(), remote) {
+			break
+		}
+		s.config.Logger.Printf("[WARN] socks: bind for %v rejected unexpected peer %v", destString(ctx, req), remote)
+		peer.Close()
+	}
+	defer peer.Close()
+
+	// Send the second reply with the peer address
+	remote := peer.RemoteAddr().(*net.TCPAddr)
+	if err := req.sendReply(conn, ReplySuccess, &AddrSpec{IP: remote.IP, Port: remote.Port}); err != nil {
+		return fmt.Errorf("failed to send reply: %v", err)
+	}
+
+	// Start proxying
+	return s.relay(req, conn, peer)
+}
+
+// boundAddr 返回 bind 或 udp associate 监听地址，若监听在未指定地址上，则使用客户端连接的本地地址
+func (s *Server) boundAddr(conn conn, ip net.IP, port int) *AddrSpec {
+	bind := &AddrSpec{IP: ip, Port: port}
+	if ip.IsUnspecified() {
+		if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+			bind.IP = addr.IP
+		}
+	}
+	return bind
 }
 
-// handleAssociate 处理 Connect 命令
+// destString 用于日志的目标地址，被重写时同时包含重写后的地址
+func destString(ctx context.Context, req *Request) string {
+	if rw, ok := RewriteFromContext(ctx); ok {
+		return fmt.Sprintf("%v (rewritten to %v)", rw.From, rw.To)
+	}
+	return req.DestAddr.String()
+}
+
+// peerIPs bind 命令允许连入的对端地址，目标地址未被重写时为目标域名解析得到的所有地址
+func (req *Request) peerIPs() []net.IP {
+	dest := req.realDestAddr
+	if dest == nil || len(dest.IP) == 0 || dest.IP.IsUnspecified() {
+		return nil
+	}
+	if len(req.destIPs) > 0 && !req.hostRewritten() {
+		return req.destIPs
+	}
+	return []net.IP{dest.IP}
+}
+
+// hostRewritten 目标主机是否被重写，仅端口被重写时仍为原主机
+func (req *Request) hostRewritten() bool {
+	return req.realDestAddr.FQDN != req.DestAddr.FQDN || !req.realDestAddr.IP.Equal(req.DestAddr.IP)
+}
+
+// isExpectedPeer 检查连入的对端是否为请求中的目标地址
+// 仅比较 IP，对端的源端口通常无法预知；目标地址未指定时允许任意对端
+func isExpectedPeer(ips []net.IP, remote *net.TCPAddr) bool {
+	if len(ips) == 0 {
+		return true
+	}
+	for _, ip := range ips {
+		if ip.Equal(remote.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// handleAssociate 处理 Associate 命令
 func (s *Server) handleAssociate(ctx context.Context, conn conn, req *Request) error {
 	// Check if this is allowed
 	if ctx_, ok := s.config.Rules.Allow(ctx, req); !ok {
-		if err := sendReply(conn, ReplyRuleFailure, nil); err != nil {
+		if err := req.sendReply(conn, ReplyRuleFailure, nil); err != nil {
 			return fmt.Errorf("failed to send reply: %v", err)
 		}
-		return fmt.Errorf("associate to %v blocked by rules", req.DestAddr)
+		return fmt.Errorf("associate to %v blocked by rules", destString(ctx, req))
 	} else {
 		ctx = ctx_
 	}
 
-	// TODO: Support associate
-	if err := sendReply(conn, ReplyCommandNotSupported, nil); err != nil {
+	// Listen on the bind ip
+	relay, err := net.ListenUDP("udp", &net.UDPAddr{IP: s.config.BindIP})
+	if err != nil {
+		if err := req.sendReply(conn, ReplyServerFailure, nil); err != nil {
+			return fmt.Errorf("failed to send reply: %v", err)
+		}
+		return fmt.Errorf("associate for %v failed: %v", destString(ctx, req), err)
+	}
+	defer relay.Close()
+
+	// Send the reply with the address the client should send datagrams to
+	local := relay.LocalAddr().(*net.UDPAddr)
+	bind := s.boundAddr(conn, local.IP, local.Port)
+	if err := req.sendReply(conn, ReplySuccess, bind); err != nil {
 		return fmt.Errorf("failed to send reply: %v", err)
 	}
+
+	// The association terminates when the controlling connection closes
+	go holdAssociation(req.bufConn, relay)
+
+	// Start relaying
+	return newUDPAssociation(ctx, s, req, relay).run()
+}
+
+// relay 在客户端与目标之间双向转发数据，直到两个方向都结束
+// 配置了 IdleTimeout 时，两个方向均空闲超时后结束；配置了 MaxLifetime 时，存活超时后结束
+func (s *Server) relay(req *Request, conn conn, target net.Conn) error {
+	reqCopier, respCopier := s.config.RequestCopier, s.config.ResponseCopier
+	var src, dst io.Reader = req.bufConn, target
+	if client, tcpTarget, ok := s.zeroCopyConns(req, conn, target); ok {
+		// 零拷贝转发，不经过自定义 Copier
+		copier := &zeroCopier{timeout: s.config.IdleTimeout}
+		if copier.timeout > 0 {
+			copier.activity = newActivity()
+		}
+		reqCopier, respCopier = copier, copier
+		src, dst = client, tcpTarget
+	} else if s.config.IdleTimeout > 0 {
+		act := newActivity()
+		src = &idleReader{reader: req.bufConn, conn: conn, timeout: s.config.IdleTimeout, activity: act}
+		dst = &idleReader{reader: target, conn: target, timeout: s.config.IdleTimeout, activity: act}
+	}
+
+	var expired int32
+	if s.config.MaxLifetime > 0 {
+		timer := time.AfterFunc(s.config.MaxLifetime, func() {
+			atomic.StoreInt32(&expired, 1)
+			target.Close()
+		})
+		defer timer.Stop()
+	}
+
+	errCh := make(chan error, 2)
+	go s.forwardRequest(req, reqCopier, target, src, errCh)
+	go s.forwardResponse(req, respCopier, conn, dst, errCh)
+
+	// Wait
+	for i := 0; i < 2; i++ {
+		e := <-errCh
+		if atomic.LoadInt32(&expired) == 1 {
+			return lifetimeExceeded
+		}
+		if e != nil {
+			// return from this function closes target (and conn).
+			return e
+		}
+	}
 	return nil
 }
 
 // forwardRequest 转发请求数据
-func (s *Server) forwardRequest(req *Request, dst io.Writer, src io.Reader, errCh chan error) {
-	n, err := s.config.RequestCopier.Copy(dst, src)
+func (s *Server) forwardRequest(req *Request, copier proxy.Copier, dst io.Writer, src io.Reader, errCh chan error) {
+	n, err := proxy.CopyUser(copier, req.AuthContext.UserIdentifier, dst, src)
 	if s.config.RequestReporter != nil {
 		_ = s.config.RequestReporter.Report(req.AuthContext.UserIdentifier, n)
 	}
@@ -268,8 +688,8 @@ func (s *Server) forwardRequest(req *Request, dst io.Writer, src io.Reader, errC
 }
 
 // forwardResponse 转发响应数据
-func (s *Server) forwardResponse(req *Request, dst io.Writer, src io.Reader, errCh chan error) {
-	n, err := s.config.ResponseCopier.Copy(dst, src)
+func (s *Server) forwardResponse(req *Request, copier proxy.Copier, dst io.Writer, src io.Reader, errCh chan error) {
+	n, err := proxy.CopyUser(copier, req.AuthContext.UserIdentifier, dst, src)
 	if s.config.ResponseReporter != nil {
 		_ = s.config.ResponseReporter.Report(req.AuthContext.UserIdentifier, n)
 	}
@@ -336,8 +756,17 @@ func readAddrSpec(r io.Reader) (*AddrSpec, error) {
 	return d, nil
 }
 
-// sendReply 用于响应相信
-func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+// sendReply 按请求的协议发送响应，默认为 SOCKS5 响应
+func (r *Request) sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	if r.reply != nil {
+		return r.reply(w, resp, addr)
+	}
+	return sendReply(w, resp, addr)
+}
+
+// appendAddrSpec 将地址按 地址类型（一个字节）+ 地址 + 端口 的格式追加到 b 中
+// 地址为空时，使用 0.0.0.0:0
+func appendAddrSpec(b []byte, addr *AddrSpec) ([]byte, error) {
 	// Format the address
 	var addrType uint8
 	var addrBody []byte
@@ -364,20 +793,24 @@ func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 		addrPort = uint16(addr.Port)
 
 	default:
-		return fmt.Errorf("failed to format address: %v", addr)
+		return nil, fmt.Errorf("failed to format address: %v", addr)
 	}
 
+	b = append(b, addrType)
+	b = append(b, addrBody...)
+	b = append(b, byte(addrPort>>8), byte(addrPort&0xff))
+	return b, nil
+}
+
+// sendReply 用于响应相信
+func sendReply(w io.Writer, resp uint8, addr *AddrSpec) error {
 	// Format the message
-	msg := make([]byte, 6+len(addrBody))
-	msg[0] = socks5Version
-	msg[1] = resp
-	msg[2] = 0 // Reserved
-	msg[3] = addrType
-	copy(msg[4:], addrBody)
-	msg[4+len(addrBody)] = byte(addrPort >> 8)
-	msg[4+len(addrBody)+1] = byte(addrPort & 0xff)
+	msg, err := appendAddrSpec([]byte{socks5Version, resp, 0}, addr)
+	if err != nil {
+		return err
+	}
 
 	// Send the message
-	_, err := w.Write(msg)
+	_, err = w.Write(msg)
 	return err
 }
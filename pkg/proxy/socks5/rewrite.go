@@ -0,0 +1,312 @@
+package socks5
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/net/context"
+)
+
+// RewriteConfig 目标地址重写配置，先查找 Static，再按顺序匹配 Rules，第一条匹配的规则生效
+type RewriteConfig struct {
+	// Static 静态重写，键为 host:port 或 host，host 为域名或 IP，值格式同 RewriteRuleConfig.Target
+	// 同时存在时 host:port 优先
+	Static map[string]string `json:"static,omitempty"`
+	// Rules 按规则重写
+	Rules []*RewriteRuleConfig `json:"rules,omitempty"`
+}
+
+// RewriteRuleConfig 重写规则，匹配条件与 ACLRuleConfig 相同，各条件同时满足时规则匹配，条件为空时不限制
+type RewriteRuleConfig struct {
+	Commands     []string `json:"commands,omitempty"`
+	Users        []string `json:"users,omitempty"`
+	Sources      []string `json:"sources,omitempty"`
+	Destinations []string `json:"destinations,omitempty"`
+	Domains      []string `json:"domains,omitempty"`
+	Ports        []string `json:"ports,omitempty"`
+
+	// Target 重写后的目标，支持：
+	//   10.0.0.1:8443         替换地址和端口
+	//   ingress.local         仅替换地址，保留端口
+	//   :8443                 仅替换端口
+	//   10.0.0.1:9000-9999    按偏移映射端口，Ports 须为一个长度相同的端口范围
+	//   unix:/run/app.sock    unix socket，仅对 connect 生效
+	Target string `json:"target"`
+}
+
+// Rewriter 基于配置的目标地址重写
+type Rewriter struct {
+	static map[string]*rewriteTarget
+	rules  []*rewriteRule
+}
+
+type rewriteRule struct {
+	match  *aclRule
+	target *rewriteTarget
+}
+
+// rewriteTarget 重写后的目标，字段为空时保留原值
+type rewriteTarget struct {
+	host string
+	ip   net.IP
+	// port 为范围时按 base 偏移映射
+	port *portRange
+	base int
+	unix string
+}
+
+// Rewrite 一次目标地址重写
+type Rewrite struct {
+	From *AddrSpec
+	To   *AddrSpec
+}
+
+type rewriteKey struct{}
+
+// WithRewrite 在上下文中记录目标地址重写
+func WithRewrite(ctx context.Context, from, to *AddrSpec) context.Context {
+	return context.WithValue(ctx, rewriteKey{}, Rewrite{From: from, To: to})
+}
+
+// RewriteFromContext 返回上下文中记录的目标地址重写
+func RewriteFromContext(ctx context.Context) (Rewrite, bool) {
+	rw, ok := ctx.Value(rewriteKey{}).(Rewrite)
+	return rw, ok
+}
+
+// LoadRewriter 从 JSON 文件加载重写配置
+func LoadRewriter(file string) (*Rewriter, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	conf := &RewriteConfig{}
+	if err := json.Unmarshal(data, conf); err != nil {
+		return nil, fmt.Errorf("parse rewrite file %s: %v", file, err)
+	}
+	return NewRewriter(conf)
+}
+
+// NewRewriter 创建目标地址重写
+func NewRewriter(conf *RewriteConfig) (*Rewriter, error) {
+	r := &Rewriter{static: make(map[string]*rewriteTarget)}
+	for key, target := range conf.Static {
+		k, err := parseStaticRewriteKey(key)
+		if err != nil {
+			return nil, err
+		}
+		t, err := parseRewriteTarget(target)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite %s: %v", key, err)
+		}
+		if t.port != nil && t.port.from != t.port.to {
+			return nil, fmt.Errorf("rewrite %s: port range not allowed", key)
+		}
+		r.static[k] = t
+	}
+	for i, rc := range conf.Rules {
+		rule, err := newRewriteRule(rc)
+		if err != nil {
+			return nil, fmt.Errorf("rewrite rule %d: %v", i, err)
+		}
+		r.rules = append(r.rules, rule)
+	}
+	return r, nil
+}
+
+// Len 静态重写和规则的数量
+func (r *Rewriter) Len() int {
+	return len(r.static) + len(r.rules)
+}
+
+func (r *Rewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	dest := req.DestAddr
+	target := r.lookupStatic(dest)
+	if target == nil {
+		for _, rule := range r.rules {
+			if rule.match.match(req) {
+				target = rule.target
+				break
+			}
+		}
+	}
+	if target == nil {
+		return ctx, dest
+	}
+
+	to, ok := target.apply(dest, req.Command)
+	if !ok {
+		return ctx, dest
+	}
+	return WithRewrite(ctx, dest, to), to
+}
+
+func (r *Rewriter) lookupStatic(dest *AddrSpec) *rewriteTarget {
+	if len(r.static) == 0 {
+		return nil
+	}
+
+	var hosts []string
+	if dest.FQDN != "" {
+		hosts = append(hosts, strings.ToLower(strings.TrimSuffix(dest.FQDN, ".")))
+	}
+	if len(dest.IP) > 0 {
+		hosts = append(hosts, dest.IP.String())
+	}
+	port := strconv.Itoa(dest.Port)
+	for _, host := range hosts {
+		if t, ok := r.static[net.JoinHostPort(host, port)]; ok {
+			return t
+		}
+	}
+	for _, host := range hosts {
+		if t, ok := r.static[host]; ok {
+			return t
+		}
+	}
+	return nil
+}
+
+func newRewriteRule(conf *RewriteRuleConfig) (*rewriteRule, error) {
+	match, err := newACLRule(&ACLRuleConfig{
+		Action:       ACLAllow,
+		Commands:     conf.Commands,
+		Users:        conf.Users,
+		Sources:      conf.Sources,
+		Destinations: conf.Destinations,
+		Domains:      conf.Domains,
+		Ports:        conf.Ports,
+	})
+	if err != nil {
+		return nil, err
+	}
+	target, err := parseRewriteTarget(conf.Target)
+	if err != nil {
+		return nil, err
+	}
+
+	if target.port != nil && target.port.from != target.port.to {
+		if len(match.ports) != 1 || match.ports[0].to-match.ports[0].from != target.port.to-target.port.from {
+			return nil, fmt.Errorf("target port range %s requires a single port range of the same size", conf.Target)
+		}
+		target.base = match.ports[0].from
+	}
+	return &rewriteRule{match: match, target: target}, nil
+}
+
+// parseStaticRewriteKey 解析静态重写的键，返回规范化的 host:port 或 host
+func parseStaticRewriteKey(key string) (string, error) {
+	host, port, err := net.SplitHostPort(key)
+	if err != nil {
+		host, port = key, ""
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		host = ip.String()
+	} else {
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+	}
+	if host == "" {
+		return "", fmt.Errorf("bad rewrite key: %s", key)
+	}
+	if port == "" {
+		return host, nil
+	}
+	if p, err := strconv.Atoi(port); err != nil || p < 0 || p > 0xffff {
+		return "", fmt.Errorf("bad rewrite key: %s", key)
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func parseRewriteTarget(s string) (*rewriteTarget, error) {
+	t := &rewriteTarget{}
+	if strings.HasPrefix(s, "unix:") {
+		t.unix = strings.TrimPrefix(s, "unix:")
+		if t.unix == "" {
+			return nil, fmt.Errorf("empty unix socket path")
+		}
+		return t, nil
+	}
+
+	host, port, err := net.SplitHostPort(s)
+	if err != nil {
+		// 没有端口，或未加方括号的 IPv6 地址
+		host, port = s, ""
+	}
+	if host == "" && port == "" {
+		return nil, fmt.Errorf("target required")
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		t.ip = ip
+	} else if strings.ContainsAny(host, ":/ ") {
+		return nil, fmt.Errorf("bad target: %s", s)
+	} else {
+		t.host = host
+	}
+	if port != "" {
+		p, err := parsePortRange(port)
+		if err != nil {
+			return nil, err
+		}
+		t.port = &p
+	}
+	return t, nil
+}
+
+// apply 返回重写后的地址，不适用时返回 false
+func (t *rewriteTarget) apply(dest *AddrSpec, command uint8) (*AddrSpec, bool) {
+	if t.unix != "" {
+		if command != CommandConnect {
+			return nil, false
+		}
+		return &AddrSpec{Unix: t.unix}, true
+	}
+
+	to := &AddrSpec{FQDN: dest.FQDN, IP: dest.IP, Port: dest.Port}
+	if t.ip != nil {
+		to.FQDN, to.IP = "", t.ip
+	} else if t.host != "" {
+		to.FQDN, to.IP = t.host, nil
+	}
+	if t.port != nil {
+		to.Port = t.port.from
+		if t.port.from != t.port.to {
+			to.Port += dest.Port - t.base
+		}
+	}
+	return to, true
+}
+
+// ReloadableRewriter 可在运行时原子替换的地址重写，已建立的连接不受影响
+type ReloadableRewriter struct {
+	rewriter atomic.Value // rewriterHolder
+}
+
+// rewriterHolder atomic.Value 要求每次存入的类型一致
+type rewriterHolder struct {
+	rewriter AddressRewriter
+}
+
+func NewReloadableRewriter(rewriter AddressRewriter) *ReloadableRewriter {
+	r := &ReloadableRewriter{}
+	r.Store(rewriter)
+	return r
+}
+
+// Store 替换地址重写
+func (r *ReloadableRewriter) Store(rewriter AddressRewriter) {
+	r.rewriter.Store(rewriterHolder{rewriter})
+}
+
+func (r *ReloadableRewriter) Rewrite(ctx context.Context, req *Request) (context.Context, *AddrSpec) {
+	rewriter := r.rewriter.Load().(rewriterHolder).rewriter
+	if rewriter == nil {
+		return ctx, req.DestAddr
+	}
+	return rewriter.Rewrite(ctx, req)
+}
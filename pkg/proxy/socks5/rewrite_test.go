@@ -0,0 +1,66 @@
+package socks5
+
+import (
+	"net"
+	"testing"
+
+	"golang.org/x/net/context"
+)
+
+func TestRewriter(t *testing.T) {
+	r, err := NewRewriter(&RewriteConfig{
+		Static: map[string]string{
+			"api.example.com:80": "10.0.0.2:8080",
+			"10.1.1.1":           "db.internal",
+		},
+		Rules: []*RewriteRuleConfig{
+			{Domains: []string{"*.internal"}, Ports: []string{"443"}, Target: "10.0.0.1"},
+			{Destinations: []string{"192.168.0.0/16"}, Ports: []string{"8000-8999"}, Target: ":9000-9999"},
+			{Domains: []string{"app.local"}, Target: "unix:/run/app.sock"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		command uint8
+		dest    *AddrSpec
+		expect  string
+	}{
+		{CommandConnect, &AddrSpec{FQDN: "API.example.com", Port: 80}, "10.0.0.2:8080"},
+		{CommandConnect, &AddrSpec{FQDN: "api.example.com", Port: 443}, "api.example.com (<nil>):443"},
+		{CommandConnect, &AddrSpec{IP: net.ParseIP("10.1.1.1"), Port: 5432}, "db.internal (<nil>):5432"},
+		{CommandConnect, &AddrSpec{FQDN: "git.corp.internal", IP: net.ParseIP("172.16.0.1"), Port: 443}, "10.0.0.1:443"},
+		{CommandConnect, &AddrSpec{FQDN: "git.corp.internal", Port: 22}, "git.corp.internal (<nil>):22"},
+		{CommandConnect, &AddrSpec{IP: net.ParseIP("192.168.1.1"), Port: 8080}, "192.168.1.1:9080"},
+		{CommandConnect, &AddrSpec{FQDN: "app.local", Port: 80}, "unix:/run/app.sock"},
+		{CommandUDPAssociate, &AddrSpec{FQDN: "app.local", Port: 80}, "app.local (<nil>):80"},
+	}
+	for _, tt := range tests {
+		req := &Request{Command: tt.command, DestAddr: tt.dest}
+		ctx, got := r.Rewrite(context.Background(), req)
+		if got.String() != tt.expect {
+			t.Errorf("rewrite %v: got %v, expected %s", tt.dest, got, tt.expect)
+		}
+		rw, ok := RewriteFromContext(ctx)
+		if ok != (got != tt.dest) {
+			t.Errorf("rewrite %v: recorded %v, expected %v", tt.dest, ok, got != tt.dest)
+		}
+		if ok && (rw.From != tt.dest || rw.To != got) {
+			t.Errorf("rewrite %v: unexpected record %v -> %v", tt.dest, rw.From, rw.To)
+		}
+	}
+
+	bad := []*RewriteRuleConfig{
+		{Target: ""},
+		{Target: "unix:"},
+		{Ports: []string{"80-90"}, Target: ":9000-9999"},
+		{Target: "10.0.0.1:9000-9999"},
+	}
+	for _, rc := range bad {
+		if _, err := NewRewriter(&RewriteConfig{Rules: []*RewriteRuleConfig{rc}}); err == nil {
+			t.Errorf("expected error for target %q", rc.Target)
+		}
+	}
+}
@@ -1,6 +1,8 @@
 package socks5
 
 import (
+	"sync/atomic"
+
 	"golang.org/x/net/context"
 )
 
@@ -38,3 +40,32 @@ func (p *PermitCommand) Allow(ctx context.Context, req *Request) (context.Contex
 
 	return ctx, false
 }
+
+// ReloadableRuleSet 可在运行时原子替换的授权规则，已建立的连接不受影响
+type ReloadableRuleSet struct {
+	rules atomic.Value // ruleSetHolder
+}
+
+// ruleSetHolder atomic.Value 要求每次存入的类型一致
+type ruleSetHolder struct {
+	rules RuleSet
+}
+
+func NewReloadableRuleSet(rules RuleSet) *ReloadableRuleSet {
+	r := &ReloadableRuleSet{}
+	r.Store(rules)
+	return r
+}
+
+// Store 替换授权规则
+func (r *ReloadableRuleSet) Store(rules RuleSet) {
+	r.rules.Store(ruleSetHolder{rules})
+}
+
+func (r *ReloadableRuleSet) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	rules := r.rules.Load().(ruleSetHolder).rules
+	if rules == nil {
+		return ctx, false
+	}
+	return rules.Allow(ctx, req)
+}
@@ -0,0 +1,76 @@
+package socks5
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const (
+	defaultSessionCheckInterval = 10 * time.Second
+)
+
+var (
+	accountInactive = fmt.Errorf("account disabled or expired")
+)
+
+// QuotaAccountant 可统计流量的配额检查，UDP 转发的数据经由它计入配额
+type QuotaAccountant interface {
+	QuotaChecker
+	Add(userIdentifier string, t time.Time, bytes int64)
+}
+
+// sessionError 检查已建立的会话能否继续，用户超出配额，或账号已停用、过期时返回错误
+func (s *Server) sessionError(req *Request) error {
+	user := req.AuthContext.UserIdentifier
+	if user == "" {
+		return nil
+	}
+	if s.config.Quota != nil && s.config.Quota.Exceeded(user) {
+		return proxy.QuotaExceeded
+	}
+	if store, ok := s.config.Credentials.(proxy.ActiveCredentialStore); ok &&
+		req.AuthContext.Method == MethodUserPassAuth && !store.UserActive(user) {
+		return accountInactive
+	}
+	return nil
+}
+
+// watchSession 定期检查会话，不能继续时关闭客户端连接以中断转发，返回停止检查的函数
+func (s *Server) watchSession(req *Request, conn conn) func() {
+	closer, ok := conn.(io.Closer)
+	if !ok || req.AuthContext == nil || req.AuthContext.UserIdentifier == "" {
+		return func() {}
+	}
+	if _, ok := s.config.Credentials.(proxy.ActiveCredentialStore); !ok && s.config.Quota == nil {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.config.SessionCheckInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if err := s.sessionError(req); err != nil {
+					s.config.Logger.Printf("[ERR] socks: closing session of %s: %v", req.AuthContext.UserIdentifier, err)
+					closer.Close()
+					return
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// chargeQuota 将未经过 Copier 转发的数据计入用户流量
+func (s *Server) chargeQuota(user string, bytes int64) {
+	if accountant, ok := s.config.Quota.(QuotaAccountant); ok && user != "" {
+		accountant.Add(user, time.Now(), bytes)
+	}
+}
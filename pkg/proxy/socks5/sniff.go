@@ -0,0 +1,177 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/cryptobyte"
+)
+
+// DefaultSniffPorts 默认嗅探的目标端口，HTTP 和 HTTPS 均由客户端先发送数据
+var DefaultSniffPorts = []int{80, 443}
+
+const (
+	// DefaultSniffTimeout 嗅探时等待客户端首个数据包的默认时间
+	DefaultSniffTimeout = 300 * time.Millisecond
+
+	tlsRecordHeaderLen      = 5
+	tlsContentHandshake     = 0x16
+	tlsHandshakeClientHello = 0x01
+	tlsExtensionServerName  = 0x0000
+)
+
+// httpMethods 用于识别 HTTP 请求行
+var httpMethods = []string{"GET ", "POST ", "HEAD ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "TRACE ", "CONNECT "}
+
+// sniffHost 读取客户端首个数据包中 TLS ClientHello 的 SNI 或 HTTP 请求的 Host，数据仍保留在 br 中
+// 超时或无法识别时返回空字符串，不影响后续转发
+func sniffHost(conn conn, br *bufio.Reader, timeout time.Duration) string {
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return ""
+	}
+	defer conn.SetReadDeadline(time.Time{})
+
+	b, err := br.Peek(1)
+	if err != nil {
+		return ""
+	}
+	if b[0] == tlsContentHandshake {
+		// 等待完整的 TLS 记录，超出缓冲区时尽量解析已有的部分
+		header, err := br.Peek(tlsRecordHeaderLen)
+		if err != nil {
+			return ""
+		}
+		n := tlsRecordHeaderLen + (int(header[3])<<8 | int(header[4]))
+		if n > br.Size() {
+			n = br.Size()
+		}
+		b, _ = br.Peek(n)
+		return sniffTLS(b)
+	}
+
+	if !isHTTPRequest(br) {
+		return ""
+	}
+	// 等待请求头结束，超时或超出缓冲区时解析已有的部分
+	for n := br.Buffered(); ; n = br.Buffered() + 1 {
+		b, err = br.Peek(n)
+		if err != nil || bytes.Contains(b, []byte("\r\n\r\n")) {
+			return sniffHTTP(b)
+		}
+	}
+}
+
+// isHTTPRequest 客户端数据是否以 HTTP 方法开头
+func isHTTPRequest(br *bufio.Reader) bool {
+	for _, method := range httpMethods {
+		if b, _ := br.Peek(len(method)); string(b) == method {
+			return true
+		}
+	}
+	return false
+}
+
+// sniffTLS 解析 TLS ClientHello 中的 server_name 扩展
+func sniffTLS(b []byte) string {
+	s := cryptobyte.String(b)
+	var contentType, handshakeType uint8
+	var version uint16
+	var record, hello cryptobyte.String
+	if !s.ReadUint8(&contentType) || contentType != tlsContentHandshake ||
+		!s.ReadUint16(&version) || !s.ReadUint16LengthPrefixed(&record) {
+		// 记录被截断时解析已读取的部分
+		if len(b) <= tlsRecordHeaderLen || b[0] != tlsContentHandshake {
+			return ""
+		}
+		record = cryptobyte.String(b[tlsRecordHeaderLen:])
+	}
+	if !record.ReadUint8(&handshakeType) || handshakeType != tlsHandshakeClientHello {
+		return ""
+	}
+	if !record.ReadUint24LengthPrefixed(&hello) {
+		// 握手消息跨越多个记录或被截断
+		if !record.Skip(3) {
+			return ""
+		}
+		hello = record
+	}
+
+	var sessionID, cipherSuites, compression, extensions cryptobyte.String
+	if !hello.Skip(2+32) ||
+		!hello.ReadUint8LengthPrefixed(&sessionID) ||
+		!hello.ReadUint16LengthPrefixed(&cipherSuites) ||
+		!hello.ReadUint8LengthPrefixed(&compression) {
+		return ""
+	}
+	if !hello.ReadUint16LengthPrefixed(&extensions) {
+		if !hello.Skip(2) {
+			return ""
+		}
+		extensions = hello
+	}
+	for !extensions.Empty() {
+		var extType uint16
+		var ext cryptobyte.String
+		if !extensions.ReadUint16(&extType) || !extensions.ReadUint16LengthPrefixed(&ext) {
+			return ""
+		}
+		if extType != tlsExtensionServerName {
+			continue
+		}
+
+		var names cryptobyte.String
+		if !ext.ReadUint16LengthPrefixed(&names) {
+			return ""
+		}
+		for !names.Empty() {
+			var nameType uint8
+			var name cryptobyte.String
+			if !names.ReadUint8(&nameType) || !names.ReadUint16LengthPrefixed(&name) {
+				return ""
+			}
+			if nameType == 0 {
+				return validSniffedHost(string(name))
+			}
+		}
+		return ""
+	}
+	return ""
+}
+
+// sniffHTTP 解析 HTTP 请求头中的 Host
+func sniffHTTP(b []byte) string {
+	lines := strings.Split(string(b), "\r\n")
+	// 最后一行可能不完整
+	for _, line := range lines[1 : len(lines)-1] {
+		if line == "" {
+			break
+		}
+		i := strings.IndexByte(line, ':')
+		if i < 0 || !strings.EqualFold(strings.TrimSpace(line[:i]), "Host") {
+			continue
+		}
+		host := strings.TrimSpace(line[i+1:])
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		return validSniffedHost(host)
+	}
+	return ""
+}
+
+// validSniffedHost 返回可用于规则匹配的域名，IP 地址和非法域名返回空字符串
+func validSniffedHost(host string) string {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	if host == "" || len(host) > 253 || net.ParseIP(strings.Trim(host, "[]")) != nil {
+		return ""
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_') {
+			return ""
+		}
+	}
+	return host
+}
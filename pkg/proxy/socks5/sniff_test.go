@@ -0,0 +1,58 @@
+package socks5
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+)
+
+// clientHello 返回 TLS 客户端发送的 ClientHello 记录
+func clientHello(t *testing.T, serverName string) []byte {
+	c1, c2 := net.Pipe()
+	defer c2.Close()
+	go func() {
+		_ = tls.Client(c1, &tls.Config{ServerName: serverName, InsecureSkipVerify: true}).Handshake()
+		c1.Close()
+	}()
+
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(c2, header); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, int(header[3])<<8|int(header[4]))
+	if _, err := io.ReadFull(c2, body); err != nil {
+		t.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func TestSniffTLS(t *testing.T) {
+	hello := clientHello(t, "Www.Example.com")
+	if host := sniffTLS(hello); host != "www.example.com" {
+		t.Fatalf("unexpected sni: %q", host)
+	}
+	if host := sniffTLS(hello[:20]); host != "" {
+		t.Fatalf("unexpected sni from truncated hello: %q", host)
+	}
+	if host := sniffTLS(clientHello(t, "")); host != "" {
+		t.Fatalf("unexpected sni without server name: %q", host)
+	}
+}
+
+func TestSniffHTTP(t *testing.T) {
+	tests := []struct {
+		data, expect string
+	}{
+		{"GET / HTTP/1.1\r\nHost: example.com\r\n\r\n", "example.com"},
+		{"POST /a HTTP/1.1\r\nUser-Agent: x\r\nhost: Example.com:8080\r\n\r\n", "example.com"},
+		{"GET / HTTP/1.1\r\nHost: 10.0.0.1\r\n\r\n", ""},
+		{"GET / HTTP/1.1\r\nUser-Agent: x\r\n\r\nHost: example.com\r\n", ""},
+		{"GET / HTTP/1.1\r\nHost: exam", ""},
+	}
+	for _, tt := range tests {
+		if host := sniffHTTP([]byte(tt.data)); host != tt.expect {
+			t.Errorf("sniffHTTP(%q) = %q, expected %q", tt.data, host, tt.expect)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package socks5
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+const (
+	socks4Version      = uint8(4)
+	socks4ReplyVersion = uint8(0)
+
+	socks4CommandConnect = uint8(1) // 连接命令
+	socks4CommandBind    = uint8(2) // 绑定命令
+
+	socks4ReplyGranted  = uint8(90) // 请求成功
+	socks4ReplyRejected = uint8(91) // 请求被拒绝或失败
+
+	// socks4MaxFieldLen USERID 和 HOSTNAME 的最大长度
+	socks4MaxFieldLen = 255
+)
+
+var (
+	socks4AuthRequired = fmt.Errorf("socks4 not allowed, authentication required")
+)
+
+//  1. Request:
+//     +----+----+----------+--------+----------+------+-----------------+
+//     | VN | CD | DST.PORT | DST.IP |  USERID  | NULL | HOSTNAME | NULL |
+//     +----+----+----------+--------+----------+------+-----------------+
+//     | 1  | 1  |    2     |   4    | Variable |  1   |     SOCKS4a     |
+//     +----+----+----------+--------+----------+------+-----------------+
+//
+//  2. Response:
+//     +----+----+----------+--------+
+//     | VN | CD | DST.PORT | DST.IP |
+//     +----+----+----------+--------+
+//     | 1  | 1  |    2     |   4    |
+//     +----+----+----------+--------+
+//
+// SOCKS4 没有密码，仅在服务允许无需鉴权或来源地址匹配 SourceAuth 时可用
+// USERID 由客户端任意填写，仅在启用 Socks4UserIdentifier 时作为用户标识
+func (s *Server) handleSocks4(ctx context.Context, conn net.Conn, bufConn *bufio.Reader) {
+	request, err := NewSocks4Request(bufConn)
+	if err != nil {
+		s.config.Logger.Printf("[ERR] socks: failed to read socks4 request: %v", withTimeoutReason(err, handshakeTimeout))
+		return
+	}
+
+	if !s.config.Socks4UserIdentifier {
+		request.AuthContext.UserIdentifier = ""
+	}
+	payload := request.AuthContext.Payload
+	if authContext, ok := s.config.SourceAuth.authContext(remoteIP(conn), payload); ok {
+		request.AuthContext = authContext
+	} else if _, ok := s.authMethods[MethodNoAuth]; !ok {
+		if err := request.sendReply(conn, ReplyRuleFailure, nil); err != nil {
+			s.config.Logger.Printf("[ERR] failed to send reply: %v", err)
+			return
+		}
+		s.config.Logger.Printf("[ERR] socks: %v", socks4AuthRequired)
+		return
+	}
+	if client, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
+	}
+
+	// 握手完成，清除超时
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.config.Logger.Printf("[ERR] socks: failed to clear handshake deadline: %v", err)
+		return
+	}
+
+	// 处理请求
+	if err := s.handleRequest(ctx, request, conn); err != nil {
+		err = fmt.Errorf("failed to handle socks4 request: %v", err)
+		s.config.Logger.Printf("[ERR] socks: %v", err)
+		return
+	}
+}
+
+// NewSocks4Request 读取 SOCKS4/SOCKS4a 请求，版本号已被读取
+// USERID 作为用户标识，同时存于 AuthContext.Payload["UserID"]
+func NewSocks4Request(bufConn *bufio.Reader) (*Request, error) {
+	// Read the command, port and ip
+	header := make([]byte, 7)
+	if _, err := io.ReadFull(bufConn, header); err != nil {
+		return nil, fmt.Errorf("failed to get socks4 command: %v", err)
+	}
+
+	var command uint8
+	switch header[0] {
+	case socks4CommandConnect:
+		command = CommandConnect
+	case socks4CommandBind:
+		command = CommandBind
+	default:
+		return nil, fmt.Errorf("unsupported socks4 command: %v", header[0])
+	}
+
+	dest := &AddrSpec{
+		Port: (int(header[1]) << 8) | int(header[2]),
+		IP:   net.IPv4(header[3], header[4], header[5], header[6]),
+	}
+
+	// Read the user id
+	userID, err := readNullString(bufConn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get socks4 user id: %v", err)
+	}
+
+	// SOCKS4a: DST.IP is 0.0.0.x (x != 0), followed by the host name
+	if header[3] == 0 && header[4] == 0 && header[5] == 0 && header[6] != 0 {
+		host, err := readNullString(bufConn)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get socks4a host name: %v", err)
+		}
+		dest.IP = nil
+		dest.FQDN = host
+	}
+
+	request := &Request{
+		Version:     socks4Version,
+		Command:     command,
+		AuthContext: &AuthContext{MethodNoAuth, userID, map[string]string{"UserID": userID}},
+		DestAddr:    dest,
+		bufConn:     bufConn,
+		reply:       sendSocks4Reply,
+	}
+	return request, nil
+}
+
+// readNullString 读取以 NULL 结尾的字符串
+func readNullString(r *bufio.Reader) (string, error) {
+	var b []byte
+	for {
+		c, err := r.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		if c == 0 {
+			return string(b), nil
+		}
+		if len(b) >= socks4MaxFieldLen {
+			return "", fmt.Errorf("field exceeds %d bytes", socks4MaxFieldLen)
+		}
+		b = append(b, c)
+	}
+}
+
+// sendSocks4Reply 发送 SOCKS4 响应，仅支持 IPv4 地址
+func sendSocks4Reply(w io.Writer, resp uint8, addr *AddrSpec) error {
+	msg := make([]byte, 8)
+	msg[0] = socks4ReplyVersion
+	msg[1] = socks4ReplyRejected
+	if resp == ReplySuccess {
+		msg[1] = socks4ReplyGranted
+	}
+	if addr != nil {
+		msg[2] = byte(addr.Port >> 8)
+		msg[3] = byte(addr.Port & 0xff)
+		if ip := addr.IP.To4(); ip != nil {
+			copy(msg[4:], ip)
+		}
+	}
+
+	_, err := w.Write(msg)
+	return err
+}
@@ -6,7 +6,10 @@ import (
 	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"golang.org/x/net/context"
 
@@ -15,6 +18,17 @@ import (
 
 const (
 	socks5Version = uint8(5)
+
+	defaultBindTimeout      = 2 * time.Minute
+	defaultHandshakeTimeout = 30 * time.Second
+	defaultDialTimeout      = 30 * time.Second
+
+	// refuseTimeout 超出连接数限制时等待客户端请求以便响应的时间
+	refuseTimeout = 5 * time.Second
+)
+
+var (
+	ServerClosed = fmt.Errorf("socks: server closed")
 )
 
 // Config is used to setup and configure a Server
@@ -30,6 +44,11 @@ type Config struct {
 	// Resolver 自定义 DNS 解析器，默认为 DNSResolver
 	Resolver proxy.NameResolver
 
+	// FakeIP 伪 IP 模式，客户端经 UDP ASSOCIATE 发往 53 端口的 A 查询由服务端以地址池中的伪 IP 应答，
+	// 之后目标为这些伪 IP 的请求还原为域名，使规则和日志使用真实域名，拨号时再通过 Resolver 解析
+	// 伪 IP 只为获得该地址的用户（匿名时为来源 IP）还原，为空时不启用
+	FakeIP *proxy.FakeIPPool
+
 	// Rules 用于自定义授权命令，默认为 PermitAll
 	Rules RuleSet
 
@@ -37,6 +56,20 @@ type Config struct {
 	// 在 RuleSet 之前调用
 	Rewriter AddressRewriter
 
+	// Sniff 目标为 IP 的 CONNECT 请求，从客户端首个数据包中读取 TLS SNI 或 HTTP Host 作为目标域名，
+	// 供 RuleSet、Rewriter 和日志使用，拨号仍使用原 IP
+	// 域名由客户端提供，仅在经 Resolver 解析的结果包含原 IP 时使用，否则忽略并按原 IP 处理
+	// 仅嗅探目标端口在 SniffPorts 中的请求，这些请求先响应成功再检查规则和拨号，规则拒绝或连接目标失败时
+	// 客户端收不到对应的响应码，只能看到连接关闭，失败原因记录在日志中，拨号失败同时上报给 FailureReporter
+	Sniff bool
+
+	// SniffPorts 嗅探的目标端口，默认为 DefaultSniffPorts
+	// 不应包含服务端先发送数据的协议（如 SMTP、SSH）的端口，这些连接要等待 SniffTimeout 后才开始拨号
+	SniffPorts []int
+
+	// SniffTimeout 嗅探时等待客户端数据的时间，超时后按原目标转发，避免阻塞服务端先发送数据的协议，默认 300 毫秒
+	SniffTimeout time.Duration
+
 	// RequestReporter 用于统计转发请求数据
 	RequestReporter proxy.TrafficReporter
 
@@ -52,6 +85,63 @@ type Config struct {
 	// BindIP 用于 bind 和 udp associate 命令
 	BindIP net.IP
 
+	// BindTimeout bind 命令等待对端连入的超时时间，默认为 2 分钟
+	BindTimeout time.Duration
+
+	// HandshakeTimeout 从建立连接到读取完请求的超时时间，默认为 30 秒
+	HandshakeTimeout time.Duration
+
+	// DialTimeout 连接目标地址的超时时间，默认为 30 秒
+	DialTimeout time.Duration
+
+	// IdleTimeout 隧道两个方向均无数据的最长时间，为 0 时不限制
+	IdleTimeout time.Duration
+
+	// MaxLifetime 隧道最长存活时间，为 0 时不限制
+	MaxLifetime time.Duration
+
+	// ConnectionAttemptDelay 目标有多个地址时，前一个连接尝试未完成时开始下一个的等待时间，默认 250 毫秒
+	// 地址按 RuleSet 在上下文中设置的 proxy.FamilyPolicy 排序，见 RFC 8305
+	ConnectionAttemptDelay time.Duration
+
+	// ZeroCopy CONNECT 隧道两端均为 TCP 连接时，通过 TCPConn.ReadFrom 转发（Linux 下为 splice），
+	// 数据不经过用户态缓冲区，启用后 RequestCopier 和 ResponseCopier 对这些隧道不生效
+	ZeroCopy bool
+
+	// MaxConns 同时处理的最大连接数，包括握手中的连接，为 0 时不限制
+	// 超出时 SOCKS5 响应 ReplyServerFailure，SOCKS4 响应请求被拒绝，HTTP 响应 503
+	MaxConns int
+
+	// MaxConnsPerUser 每个用户同时转发的最大连接数，超出时响应 ReplyRuleFailure，为 0 时不限制
+	MaxConnsPerUser int
+
+	// MaxConnsPerIP 每个来源 IP 同时处理的最大连接数，包括握手中的连接，超出时同 MaxConns，为 0 时不限制
+	MaxConnsPerIP int
+
+	// Quota 流量配额检查，超出配额的用户无法建立新的隧道，为空时不限制
+	// 实现 QuotaAccountant 时 UDP 转发的响应数据计入配额，超出配额时中断 UDP 关联
+	Quota QuotaChecker
+
+	// SessionCheckInterval 检查已建立的会话是否超出配额，或账号是否停用、过期（Credentials 实现 proxy.ActiveCredentialStore 时）的间隔，
+	// 不能继续的会话被中断，默认 10 秒
+	SessionCheckInterval time.Duration
+
+	// SourceAuth 按来源地址鉴权，匹配的客户端提供无需鉴权方式时直接通过，为空时不生效
+	SourceAuth *SourceAuth
+
+	// Socks4UserIdentifier 以 SOCKS4 请求的 USERID 作为用户标识，使其受每用户连接数、配额、限速和流量统计约束
+	// USERID 未经验证，客户端可冒用其他用户的标识，默认不启用，此时 SOCKS4 请求为匿名用户；来源地址匹配 SourceAuth 时以其为准
+	Socks4UserIdentifier bool
+
+	// AuthGuard 用户名密码鉴权失败限制，为空时不限制，仅在未指定 AuthMethods 时生效
+	AuthGuard *AuthGuard
+
+	// RejectReporter 用于统计因连接数限制或超出配额被拒绝的请求次数
+	RejectReporter proxy.TrafficReporter
+
+	// FailureReporter 用于统计连接目标失败的次数，标识为失败原因，见 ReplyReason
+	FailureReporter proxy.TrafficReporter
+
 	// Logger 自定义日志，默认为标准输出
 	Logger *log.Logger
 
@@ -59,17 +149,31 @@ type Config struct {
 	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
 }
 
-// Server 接收并处理 SOCKS5 请求
+// QuotaChecker 检查用户是否超出流量配额
+type QuotaChecker interface {
+	Exceeded(userIdentifier string) bool
+}
+
+// Server 接收并处理 SOCKS5 请求，同一端口兼容 SOCKS4/SOCKS4a 和 HTTP 代理请求
 type Server struct {
 	config      *Config
 	authMethods map[uint8]Authenticator
+	limiter     *connLimiter
+
+	ctx    context.Context    // 所有连接上下文的父上下文，强制关闭时取消
+	cancel context.CancelFunc // 取消所有连接
+
+	mu        sync.Mutex
+	closing   bool                      // 是否正在关闭
+	listeners map[net.Listener]struct{} // 正在接收连接的监听器
+	conns     sync.WaitGroup            // 正在处理的连接
 }
 
 func New(conf *Config) (*Server, error) {
 	// 至少需要支持一种鉴权方式
 	if len(conf.AuthMethods) == 0 {
 		if conf.Credentials != nil {
-			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{conf.Credentials}}
+			conf.AuthMethods = []Authenticator{&UserPassAuthenticator{Credentials: conf.Credentials, Guard: conf.AuthGuard}}
 		} else {
 			conf.AuthMethods = []Authenticator{&NoAuthAuthenticator{}}
 		}
@@ -89,6 +193,32 @@ func New(conf *Config) (*Server, error) {
 	if conf.Logger == nil {
 		conf.Logger = log.New(os.Stdout, "", log.LstdFlags)
 	}
+	if conf.AuthGuard != nil && conf.AuthGuard.config.Logger == nil {
+		conf.AuthGuard.config.Logger = conf.Logger
+	}
+
+	// 确保有超时时间
+	if conf.BindTimeout <= 0 {
+		conf.BindTimeout = defaultBindTimeout
+	}
+	if conf.HandshakeTimeout <= 0 {
+		conf.HandshakeTimeout = defaultHandshakeTimeout
+	}
+	if conf.DialTimeout <= 0 {
+		conf.DialTimeout = defaultDialTimeout
+	}
+	if conf.ConnectionAttemptDelay <= 0 {
+		conf.ConnectionAttemptDelay = proxy.DefaultConnectionAttemptDelay
+	}
+	if conf.SessionCheckInterval <= 0 {
+		conf.SessionCheckInterval = defaultSessionCheckInterval
+	}
+	if len(conf.SniffPorts) == 0 {
+		conf.SniffPorts = DefaultSniffPorts
+	}
+	if conf.SniffTimeout <= 0 {
+		conf.SniffTimeout = DefaultSniffTimeout
+	}
 
 	// 确保有数据转发器
 	if conf.RequestCopier == nil {
@@ -98,9 +228,14 @@ func New(conf *Config) (*Server, error) {
 		conf.ResponseCopier = proxy.NewSimpleCopier()
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	server := &Server{
 		config:      conf,
 		authMethods: make(map[uint8]Authenticator),
+		limiter:     newConnLimiter(conf.MaxConns, conf.MaxConnsPerUser, conf.MaxConnsPerIP),
+		ctx:         ctx,
+		cancel:      cancel,
+		listeners:   make(map[net.Listener]struct{}),
 	}
 
 	for _, a := range conf.AuthMethods {
@@ -114,13 +249,152 @@ func (s *Server) ListenAndServe(network, addr string) error {
 	if err != nil {
 		return err
 	}
+	return s.Serve(l)
+}
+
+// Serve 在监听器上接收连接，直到监听器出错或服务关闭
+// 服务关闭后返回 ServerClosed
+func (s *Server) Serve(l net.Listener) error {
+	if !s.trackListener(l, true) {
+		l.Close()
+		return ServerClosed
+	}
+	defer s.trackListener(l, false)
 
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if s.isClosing() {
+				return ServerClosed
+			}
 			return err
 		}
-		go s.handleConn(conn)
+		if !s.trackConn() {
+			conn.Close()
+			return ServerClosed
+		}
+		var ip string
+		if addr := remoteIP(conn); addr != nil {
+			ip = addr.String()
+		}
+		release, err := s.limiter.acquireConn(ip)
+		if err != nil {
+			s.reject(ip)
+			s.config.Logger.Printf("[ERR] socks: %v, refusing connection from %v", err, conn.RemoteAddr())
+			go func() {
+				defer s.conns.Done()
+				s.refuse(conn)
+			}()
+			continue
+		}
+		go func() {
+			defer s.conns.Done()
+			defer release()
+			s.handleConn(conn)
+		}()
+	}
+}
+
+// Shutdown 停止接收新连接，并等待正在处理的连接结束
+// 若 ctx 先结束，则取消所有连接的上下文并关闭连接，待其退出后返回 ctx 的错误
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.mu.Lock()
+	s.closing = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		s.conns.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		s.cancel()
+		return nil
+	case <-ctx.Done():
+		s.cancel()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (s *Server) isClosing() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.closing
+}
+
+// trackListener 记录或移除监听器，服务关闭后无法再记录
+func (s *Server) trackListener(l net.Listener, add bool) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !add {
+		delete(s.listeners, l)
+		return true
+	}
+	if s.closing {
+		return false
+	}
+	s.listeners[l] = struct{}{}
+	return true
+}
+
+// trackConn 记录新连接，服务关闭后无法再记录
+func (s *Server) trackConn() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closing {
+		return false
+	}
+	s.conns.Add(1)
+	return true
+}
+
+// refuse 连接数超出限制时按客户端协议响应失败并关闭连接
+// SOCKS5 客户端支持无需鉴权时读取请求后响应 ReplyServerFailure，否则响应无可用鉴权方式；
+// SOCKS4 响应请求被拒绝；HTTP 读取请求头后响应 503
+func (s *Server) refuse(conn net.Conn) {
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(refuseTimeout)); err != nil {
+		return
+	}
+	bufConn := bufio.NewReader(conn)
+	version, err := bufConn.Peek(1)
+	if err != nil {
+		return
+	}
+	switch version[0] {
+	case socks5Version:
+		_, _ = bufConn.Discard(1)
+		methods, err := readMethods(bufConn)
+		if err != nil {
+			return
+		}
+		for _, method := range methods {
+			if method != MethodNoAuth {
+				continue
+			}
+			if _, err := conn.Write([]byte{socks5Version, MethodNoAuth}); err != nil {
+				return
+			}
+			if _, err := NewRequest(bufConn); err != nil {
+				return
+			}
+			_ = sendReply(conn, ReplyServerFailure, nil)
+			return
+		}
+		_ = noAcceptableAuth(conn)
+	case socks4Version:
+		_ = sendSocks4Reply(conn, ReplyServerFailure, nil)
+	default:
+		if _, err := readHTTPHeader(bufConn, http.DefaultMaxHeaderBytes); err != nil {
+			return
+		}
+		_ = writeHTTPStatus(conn, http.StatusServiceUnavailable, nil)
 	}
 }
 
@@ -153,28 +427,49 @@ func (s *Server) ListenAndServe(network, addr string) error {
 //     +----+-----+-------+------+----------+----------+
 //
 // 5. CONNECT / BIND / UDP ASSOCIATE
+//
+// 首字节为 4 时按 SOCKS4/SOCKS4a 处理，其他非 SOCKS 版本号按 HTTP 代理处理
 func (s *Server) handleConn(conn net.Conn) {
 	defer conn.Close()
 	bufConn := bufio.NewReader(conn)
 
-	// 读取版本
-	version := []byte{0}
-	if _, err := bufConn.Read(version); err != nil {
-		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+	// 连接上下文在服务强制关闭时取消，取消时关闭连接以结束转发
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+
+	// 握手需在超时时间内完成
+	if err := conn.SetDeadline(time.Now().Add(s.config.HandshakeTimeout)); err != nil {
+		s.config.Logger.Printf("[ERR] socks: failed to set handshake deadline: %v", err)
 		return
 	}
 
-	// 检查兼容性
-	if version[0] != socks5Version {
-		err := fmt.Errorf("unsupported SOCKS version: %v", version)
-		s.config.Logger.Printf("[ERR] socks: %v", err)
+	// 读取版本，非 SOCKS 版本号时作为 HTTP 代理请求处理
+	version, err := bufConn.Peek(1)
+	if err != nil {
+		err = withTimeoutReason(err, handshakeTimeout)
+		s.config.Logger.Printf("[ERR] socks: Failed to get version byte: %v", err)
+		return
+	}
+	switch version[0] {
+	case socks5Version:
+		_, _ = bufConn.Discard(1)
+	case socks4Version:
+		_, _ = bufConn.Discard(1)
+		s.handleSocks4(ctx, conn, bufConn)
+		return
+	default:
+		s.handleHTTP(ctx, conn, bufConn)
 		return
 	}
 
 	// 认证请求
 	authContext, err := s.authenticate(conn, bufConn)
 	if err != nil {
-		err = fmt.Errorf("failed to authenticate: %v", err)
+		err = fmt.Errorf("failed to authenticate: %v", withTimeoutReason(err, handshakeTimeout))
 		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return
 	}
@@ -188,7 +483,7 @@ func (s *Server) handleConn(conn net.Conn) {
 			}
 		}
 
-		s.config.Logger.Printf("[ERR] failed to read destination address: %v", err)
+		s.config.Logger.Printf("[ERR] failed to read destination address: %v", withTimeoutReason(err, handshakeTimeout))
 		return
 	}
 	request.AuthContext = authContext
@@ -196,8 +491,14 @@ func (s *Server) handleConn(conn net.Conn) {
 		request.RemoteAddr = &AddrSpec{IP: client.IP, Port: client.Port}
 	}
 
+	// 握手完成，清除超时
+	if err := conn.SetDeadline(time.Time{}); err != nil {
+		s.config.Logger.Printf("[ERR] socks: failed to clear handshake deadline: %v", err)
+		return
+	}
+
 	// 处理请求
-	if err := s.handleRequest(request, conn); err != nil {
+	if err := s.handleRequest(ctx, request, conn); err != nil {
 		err = fmt.Errorf("failed to handle request: %v", err)
 		s.config.Logger.Printf("[ERR] socks: %v", err)
 		return
@@ -228,6 +529,17 @@ func (s *Server) authenticate(conn io.Writer, bufConn io.Reader) (*AuthContext,
 		return nil, fmt.Errorf("failed to get auth methods: %v", err)
 	}
 
+	// 来源地址已知的客户端无需用户名密码
+	for _, method := range methods {
+		if method != MethodNoAuth {
+			continue
+		}
+		if authContext, ok := s.config.SourceAuth.authContext(remoteIP(conn), nil); ok {
+			_, err := conn.Write([]byte{socks5Version, MethodNoAuth})
+			return authContext, err
+		}
+	}
+
 	// Select a usable method
 	for _, method := range methods {
 		cator, found := s.authMethods[method]
@@ -0,0 +1,1434 @@
+package socks5
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"golang.org/x/net/context"
+	"golang.org/x/net/dns/dnsmessage"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func newTestServer(t testing.TB, conf *Config) (*Server, string) {
+	server, err := New(conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = server.Shutdown(context.Background()) })
+
+	go server.Serve(l)
+	return server, l.Addr().String()
+}
+
+func dialNoAuth(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	if _, err := conn.Write([]byte{socks5Version, 1, MethodNoAuth}); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	resp := make([]byte, 2)
+	if _, err := io.ReadFull(reader, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != MethodNoAuth {
+		t.Fatalf("unexpected method: %v", resp[1])
+	}
+	return conn, reader
+}
+
+func writeRequest(t *testing.T, w io.Writer, command uint8, addr *AddrSpec) {
+	buf := &bytes.Buffer{}
+	if err := sendReply(buf, command, addr); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readTestReply(t *testing.T, r io.Reader) (uint8, *AddrSpec) {
+	header := make([]byte, 3)
+	if _, err := io.ReadFull(r, header); err != nil {
+		t.Fatal(err)
+	}
+	addr, err := readAddrSpec(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return header[1], addr
+}
+
+func TestBind(t *testing.T) {
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1")})
+	conn, reader := dialNoAuth(t, addr)
+
+	writeRequest(t, conn, CommandBind, &AddrSpec{IP: net.ParseIP("127.0.0.1")})
+	resp, bind := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected first reply: %v", resp)
+	}
+
+	peer, err := net.Dial("tcp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	resp, remote := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected second reply: %v", resp)
+	}
+	if remote.Port != peer.LocalAddr().(*net.TCPAddr).Port {
+		t.Fatalf("unexpected peer address: %v", remote)
+	}
+
+	if _, err := peer.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected data from peer: %q, %v", buf, err)
+	}
+
+	if _, err := conn.Write([]byte("pong")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(peer, buf); err != nil || string(buf) != "pong" {
+		t.Fatalf("unexpected data from client: %q, %v", buf, err)
+	}
+}
+
+func TestBindMultiHomed(t *testing.T) {
+	// 对端从目标域名的第二个地址连入
+	_, addr := newTestServer(t, &Config{
+		BindIP:   net.ParseIP("127.0.0.1"),
+		Resolver: addrsResolver{"peer.test": {net.ParseIP("192.0.2.1"), net.ParseIP("127.0.0.1")}},
+	})
+	conn, reader := dialNoAuth(t, addr)
+
+	writeRequest(t, conn, CommandBind, &AddrSpec{FQDN: "peer.test"})
+	resp, bind := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected first reply: %v", resp)
+	}
+
+	peer, err := net.Dial("tcp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	if resp, _ := readTestReply(t, reader); resp != ReplySuccess {
+		t.Fatalf("unexpected second reply: %v", resp)
+	}
+}
+
+func TestBindTimeout(t *testing.T) {
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1"), BindTimeout: 100 * time.Millisecond})
+	conn, reader := dialNoAuth(t, addr)
+
+	writeRequest(t, conn, CommandBind, &AddrSpec{IP: net.ParseIP("127.0.0.1")})
+	if resp, _ := readTestReply(t, reader); resp != ReplySuccess {
+		t.Fatalf("unexpected first reply: %v", resp)
+	}
+	if resp, _ := readTestReply(t, reader); resp != ReplyTTLExpired {
+		t.Fatalf("unexpected second reply: %v", resp)
+	}
+}
+
+func newUDPEchoServer(t testing.TB) *net.UDPConn {
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { echo.Close() })
+	go func() {
+		buf := make([]byte, udpBufSize)
+		for {
+			n, from, err := echo.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			_, _ = echo.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return echo
+}
+
+func TestUDPAssociate(t *testing.T) {
+	echo := newUDPEchoServer(t)
+
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1")})
+	conn, reader := dialNoAuth(t, addr)
+
+	writeRequest(t, conn, CommandUDPAssociate, nil)
+	resp, bind := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected reply: %v", resp)
+	}
+
+	client, err := net.Dial("udp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	local := echo.LocalAddr().(*net.UDPAddr)
+	dest := &AddrSpec{IP: local.IP, Port: local.Port}
+	pkt, err := packUDPDatagram(dest, []byte("ping"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, udpBufSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, data, err := readUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from.Address() != dest.Address() || string(data) != "ping" {
+		t.Fatalf("unexpected datagram from %v: %q", from, data)
+	}
+
+	// Fragmented datagrams are dropped
+	pkt[2] = 1
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+	_ = client.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if _, err := client.Read(buf); err == nil {
+		t.Fatal("expected fragmented datagram to be dropped")
+	}
+}
+
+func newEchoServer(t testing.TB) *net.TCPAddr {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return l.Addr().(*net.TCPAddr)
+}
+
+func TestSocks4aConnect(t *testing.T) {
+	echo := newEchoServer(t)
+
+	// USERID 仅在启用 Socks4UserIdentifier 时作为用户标识
+	for _, tt := range []struct {
+		userIdentifier bool
+		expect         string
+	}{
+		{false, ""},
+		{true, "alice"},
+	} {
+		rules := &recordRules{}
+		_, addr := newTestServer(t, &Config{Rules: rules, Socks4UserIdentifier: tt.userIdentifier})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := []byte{socks4Version, socks4CommandConnect, byte(echo.Port >> 8), byte(echo.Port), 0, 0, 0, 1}
+		req = append(req, "alice\x00localhost\x00"...)
+		if _, err := conn.Write(req); err != nil {
+			t.Fatal(err)
+		}
+
+		resp := make([]byte, 8)
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			t.Fatal(err)
+		}
+		if resp[0] != socks4ReplyVersion || resp[1] != socks4ReplyGranted {
+			t.Fatalf("unexpected reply: %v", resp)
+		}
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("unexpected echo: %q, %v", buf, err)
+		}
+		conn.Close()
+
+		rules.mu.Lock()
+		users := rules.users
+		rules.mu.Unlock()
+		if len(users) != 1 || users[0] != tt.expect {
+			t.Fatalf("unexpected user identifiers: %q", users)
+		}
+	}
+}
+
+func TestSocks4AuthRequired(t *testing.T) {
+	_, addr := newTestServer(t, &Config{Credentials: proxy.StaticCredentials{"alice": "secret"}})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	req := append([]byte{socks4Version, socks4CommandConnect, 0, 80, 127, 0, 0, 1}, "alice\x00"...)
+	if _, err := conn.Write(req); err != nil {
+		t.Fatal(err)
+	}
+	resp := make([]byte, 8)
+	if _, err := io.ReadFull(conn, resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp[1] != socks4ReplyRejected {
+		t.Fatalf("unexpected reply: %v", resp)
+	}
+}
+
+func TestHTTPConnect(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{Credentials: proxy.StaticCredentials{"alice": "secret"}})
+
+	for _, c := range []struct {
+		auth   string
+		status string
+	}{
+		{"", "HTTP/1.1 407 Proxy Authentication Required"},
+		{"Basic YWxpY2U6d3Jvbmc=", "HTTP/1.1 407 Proxy Authentication Required"},
+		{"Basic YWxpY2U6c2VjcmV0", "HTTP/1.1 200 Connection established"},
+	} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+		req := "CONNECT " + echo.String() + " HTTP/1.1\r\nHost: " + echo.String() + "\r\n"
+		if c.auth != "" {
+			req += "Proxy-Authorization: " + c.auth + "\r\n"
+		}
+		if _, err := conn.Write([]byte(req + "\r\n")); err != nil {
+			t.Fatal(err)
+		}
+
+		reader := bufio.NewReader(conn)
+		status, err := reader.ReadString('\n')
+		if err != nil || status != c.status+"\r\n" {
+			t.Fatalf("unexpected status: %q, %v", status, err)
+		}
+		if c.auth != "Basic YWxpY2U6c2VjcmV0" {
+			conn.Close()
+			continue
+		}
+		if line, err := reader.ReadString('\n'); err != nil || line != "\r\n" {
+			t.Fatalf("unexpected header: %q, %v", line, err)
+		}
+
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(reader, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("unexpected echo: %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestHTTPForward(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Proxy-Authorization") != "" {
+			t.Errorf("proxy authorization leaked to origin")
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.Method + " " + r.URL.Path + " " + string(body)))
+	}))
+	defer origin.Close()
+
+	_, addr := newTestServer(t, &Config{})
+	proxyURL, _ := url.Parse("http://" + addr)
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}, Timeout: 5 * time.Second}
+
+	resp, err := client.Post(origin.URL+"/echo", "text/plain", strings.NewReader("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "POST /echo hello" {
+		t.Fatalf("unexpected response: %d %q", resp.StatusCode, body)
+	}
+}
+
+func TestHTTPForwardRaw(t *testing.T) {
+	var requests int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		if r.Header.Get("X-Hop") != "" {
+			t.Errorf("connection-listed header leaked to origin")
+		}
+		body, _ := io.ReadAll(r.Body)
+		_, _ = w.Write([]byte(r.URL.Path + " " + string(body)))
+	}))
+	defer origin.Close()
+	_, addr := newTestServer(t, &Config{})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// 分块请求体重新编码后转发，同一连接上的后续请求不转发
+	host := strings.TrimPrefix(origin.URL, "http://")
+	req := "POST " + origin.URL + "/first HTTP/1.1\r\nHost: " + host + "\r\nConnection: keep-alive, X-Hop\r\nX-Hop: 1\r\n" +
+		"Transfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n" +
+		"GET " + origin.URL + "/second HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+	if _, err := conn.Write([]byte(req)); err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	if string(body) != "/first hello" {
+		t.Fatalf("unexpected response: %q", body)
+	}
+	if n := atomic.LoadInt32(&requests); n != 1 {
+		t.Fatalf("expected 1 request at origin, got %d", n)
+	}
+}
+
+func TestParseHTTPHost(t *testing.T) {
+	for _, c := range []struct {
+		hostport string
+		port     int
+		ok       bool
+	}{
+		{"example.com", 80, true},
+		{"example.com:8080", 8080, true},
+		{"[::1]", 80, true},
+		{"example.com:0", 0, false},
+		{"example.com:65536", 0, false},
+	} {
+		addr, err := parseHTTPHost(c.hostport, 80)
+		if (err == nil) != c.ok {
+			t.Fatalf("%s: unexpected error: %v", c.hostport, err)
+		}
+		if c.ok && addr.Port != c.port {
+			t.Fatalf("%s: unexpected port %d", c.hostport, addr.Port)
+		}
+	}
+	if _, err := parseHTTPHost("example.com", 0); err == nil {
+		t.Fatal("expected connect target without port to be rejected")
+	}
+}
+
+func TestHTTPHeaderTooLarge(t *testing.T) {
+	_, addr := newTestServer(t, &Config{})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	go func() {
+		_, _ = conn.Write([]byte("GET http://example.com/ HTTP/1.1\r\nX-Large: " + strings.Repeat("a", http.DefaultMaxHeaderBytes) + "\r\n\r\n"))
+	}()
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusRequestHeaderFieldsTooLarge {
+		t.Fatalf("unexpected status: %d", resp.StatusCode)
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	echo := newEchoServer(t)
+	server, err := New(&Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	serveErr := make(chan error, 1)
+	go func() { serveErr <- server.Serve(l) }()
+
+	conn, err := NewClient(l.Addr().String(), "", "").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// The active tunnel outlives the drain deadline and is closed
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if err := <-serveErr; err != ServerClosed {
+		t.Fatalf("expected server closed, got %v", err)
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected tunnel to be closed, got %v", err)
+	}
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Fatal("expected listener to be closed")
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	_, addr := newTestServer(t, &Config{HandshakeTimeout: 100 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected silent client to be disconnected, got %v", err)
+	}
+}
+
+func TestIdleTimeout(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{IdleTimeout: 200 * time.Millisecond})
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	// Activity keeps the tunnel open past the idle timeout
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected idle tunnel to be closed, got %v", err)
+	}
+}
+
+type countReporter struct {
+	mu     sync.Mutex
+	counts map[string]int64
+}
+
+func (r *countReporter) Report(identifier string, n int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.counts == nil {
+		r.counts = make(map[string]int64)
+	}
+	r.counts[identifier] += n
+	return nil
+}
+
+func (r *countReporter) get(identifier string) int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.counts[identifier]
+}
+
+func TestMaxConnsBeforeHandshake(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{MaxConns: 1})
+
+	// 未完成握手的连接同样占用名额
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	client := NewClient(addr, "", "")
+	_, err = client.Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyServerFailure {
+		t.Fatalf("expected server failure, got %v", err)
+	}
+
+	// HTTP 代理请求响应 503
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write([]byte("CONNECT " + echo.String() + " HTTP/1.1\r\nHost: " + echo.String() + "\r\n\r\n"))
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	conn.Close()
+	if err != nil || resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %v, %v", resp, err)
+	}
+
+	idle.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := client.Dial("tcp", echo.String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMaxConnsPerIPBeforeHandshake(t *testing.T) {
+	echo := newEchoServer(t)
+	rejects := &countReporter{}
+	_, addr := newTestServer(t, &Config{MaxConnsPerIP: 1, RejectReporter: rejects})
+
+	// 同一来源 IP 未完成握手的连接占用该 IP 的名额
+	idle, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer idle.Close()
+	time.Sleep(50 * time.Millisecond)
+	_, err = NewClient(addr, "", "").Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyServerFailure {
+		t.Fatalf("expected server failure, got %v", err)
+	}
+	if n := rejects.get("127.0.0.1"); n != 1 {
+		t.Fatalf("expected 1 rejection, got %d", n)
+	}
+}
+
+func TestConnLimits(t *testing.T) {
+	echo := newEchoServer(t)
+	rejects := &countReporter{}
+	_, addr := newTestServer(t, &Config{
+		Credentials:     proxy.StaticCredentials{"alice": "secret", "bob": "secret"},
+		MaxConnsPerUser: 1,
+		RejectReporter:  rejects,
+	})
+
+	alice := NewClient(addr, "alice", "secret")
+	first, err := alice.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = alice.Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+	if n := rejects.get("alice"); n != 1 {
+		t.Fatalf("expected 1 rejection, got %d", n)
+	}
+
+	// Other users are not affected
+	bob, err := NewClient(addr, "bob", "secret").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob.Close()
+
+	// The slot is released once the tunnel is closed
+	first.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := alice.Dial("tcp", echo.String())
+		if err == nil {
+			conn.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("slot not released: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestQuota(t *testing.T) {
+	echo := newEchoServer(t)
+	rejects := &countReporter{}
+	quota := proxy.NewQuotaEnforcer(map[string]proxy.Quota{"alice": {Daily: 8}})
+	_, addr := newTestServer(t, &Config{
+		Credentials:    proxy.StaticCredentials{"alice": "secret"},
+		ResponseCopier: quota.Copier(nil),
+		Quota:          quota,
+		RejectReporter: rejects,
+	})
+
+	// The tunnel is cut off once the quota is used up
+	conn, err := NewClient(addr, "alice", "secret").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	payload := []byte("0123456789")
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write(payload); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, len(payload))); err != nil {
+		t.Fatal(err)
+	}
+	_, _ = conn.Write(payload)
+	if n, err := io.Copy(io.Discard, conn); n != 0 || err != nil {
+		t.Fatalf("tunnel not cut off: read %d bytes, %v", n, err)
+	}
+	if !quota.Exceeded("alice") {
+		t.Fatal("expected quota exceeded")
+	}
+
+	// New tunnels are refused
+	_, err = NewClient(addr, "alice", "secret").Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+	if n := rejects.get("alice"); n != 1 {
+		t.Fatalf("expected 1 rejection, got %d", n)
+	}
+}
+
+func TestQuotaUDP(t *testing.T) {
+	echo := newUDPEchoServer(t)
+	quota := proxy.NewQuotaEnforcer(map[string]proxy.Quota{"alice": {Daily: 8}})
+	_, addr := newTestServer(t, &Config{
+		Credentials: proxy.StaticCredentials{"alice": "secret"},
+		Quota:       quota,
+		BindIP:      net.ParseIP("127.0.0.1"),
+	})
+
+	pc, err := NewClient(addr, "alice", "secret").ListenPacket(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+
+	// UDP 响应数据计入配额，超出后不再转发
+	payload := []byte("0123456789")
+	buf := make([]byte, udpBufSize)
+	if _, err := pc.WriteTo(payload, echo.LocalAddr()); err != nil {
+		t.Fatal(err)
+	}
+	_ = pc.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, _, err := pc.ReadFrom(buf); err != nil || n != len(payload) {
+		t.Fatalf("unexpected echo: %d, %v", n, err)
+	}
+	if daily, _ := quota.Usage("alice"); daily != int64(len(payload)) {
+		t.Fatalf("expected udp traffic to be charged, got %d", daily)
+	}
+
+	_, _ = pc.WriteTo(payload, echo.LocalAddr())
+	_ = pc.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, _, err := pc.ReadFrom(buf); err == nil {
+		t.Fatal("expected udp association to be cut off")
+	}
+}
+
+func TestSessionRevoked(t *testing.T) {
+	echo := newEchoServer(t)
+	hashed, err := proxy.HashPassword(proxy.HashSHA256, "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	accounts, err := proxy.NewAccounts([]*proxy.Account{{Username: "alice", Password: hashed}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := proxy.NewReloadableCredentials(accounts)
+	_, addr := newTestServer(t, &Config{Credentials: creds, SessionCheckInterval: 20 * time.Millisecond})
+
+	conn, err := NewClient(addr, "alice", "secret").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// 账号停用后正在转发的隧道被中断
+	disabled, err := proxy.NewAccounts([]*proxy.Account{{Username: "alice", Password: hashed, Disabled: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds.Store(disabled)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if n, err := io.Copy(io.Discard, conn); n != 0 || err != nil {
+		t.Fatalf("tunnel not cut off: read %d bytes, %v", n, err)
+	}
+}
+
+type mapResolver map[string]net.IP
+
+func (r mapResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	if ip, ok := r[name]; ok {
+		return ctx, ip, nil
+	}
+	return ctx, nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+}
+
+// recordRules 记录请求的目标地址和用户标识
+type recordRules struct {
+	mu    sync.Mutex
+	dests []AddrSpec
+	users []string
+	// next 不为空时由其决定是否允许
+	next RuleSet
+}
+
+func (r *recordRules) Allow(ctx context.Context, req *Request) (context.Context, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.dests = append(r.dests, *req.DestAddr)
+	r.users = append(r.users, req.AuthContext.UserIdentifier)
+	if r.next != nil {
+		return r.next.Allow(ctx, req)
+	}
+	return ctx, true
+}
+
+// fakeDNSQuery 经 UDP ASSOCIATE 发送 DNS 查询，返回应答中的地址
+func fakeDNSQuery(t *testing.T, addr, name string, qtype dnsmessage.Type) []net.IP {
+	conn, reader := dialNoAuth(t, addr)
+	defer conn.Close()
+	writeRequest(t, conn, CommandUDPAssociate, nil)
+	resp, bind := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected reply: %v", resp)
+	}
+	client, err := net.Dial("udp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+
+	b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: 1, RecursionDesired: true})
+	_ = b.StartQuestions()
+	_ = b.Question(dnsmessage.Question{Name: dnsmessage.MustNewName(name + "."), Type: qtype, Class: dnsmessage.ClassINET})
+	query, err := b.Finish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 查询不会发往该地址
+	pkt, err := packUDPDatagram(&AddrSpec{IP: net.ParseIP("192.0.2.53"), Port: 53}, query)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Write(pkt); err != nil {
+		t.Fatal(err)
+	}
+
+	buf := make([]byte, udpBufSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, data, err := readUDPDatagram(buf[:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var msg dnsmessage.Message
+	if err := msg.Unpack(data); err != nil {
+		t.Fatal(err)
+	}
+	if msg.ID != 1 || !msg.Response {
+		t.Fatalf("unexpected dns header: %+v", msg.Header)
+	}
+	var ips []net.IP
+	for _, answer := range msg.Answers {
+		if a, ok := answer.Body.(*dnsmessage.AResource); ok {
+			ips = append(ips, net.IP(a.A[:]))
+		}
+	}
+	return ips
+}
+
+func TestFakeIP(t *testing.T) {
+	echo := newEchoServer(t)
+	pool, err := proxy.NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &recordRules{}
+	var mu sync.Mutex
+	var dialed []string
+	_, addr := newTestServer(t, &Config{
+		BindIP:   net.ParseIP("127.0.0.1"),
+		Resolver: mapResolver{"echo.test": echo.IP},
+		FakeIP:   pool,
+		Rules:    rules,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			if host, _, _ := net.SplitHostPort(addr); !net.ParseIP(host).Equal(echo.IP) {
+				return nil, syscall.ECONNREFUSED
+			}
+			return proxy.Direct.DialContext(ctx, network, addr)
+		},
+	})
+	client := NewClient(addr, "", "")
+
+	// 服务端以伪 IP 应答 DNS 查询，AAAA 查询返回空应答
+	ips := fakeDNSQuery(t, addr, "echo.test", dnsmessage.TypeA)
+	if len(ips) != 1 || !pool.Contains(ips[0]) {
+		t.Fatalf("unexpected fake ip answer: %v", ips)
+	}
+	fake := ips[0]
+	if ips := fakeDNSQuery(t, addr, "echo.test", dnsmessage.TypeAAAA); len(ips) != 0 {
+		t.Fatalf("unexpected aaaa answer: %v", ips)
+	}
+	rules.mu.Lock()
+	rules.dests = nil
+	rules.mu.Unlock()
+
+	// 域名和伪 IP 均转发到真实地址，规则看到的是域名
+	for _, dest := range []string{"echo.test", fake.String()} {
+		conn, err := client.Dial("tcp", net.JoinHostPort(dest, strconv.Itoa(echo.Port)))
+		if err != nil {
+			t.Fatalf("dial %s: %v", dest, err)
+		}
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 4)
+		if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+			t.Fatalf("unexpected echo: %q, %v", buf, err)
+		}
+		conn.Close()
+	}
+	// 规则先看到伪 IP，拨号前再以真实地址检查
+	for _, dest := range rules.dests {
+		if dest.FQDN != "echo.test" || !dest.IP.Equal(fake) && !dest.IP.Equal(echo.IP) {
+			t.Errorf("unexpected rule destination: %v", &dest)
+		}
+	}
+
+	// 未分配的地址段内地址不还原，按原地址拨号
+	other := net.IPv4(198, 18, 0, 200)
+	_, err = client.Dial("tcp", net.JoinHostPort(other.String(), "80"))
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyConnectionRefused {
+		t.Fatalf("expected connection refused, got %v", err)
+	}
+	mu.Lock()
+	last := dialed[len(dialed)-1]
+	mu.Unlock()
+	if last != "198.18.0.200:80" {
+		t.Fatalf("unexpected dialed address: %s", last)
+	}
+
+	_, err = client.Dial("tcp", "missing.test:80")
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyHostUnreachable {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+}
+
+func TestFakeIPOwner(t *testing.T) {
+	pool, err := proxy.NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &recordRules{next: PermitNone()}
+	_, addr := newTestServer(t, &Config{
+		Credentials: proxy.StaticCredentials{"alice": "secret", "bob": "secret"},
+		FakeIP:      pool,
+		Rules:       rules,
+	})
+
+	// 分配给 alice 的伪 IP 不为 bob 还原
+	fake := pool.Allocate("echo.test", "alice")
+	for _, user := range []string{"alice", "bob"} {
+		_, err := NewClient(addr, user, "secret").Dial("tcp", net.JoinHostPort(fake.String(), "80"))
+		if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+			t.Fatalf("expected rule failure, got %v", err)
+		}
+	}
+	rules.mu.Lock()
+	defer rules.mu.Unlock()
+	if len(rules.dests) != 2 || rules.dests[0].FQDN != "echo.test" || rules.dests[1].FQDN != "" {
+		t.Fatalf("unexpected destinations: %v", rules.dests)
+	}
+}
+
+func TestFakeIPDestinationRules(t *testing.T) {
+	echo := newEchoServer(t)
+	pool, err := proxy.NewFakeIPPool("198.18.0.0/15")
+	if err != nil {
+		t.Fatal(err)
+	}
+	acl, err := NewACL(&ACLConfig{
+		Default: ACLAllow,
+		Rules:   []*ACLRuleConfig{{Action: ACLDeny, Destinations: []string{echo.IP.String() + "/32"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, &Config{
+		Resolver: mapResolver{"echo.test": echo.IP},
+		FakeIP:   pool,
+		Rules:    acl,
+	})
+	client := NewClient(addr, "", "")
+
+	// 伪 IP 不在拒绝的网段内，真实地址被拒绝
+	for _, dest := range []string{"echo.test", pool.Allocate("echo.test", "127.0.0.1").String()} {
+		_, err := client.Dial("tcp", net.JoinHostPort(dest, strconv.Itoa(echo.Port)))
+		if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+			t.Fatalf("dial %s: expected rule failure, got %v", dest, err)
+		}
+	}
+}
+
+type addrsResolver map[string][]net.IP
+
+func (r addrsResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	return ctx, r[name][0], nil
+}
+
+func (r addrsResolver) ResolveAddrs(ctx context.Context, name string) (context.Context, []net.IP, time.Duration, error) {
+	return ctx, r[name], 0, nil
+}
+
+func TestHappyEyeballs(t *testing.T) {
+	echo := newEchoServer(t)
+	acl, err := NewACL(&ACLConfig{
+		Default: ACLAllow,
+		Rules: []*ACLRuleConfig{
+			{Action: ACLAllow, Domains: []string{"v6only.test"}, Family: "ipv6"},
+			{Action: ACLAllow, PreferFamily: "ipv6"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2001:db8::1 不可达，拨号一直等待到取消
+	unreachable := net.ParseIP("2001:db8::1")
+	_, addr := newTestServer(t, &Config{
+		Resolver: addrsResolver{
+			"dual.test":   {echo.IP, unreachable},
+			"v6only.test": {echo.IP, unreachable},
+		},
+		Rules:                  acl,
+		ConnectionAttemptDelay: 50 * time.Millisecond,
+		DialTimeout:            time.Second,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(addr); net.ParseIP(host).Equal(unreachable) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return proxy.Direct.DialContext(ctx, network, addr)
+		},
+	})
+	client := NewClient(addr, "", "")
+
+	conn, err := client.Dial("tcp", net.JoinHostPort("dual.test", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	_, err = client.Dial("tcp", net.JoinHostPort("v6only.test", strconv.Itoa(echo.Port)))
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyTTLExpired {
+		t.Fatalf("expected ttl expired, got %v", err)
+	}
+}
+
+func TestDeniedAddrsNotDialed(t *testing.T) {
+	acl, err := NewACL(&ACLConfig{
+		Default: ACLAllow,
+		Rules:   []*ACLRuleConfig{{Action: ACLDeny, Destinations: []string{"10.0.0.0/8"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var mu sync.Mutex
+	var dialed []string
+	_, addr := newTestServer(t, &Config{
+		Resolver: addrsResolver{
+			"multi.test":  {net.ParseIP("192.0.2.1"), net.ParseIP("10.0.0.1")},
+			"denied.test": {net.ParseIP("10.0.0.1"), net.ParseIP("10.0.0.2")},
+		},
+		Rules:                  acl,
+		ConnectionAttemptDelay: 20 * time.Millisecond,
+		DialTimeout:            200 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			mu.Lock()
+			dialed = append(dialed, addr)
+			mu.Unlock()
+			// 所有地址都不可达，拨号一直等待到超时
+			<-ctx.Done()
+			return nil, ctx.Err()
+		},
+	})
+	client := NewClient(addr, "", "")
+
+	_, err = client.Dial("tcp", "multi.test:80")
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyTTLExpired {
+		t.Fatalf("expected ttl expired, got %v", err)
+	}
+	_, err = client.Dial("tcp", "denied.test:80")
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(dialed) != 1 || dialed[0] != "192.0.2.1:80" {
+		t.Fatalf("unexpected dialed addresses: %v", dialed)
+	}
+}
+
+func TestDialFailures(t *testing.T) {
+	// 关闭监听后该端口拒绝连接
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	closed := l.Addr().String()
+	l.Close()
+
+	failures := &countReporter{}
+	_, addr := newTestServer(t, &Config{
+		Resolver:        mapResolver{},
+		FailureReporter: failures,
+	})
+	client := NewClient(addr, "", "")
+
+	_, err = client.Dial("tcp", closed)
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyConnectionRefused {
+		t.Fatalf("expected connection refused, got %v", err)
+	}
+	_, err = client.Dial("tcp", "missing.test:80")
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyHostUnreachable {
+		t.Fatalf("expected host unreachable, got %v", err)
+	}
+
+	if n := failures.get("connection_refused"); n != 1 {
+		t.Errorf("expected 1 connection_refused failure, got %d", n)
+	}
+	if n := failures.get("host_unreachable"); n != 1 {
+		t.Errorf("expected 1 host_unreachable failure, got %d", n)
+	}
+}
+
+func TestRewriteUnix(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "echo.sock")
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	rewriter, err := NewRewriter(&RewriteConfig{
+		Rules: []*RewriteRuleConfig{{Domains: []string{"*.internal"}, Target: "unix:" + sock}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, addr := newTestServer(t, &Config{
+		Resolver: mapResolver{"echo.internal": net.ParseIP("192.0.2.1")},
+		Rewriter: rewriter,
+	})
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", "echo.internal:80")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q", buf)
+	}
+}
+
+func TestRewriteHostOnly(t *testing.T) {
+	echo := newEchoServer(t)
+	rewriter, err := NewRewriter(&RewriteConfig{
+		Rules: []*RewriteRuleConfig{{Domains: []string{"*.internal"}, Target: "backend.test"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 重写后的域名由 Resolver 解析，不可达的地址不影响其他地址
+	unreachable := net.ParseIP("192.0.2.2")
+	_, addr := newTestServer(t, &Config{
+		Resolver: addrsResolver{
+			"echo.internal": {net.ParseIP("192.0.2.1")},
+			"backend.test":  {unreachable, echo.IP},
+		},
+		Rewriter:               rewriter,
+		ConnectionAttemptDelay: 20 * time.Millisecond,
+		Dial: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			if host, _, _ := net.SplitHostPort(addr); !net.ParseIP(host).Equal(echo.IP) {
+				<-ctx.Done()
+				return nil, ctx.Err()
+			}
+			return proxy.Direct.DialContext(ctx, network, addr)
+		},
+	})
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", net.JoinHostPort("echo.internal", strconv.Itoa(echo.Port)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "ping" {
+		t.Fatalf("unexpected echo: %q, %v", buf, err)
+	}
+}
+
+func TestSniff(t *testing.T) {
+	echo := newEchoServer(t)
+	acl, err := NewACL(&ACLConfig{
+		Default: ACLAllow,
+		Rules:   []*ACLRuleConfig{{Action: ACLDeny, Domains: []string{"blocked.test"}}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	rules := &recordRules{next: acl}
+	_, addr := newTestServer(t, &Config{
+		Resolver: addrsResolver{
+			"allowed.test": {echo.IP},
+			"blocked.test": {echo.IP},
+			"spoofed.test": {net.ParseIP("192.0.2.1")},
+		},
+		Rules:        rules,
+		Sniff:        true,
+		SniffPorts:   []int{echo.Port},
+		SniffTimeout: 100 * time.Millisecond,
+	})
+	client := NewClient(addr, "", "")
+
+	// 先响应成功，再根据 Host 决定是否转发，解析结果不包含原 IP 的 Host 被忽略
+	for _, host := range []string{"allowed.test", "blocked.test", "spoofed.test"} {
+		conn, err := client.Dial("tcp", echo.String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		request := "GET / HTTP/1.1\r\nHost: " + host + "\r\n\r\n"
+		if _, err := conn.Write([]byte(request)); err != nil {
+			t.Fatal(err)
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, len(request))
+		_, err = io.ReadFull(conn, buf)
+		conn.Close()
+		if host != "blocked.test" && (err != nil || string(buf) != request) {
+			t.Fatalf("expected echo, got %q, %v", buf, err)
+		}
+		if host == "blocked.test" && err == nil {
+			t.Fatal("expected blocked connection to be closed")
+		}
+	}
+
+	// 客户端不发送数据时，超时后按原目标转发
+	conn, err := client.Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	time.Sleep(200 * time.Millisecond)
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 4)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+
+	rules.mu.Lock()
+	dests := rules.dests
+	rules.mu.Unlock()
+	if len(dests) != 4 || dests[0].FQDN != "allowed.test" || dests[1].FQDN != "blocked.test" || dests[2].FQDN != "" || dests[3].FQDN != "" {
+		t.Fatalf("unexpected destinations: %v", dests)
+	}
+}
+
+func TestSniffPorts(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{
+		Rules: PermitNone(),
+		Sniff: true,
+	})
+
+	// 端口不在 SniffPorts 中时不提前响应，客户端收到规则拒绝
+	_, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if re, ok := err.(*ReplyError); !ok || re.Reply != ReplyRuleFailure {
+		t.Fatalf("expected rule failure, got %v", err)
+	}
+}
+
+// udpResolver slow.test 在 release 关闭前不返回，flaky.test 首次解析失败
+type udpResolver struct {
+	release chan struct{}
+	ip      net.IP
+
+	mu    sync.Mutex
+	calls map[string]int
+}
+
+func (r *udpResolver) Resolve(ctx context.Context, name string) (context.Context, net.IP, error) {
+	r.mu.Lock()
+	r.calls[name]++
+	calls := r.calls[name]
+	r.mu.Unlock()
+
+	switch name {
+	case "slow.test":
+		select {
+		case <-r.release:
+		case <-ctx.Done():
+			return ctx, nil, ctx.Err()
+		}
+	case "flaky.test":
+		if calls == 1 {
+			return ctx, nil, &net.DNSError{Err: "server misbehaving", Name: name}
+		}
+	}
+	return ctx, r.ip, nil
+}
+
+func TestUDPAssociateRouting(t *testing.T) {
+	echo := newUDPEchoServer(t)
+	local := echo.LocalAddr().(*net.UDPAddr)
+	resolver := &udpResolver{release: make(chan struct{}), ip: local.IP, calls: make(map[string]int)}
+	_, addr := newTestServer(t, &Config{BindIP: net.ParseIP("127.0.0.1"), Resolver: resolver})
+	conn, reader := dialNoAuth(t, addr)
+
+	writeRequest(t, conn, CommandUDPAssociate, nil)
+	resp, bind := readTestReply(t, reader)
+	if resp != ReplySuccess {
+		t.Fatalf("unexpected reply: %v", resp)
+	}
+	client, err := net.Dial("udp", bind.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	send := func(host, data string) {
+		pkt, err := packUDPDatagram(&AddrSpec{FQDN: host, Port: local.Port}, []byte(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := client.Write(pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+	receive := func() (string, error) {
+		buf := make([]byte, udpBufSize)
+		_ = client.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		_, data, err := readUDPDatagram(buf[:n])
+		return string(data), err
+	}
+
+	// 解析缓慢的目标不阻塞其他目标
+	send("slow.test", "slow")
+	send("fast.test", "fast")
+	if data, err := receive(); err != nil || data != "fast" {
+		t.Fatalf("expected fast reply, got %q, %v", data, err)
+	}
+
+	// 解析完成后发送暂存的数据
+	close(resolver.release)
+	if data, err := receive(); err != nil || data != "slow" {
+		t.Fatalf("expected pending datagram, got %q, %v", data, err)
+	}
+
+	// 解析失败不缓存
+	send("flaky.test", "first")
+	if _, err := receive(); err == nil {
+		t.Fatal("expected datagram to unresolvable target to be dropped")
+	}
+	send("flaky.test", "second")
+	if data, err := receive(); err != nil || data != "second" {
+		t.Fatalf("expected retry to succeed, got %q, %v", data, err)
+	}
+}
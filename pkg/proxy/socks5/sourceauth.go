@@ -0,0 +1,68 @@
+package socks5
+
+import (
+	"fmt"
+	"net"
+)
+
+// SourceAuth 按来源地址鉴权，将来源网段映射为用户标识，用于无法配置密码的内网和 CI 环境
+// 匹配的客户端无需用户名密码，未匹配的客户端仍使用 AuthMethods 鉴权
+type SourceAuth struct {
+	networks []sourceNetwork
+}
+
+type sourceNetwork struct {
+	network    *net.IPNet
+	identifier string
+}
+
+// NewSourceAuth 创建来源地址鉴权，networks 的键为 CIDR 或 IP，值为用户标识
+func NewSourceAuth(networks map[string]string) (*SourceAuth, error) {
+	a := &SourceAuth{}
+	for cidr, identifier := range networks {
+		if identifier == "" {
+			return nil, fmt.Errorf("empty identifier for %s", cidr)
+		}
+		nets, err := parseCIDRs([]string{cidr})
+		if err != nil {
+			return nil, err
+		}
+		a.networks = append(a.networks, sourceNetwork{network: nets[0], identifier: identifier})
+	}
+	return a, nil
+}
+
+// Identify 返回来源地址对应的用户标识和网段，多个网段匹配时使用掩码最长的
+func (a *SourceAuth) Identify(ip net.IP) (identifier string, network string, ok bool) {
+	if len(ip) == 0 {
+		return "", "", false
+	}
+
+	best := -1
+	for _, n := range a.networks {
+		if !n.network.Contains(ip) {
+			continue
+		}
+		if ones, _ := n.network.Mask.Size(); ones > best {
+			best = ones
+			identifier, network, ok = n.identifier, n.network.String(), true
+		}
+	}
+	return identifier, network, ok
+}
+
+// authContext 来源地址匹配时返回鉴权上下文
+func (a *SourceAuth) authContext(ip net.IP, payload map[string]string) (*AuthContext, bool) {
+	if a == nil {
+		return nil, false
+	}
+	identifier, network, ok := a.Identify(ip)
+	if !ok {
+		return nil, false
+	}
+	if payload == nil {
+		payload = make(map[string]string)
+	}
+	payload["Source"] = network
+	return &AuthContext{MethodNoAuth, identifier, payload}, true
+}
@@ -0,0 +1,81 @@
+package socks5
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func TestSourceAuthIdentify(t *testing.T) {
+	auth, err := NewSourceAuth(map[string]string{
+		"10.0.0.0/8":  "office",
+		"10.1.0.0/16": "ci",
+		"192.168.1.1": "admin",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"10.2.3.4":    "office",
+		"10.1.3.4":    "ci",
+		"192.168.1.1": "admin",
+		"192.168.1.2": "",
+	}
+	for ip, expected := range tests {
+		identifier, _, _ := auth.Identify(net.ParseIP(ip))
+		if identifier != expected {
+			t.Errorf("Identify(%s) = %q, expected %q", ip, identifier, expected)
+		}
+	}
+
+	if _, err := NewSourceAuth(map[string]string{"10.0.0.0/33": "bad"}); err == nil {
+		t.Error("expected error for bad cidr")
+	}
+}
+
+func TestSourceAuth(t *testing.T) {
+	echo := newEchoServer(t)
+	credentials := proxy.StaticCredentials{"alice": "secret"}
+
+	trusted, _ := NewSourceAuth(map[string]string{"127.0.0.0/8": "office"})
+	requests := &countReporter{}
+	_, addr := newTestServer(t, &Config{Credentials: credentials, SourceAuth: trusted, RequestReporter: requests})
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte("ping")); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 4)); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+
+	// Traffic is attributed to the network's identifier
+	deadline := time.Now().Add(time.Second)
+	for requests.get("office") != 4 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := requests.get("office"); n != 4 {
+		t.Fatalf("expected 4 bytes reported for office, got %d", n)
+	}
+
+	// Clients from other networks still need a password
+	untrusted, _ := NewSourceAuth(map[string]string{"10.0.0.0/8": "office"})
+	_, addr = newTestServer(t, &Config{Credentials: credentials, SourceAuth: untrusted})
+	if _, err := NewClient(addr, "", "").Dial("tcp", echo.String()); err == nil {
+		t.Fatal("expected anonymous client from unknown network to be rejected")
+	}
+	conn, err = NewClient(addr, "alice", "secret").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
@@ -0,0 +1,78 @@
+package socks5
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	handshakeTimeout    = fmt.Errorf("handshake timeout")
+	idleTimeoutExceeded = fmt.Errorf("idle timeout exceeded")
+	lifetimeExceeded    = fmt.Errorf("max lifetime exceeded")
+)
+
+// isTimeout 是否为超时错误，包括被包装的超时错误
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
+// withTimeoutReason 超时错误补充超时原因
+func withTimeoutReason(err error, reason error) error {
+	if isTimeout(err) {
+		return fmt.Errorf("%v: %v", reason, err)
+	}
+	return err
+}
+
+// activity 记录隧道两个方向最近一次收到数据的时间
+type activity struct {
+	last int64
+}
+
+func newActivity() *activity {
+	a := &activity{}
+	a.touch()
+	return a
+}
+
+func (a *activity) touch() {
+	atomic.StoreInt64(&a.last, time.Now().UnixNano())
+}
+
+func (a *activity) idle() time.Duration {
+	return time.Duration(time.Now().UnixNano() - atomic.LoadInt64(&a.last))
+}
+
+// idleReader 每次读取前刷新读超时，超时后若隧道两个方向均空闲超过 timeout，返回 idleTimeoutExceeded
+type idleReader struct {
+	reader   io.Reader
+	conn     interface{ SetReadDeadline(t time.Time) error }
+	timeout  time.Duration
+	activity *activity
+}
+
+func (r *idleReader) Read(b []byte) (int, error) {
+	for {
+		if err := r.conn.SetReadDeadline(time.Now().Add(r.timeout)); err != nil {
+			return 0, err
+		}
+
+		n, err := r.reader.Read(b)
+		if n > 0 {
+			r.activity.touch()
+		}
+		if n == 0 && isTimeout(err) {
+			// 另一个方向仍在传输数据，继续等待
+			if r.activity.idle() < r.timeout {
+				continue
+			}
+			return 0, idleTimeoutExceeded
+		}
+		return n, err
+	}
+}
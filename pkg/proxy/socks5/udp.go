@@ -0,0 +1,392 @@
+package socks5
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/context"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+const (
+	// udpBufSize UDP 数据报最大长度
+	udpBufSize = 64 * 1024
+
+	// udpTargetTimeout 目标空闲超过该时间后移除，被拒绝的目标在该时间后重新检查
+	udpTargetTimeout = 2 * time.Minute
+
+	// udpMaxTargets 每个 UDP 关联同时保留的最大目标数
+	udpMaxTargets = 1024
+
+	// udpMaxPending 目标解析完成前每个目标最多暂存的数据报数
+	udpMaxPending = 8
+)
+
+var (
+	fragmentNotSupported = fmt.Errorf("udp fragmentation not supported")
+)
+
+// UDP 数据报格式：
+//
+//	+----+------+------+----------+----------+----------+
+//	|RSV | FRAG | ATYP | DST.ADDR | DST.PORT |   DATA   |
+//	+----+------+------+----------+----------+----------+
+//	| 2  |  1   |  1   | Variable |    2     | Variable |
+//	+----+------+------+----------+----------+----------+
+
+// readUDPDatagram 解析 UDP 数据报，返回目标地址和数据
+func readUDPDatagram(b []byte) (*AddrSpec, []byte, error) {
+	if len(b) < 4 {
+		return nil, nil, fmt.Errorf("short udp datagram: %d bytes", len(b))
+	}
+	if b[2] != 0 {
+		return nil, nil, fragmentNotSupported
+	}
+
+	r := bytes.NewReader(b[3:])
+	addr, err := readAddrSpec(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	return addr, b[len(b)-r.Len():], nil
+}
+
+// packUDPDatagram 将数据封装为 UDP 数据报
+func packUDPDatagram(addr *AddrSpec, data []byte) ([]byte, error) {
+	b, err := appendAddrSpec(make([]byte, 3, 3+1+255+2+len(data)), addr)
+	if err != nil {
+		return nil, err
+	}
+	return append(b, data...), nil
+}
+
+// udpTarget UDP 关联中的一个目标
+type udpTarget struct {
+	dest    *AddrSpec    // 客户端请求的目标地址
+	real    *net.UDPAddr // 实际目标地址（可能被重写）
+	ready   bool         // 是否已完成解析、重写及授权
+	allowed bool         // 是否允许转发
+	pending [][]byte     // 完成解析前收到的数据
+	expires time.Time    // 过期时间，允许的目标在转发数据时延长，被拒绝的目标到期后重新检查
+}
+
+// udpAssociation 一次 UDP 关联，生命周期与控制 TCP 连接一致
+type udpAssociation struct {
+	server *Server
+	ctx    context.Context
+	req    *Request
+	relay  *net.UDPConn
+
+	expected *net.UDPAddr // 期望的客户端地址，端口为 0 时不限制端口
+	client   *net.UDPAddr // 锁定的客户端地址
+
+	mu        sync.Mutex
+	targets   map[string]*udpTarget // 目标地址 => 目标
+	remotes   map[string]*udpTarget // 实际目标地址 => 目标
+	lastPurge time.Time
+
+	requestBytes  int64
+	responseBytes int64
+}
+
+func newUDPAssociation(ctx context.Context, s *Server, req *Request, relay *net.UDPConn) *udpAssociation {
+	// 客户端在请求中声明其发送数据报的地址，未声明时使用控制连接的地址
+	expected := &net.UDPAddr{Port: req.DestAddr.Port}
+	if len(req.DestAddr.IP) != 0 && !req.DestAddr.IP.IsUnspecified() {
+		expected.IP = req.DestAddr.IP
+	} else if req.RemoteAddr != nil {
+		expected.IP = req.RemoteAddr.IP
+	}
+
+	return &udpAssociation{
+		server:   s,
+		ctx:      ctx,
+		req:      req,
+		relay:    relay,
+		expected: expected,
+		targets:  make(map[string]*udpTarget),
+		remotes:  make(map[string]*udpTarget),
+	}
+}
+
+// run 转发数据报，直到 relay 被关闭
+func (a *udpAssociation) run() error {
+	defer a.report()
+
+	buf := make([]byte, udpBufSize)
+	idleTimeout := a.server.config.IdleTimeout
+	for {
+		if idleTimeout > 0 {
+			if err := a.relay.SetReadDeadline(time.Now().Add(idleTimeout)); err != nil {
+				return err
+			}
+		}
+
+		n, from, err := a.relay.ReadFromUDP(buf)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			if isTimeout(err) {
+				return idleTimeoutExceeded
+			}
+			return fmt.Errorf("udp relay read failed: %v", err)
+		}
+
+		if a.isClient(from) {
+			a.forwardRequest(buf[:n])
+		} else if target := a.remote(from); target != nil {
+			a.forwardResponse(target, buf[:n])
+		}
+	}
+}
+
+// isClient 判断数据报是否来自客户端，首个匹配的数据报将锁定客户端地址
+func (a *udpAssociation) isClient(from *net.UDPAddr) bool {
+	if a.client != nil {
+		return a.client.IP.Equal(from.IP) && a.client.Port == from.Port
+	}
+
+	if a.expected.IP != nil && !a.expected.IP.Equal(from.IP) {
+		return false
+	}
+	if a.expected.Port != 0 && a.expected.Port != from.Port {
+		return false
+	}
+	a.client = from
+	return true
+}
+
+// forwardRequest 转发客户端数据报到目标，目标首次出现时在后台解析，解析完成前的数据暂存
+func (a *udpAssociation) forwardRequest(b []byte) {
+	dest, data, err := readUDPDatagram(b)
+	if err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate dropped datagram: %v", err)
+		return
+	}
+	if a.server.config.FakeIP != nil && dest.Port == 53 {
+		// 伪 IP 模式下由服务端应答 DNS 查询
+		if resp, ok := fakeDNSAnswer(a.server.config.FakeIP, fakeIPOwner(a.req), data); ok {
+			a.reply(dest, resp)
+			return
+		}
+	}
+
+	key := dest.Address()
+	now := time.Now()
+	a.mu.Lock()
+	target, ok := a.targets[key]
+	if ok && target.ready && now.After(target.expires) {
+		a.remove(key, target)
+		ok = false
+	}
+	if !ok {
+		a.purge(now)
+		if len(a.targets) >= udpMaxTargets {
+			a.mu.Unlock()
+			a.server.config.Logger.Printf("[ERR] socks: udp associate dropped datagram to %v: too many targets", dest)
+			return
+		}
+		target = &udpTarget{dest: dest, expires: now.Add(udpTargetTimeout)}
+		a.targets[key] = target
+		go a.route(key, target)
+	}
+	if !target.ready {
+		if len(target.pending) < udpMaxPending {
+			target.pending = append(target.pending, append([]byte(nil), data...))
+		}
+		a.mu.Unlock()
+		return
+	}
+	if !target.allowed {
+		a.mu.Unlock()
+		return
+	}
+	target.expires = now.Add(udpTargetTimeout)
+	a.mu.Unlock()
+
+	a.send(target, data)
+}
+
+// send 发送数据到目标
+func (a *udpAssociation) send(target *udpTarget, data []byte) {
+	if _, err := a.relay.WriteToUDP(data, target.real); err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate send to %v failed: %v", target.dest, err)
+		return
+	}
+	atomic.AddInt64(&a.requestBytes, int64(len(data)))
+}
+
+// reply 以目标地址的名义直接应答客户端
+func (a *udpAssociation) reply(from *AddrSpec, data []byte) {
+	pkt, err := packUDPDatagram(from, data)
+	if err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate failed to pack datagram: %v", err)
+		return
+	}
+	if _, err := a.relay.WriteToUDP(pkt, a.client); err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate send to client failed: %v", err)
+	}
+}
+
+// remote 查找实际目标地址对应的目标
+func (a *udpAssociation) remote(from *net.UDPAddr) *udpTarget {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	target, ok := a.remotes[from.String()]
+	if !ok {
+		return nil
+	}
+	target.expires = time.Now().Add(udpTargetTimeout)
+	return target
+}
+
+// forwardResponse 转发目标数据报到客户端
+func (a *udpAssociation) forwardResponse(target *udpTarget, data []byte) {
+	user := a.req.AuthContext.UserIdentifier
+	if user != "" && a.server.config.Quota != nil && a.server.config.Quota.Exceeded(user) {
+		// 超出配额时结束关联
+		a.server.config.Logger.Printf("[ERR] socks: udp associate of %s closed: %v", user, proxy.QuotaExceeded)
+		a.relay.Close()
+		return
+	}
+
+	pkt, err := packUDPDatagram(target.dest, data)
+	if err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate failed to pack datagram: %v", err)
+		return
+	}
+
+	if _, err := a.relay.WriteToUDP(pkt, a.client); err != nil {
+		a.server.config.Logger.Printf("[ERR] socks: udp associate send to client failed: %v", err)
+		return
+	}
+	atomic.AddInt64(&a.responseBytes, int64(len(data)))
+	a.server.chargeQuota(user, int64(len(data)))
+}
+
+// route 解析、重写及授权目标，完成后发送暂存的数据
+// 解析失败的目标不保留，下一个数据报将重新解析；被拒绝的目标保留到过期
+func (a *udpAssociation) route(key string, target *udpTarget) {
+	remote, denied, err := a.resolve(target.dest)
+
+	a.mu.Lock()
+	pending := target.pending
+	target.pending = nil
+	if err != nil {
+		if denied {
+			target.ready = true
+		} else {
+			a.remove(key, target)
+		}
+		a.mu.Unlock()
+		a.server.config.Logger.Printf("[ERR] socks: udp associate %v", err)
+		return
+	}
+	target.real = remote
+	target.ready, target.allowed = true, true
+	a.remotes[remote.String()] = target
+	a.mu.Unlock()
+
+	if a.ctx.Err() != nil {
+		return
+	}
+	for _, data := range pending {
+		a.send(target, data)
+	}
+}
+
+// resolve 返回目标的实际地址，被规则拒绝时 denied 为 true
+func (a *udpAssociation) resolve(dest *AddrSpec) (remote *net.UDPAddr, denied bool, err error) {
+	req := &Request{
+		Version:     a.req.Version,
+		Command:     CommandUDPAssociate,
+		AuthContext: a.req.AuthContext,
+		RemoteAddr:  a.req.RemoteAddr,
+		DestAddr:    dest,
+	}
+
+	// Resolve the address if we have a FQDN
+	ctx, cancel := context.WithTimeout(a.ctx, a.server.config.DialTimeout)
+	defer cancel()
+	a.server.restoreFakeIP(fakeIPOwner(a.req), dest)
+	if dest.FQDN != "" {
+		ctx_, addr, err := a.server.config.Resolver.Resolve(ctx, dest.FQDN)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to resolve destination '%v': %v", dest.FQDN, err)
+		}
+		ctx = ctx_
+		dest.IP = addr
+	}
+
+	// Apply any address rewrites
+	ctx = a.server.rewrite(ctx, req)
+
+	// Check if this is allowed
+	if _, ok := a.server.config.Rules.Allow(ctx, req); !ok {
+		return nil, true, fmt.Errorf("to %v blocked by rules", destString(ctx, req))
+	}
+
+	// 重写后的目标仅有域名时由 Resolver 解析
+	real := *req.realDestAddr
+	if len(real.IP) == 0 && real.FQDN != "" {
+		_, ip, err := a.server.config.Resolver.Resolve(ctx, real.FQDN)
+		if err != nil {
+			return nil, false, fmt.Errorf("failed to resolve destination '%v': %v", destString(ctx, req), err)
+		}
+		real.IP = ip
+	}
+	remote, err = net.ResolveUDPAddr("udp", real.Address())
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to resolve destination '%v': %v", destString(ctx, req), err)
+	}
+	return remote, false, nil
+}
+
+// remove 移除目标，调用时需持有锁
+func (a *udpAssociation) remove(key string, target *udpTarget) {
+	if a.targets[key] == target {
+		delete(a.targets, key)
+	}
+	if target.real != nil && a.remotes[target.real.String()] == target {
+		delete(a.remotes, target.real.String())
+	}
+}
+
+// purge 清除过期的目标，目标数达到上限前每分钟最多一次，调用时需持有锁
+func (a *udpAssociation) purge(now time.Time) {
+	if now.Sub(a.lastPurge) < time.Minute && len(a.targets) < udpMaxTargets {
+		return
+	}
+	a.lastPurge = now
+	for key, target := range a.targets {
+		if target.ready && now.After(target.expires) {
+			a.remove(key, target)
+		}
+	}
+}
+
+// report 上报转发流量
+func (a *udpAssociation) report() {
+	identifier := a.req.AuthContext.UserIdentifier
+	if a.server.config.RequestReporter != nil {
+		_ = a.server.config.RequestReporter.Report(identifier, atomic.LoadInt64(&a.requestBytes))
+	}
+	if a.server.config.ResponseReporter != nil {
+		_ = a.server.config.ResponseReporter.Report(identifier, atomic.LoadInt64(&a.responseBytes))
+	}
+}
+
+// holdAssociation 等待控制连接关闭，然后结束 UDP 关联
+func holdAssociation(ctrl io.Reader, relay *net.UDPConn) {
+	_, _ = io.Copy(io.Discard, ctrl)
+	relay.Close()
+}
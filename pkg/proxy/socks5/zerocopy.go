@@ -0,0 +1,112 @@
+package socks5
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"time"
+)
+
+const (
+	// spliceChunkSize 零拷贝转发单次最多转发的字节数，每转发一次刷新空闲超时
+	spliceChunkSize = 4 * 1024 * 1024
+)
+
+// drainReader 客户端连接，握手时已缓冲的数据需先于连接中的数据转发
+type drainReader struct {
+	buffered *bufio.Reader
+	conn     *net.TCPConn
+}
+
+func (r *drainReader) Read(b []byte) (int, error) {
+	if r.buffered.Buffered() > 0 {
+		return r.buffered.Read(b)
+	}
+	return r.conn.Read(b)
+}
+
+// drain 将已缓冲的数据写入 dst
+func (r *drainReader) drain(dst io.Writer) (int64, error) {
+	n := r.buffered.Buffered()
+	if n == 0 {
+		return 0, nil
+	}
+	b, _ := r.buffered.Peek(n)
+	written, err := dst.Write(b)
+	_, _ = r.buffered.Discard(written)
+	return int64(written), err
+}
+
+// zeroCopier 零拷贝转发器，dst 和 src 均为 TCP 连接时，通过 TCPConn.ReadFrom 转发（Linux 下为 splice）
+// 配置了空闲超时时，分块转发并在每块之后刷新超时
+type zeroCopier struct {
+	timeout  time.Duration
+	activity *activity
+}
+
+func (c *zeroCopier) Copy(dst io.Writer, src io.Reader) (int64, error) {
+	var written int64
+	if r, ok := src.(*drainReader); ok {
+		n, err := r.drain(dst)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		src = r.conn
+	}
+
+	rf, ok := dst.(io.ReaderFrom)
+	tcp, ok2 := src.(*net.TCPConn)
+	if !ok || !ok2 {
+		n, err := io.Copy(dst, src)
+		return written + n, err
+	}
+
+	for {
+		if c.timeout > 0 {
+			if err := tcp.SetReadDeadline(time.Now().Add(c.timeout)); err != nil {
+				return written, err
+			}
+		}
+
+		n, err := rf.ReadFrom(&io.LimitedReader{R: tcp, N: spliceChunkSize})
+		written += n
+		if n > 0 && c.activity != nil {
+			c.activity.touch()
+		}
+		if err != nil {
+			if c.timeout > 0 && isTimeout(err) {
+				// 另一个方向仍在传输数据，继续等待
+				if c.activity.idle() < c.timeout {
+					continue
+				}
+				return written, idleTimeoutExceeded
+			}
+			return written, err
+		}
+		if n < spliceChunkSize {
+			// EOF
+			return written, nil
+		}
+	}
+}
+
+// zeroCopyConns 检查隧道是否可以零拷贝转发，可以时返回客户端读取端和目标连接
+func (s *Server) zeroCopyConns(req *Request, conn conn, target net.Conn) (*drainReader, *net.TCPConn, bool) {
+	if !s.config.ZeroCopy {
+		return nil, nil, false
+	}
+	client, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	buffered, ok := req.bufConn.(*bufio.Reader)
+	if !ok {
+		return nil, nil, false
+	}
+	tcpTarget, ok := target.(*net.TCPConn)
+	if !ok {
+		return nil, nil, false
+	}
+	return &drainReader{buffered: buffered, conn: client}, tcpTarget, true
+}
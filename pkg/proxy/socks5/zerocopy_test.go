@@ -0,0 +1,122 @@
+package socks5
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/proxy"
+)
+
+func TestZeroCopy(t *testing.T) {
+	echo := newEchoServer(t)
+	requests, responses := &countReporter{}, &countReporter{}
+	_, addr := newTestServer(t, &Config{
+		ZeroCopy:         true,
+		RequestReporter:  requests,
+		ResponseReporter: responses,
+	})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	// Pipeline the handshake, request and payload so part of the payload is
+	// buffered by the server before the tunnel starts
+	payload := bytes.Repeat([]byte("0123456789"), 100000)
+	msg, _ := appendAddrSpec([]byte{socks5Version, 1, MethodNoAuth, socks5Version, CommandConnect, 0},
+		&AddrSpec{IP: echo.IP, Port: echo.Port})
+	go func() {
+		_, _ = conn.Write(append(msg, payload...))
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	if _, err := io.ReadFull(conn, make([]byte, 2)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readReply(conn); err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, payload) {
+		t.Fatalf("expected %d echoed bytes, got %d", len(payload), len(got))
+	}
+
+	// Reports are sent after both directions finish
+	time.Sleep(50 * time.Millisecond)
+	if n := requests.get(""); n != int64(len(payload)) {
+		t.Fatalf("expected %d request bytes, got %d", len(payload), n)
+	}
+	if n := responses.get(""); n != int64(len(payload)) {
+		t.Fatalf("expected %d response bytes, got %d", len(payload), n)
+	}
+}
+
+func TestZeroCopyIdleTimeout(t *testing.T) {
+	echo := newEchoServer(t)
+	_, addr := newTestServer(t, &Config{ZeroCopy: true, IdleTimeout: 200 * time.Millisecond})
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	buf := make([]byte, 4)
+	for i := 0; i < 3; i++ {
+		time.Sleep(100 * time.Millisecond)
+		if _, err := conn.Write([]byte("ping")); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.ReadFull(conn, buf); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if _, err := conn.Read(buf); err != io.EOF {
+		t.Fatalf("expected idle tunnel to be closed, got %v", err)
+	}
+}
+
+func benchmarkRelay(b *testing.B, conf *Config) {
+	echo := newEchoServer(b)
+	_, addr := newTestServer(b, conf)
+
+	conn, err := NewClient(addr, "", "").Dial("tcp", echo.String())
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 256*1024)
+	go func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := conn.Write(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	b.SetBytes(int64(len(buf)))
+	b.ResetTimer()
+	if _, err := io.CopyN(io.Discard, conn, int64(len(buf))*int64(b.N)); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func BenchmarkRelaySimpleCopier(b *testing.B) {
+	benchmarkRelay(b, &Config{RequestCopier: proxy.NewSimpleCopier(), ResponseCopier: proxy.NewSimpleCopier()})
+}
+
+func BenchmarkRelayZeroCopy(b *testing.B) {
+	benchmarkRelay(b, &Config{ZeroCopy: true})
+}
@@ -0,0 +1,257 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/liamylian/lsocks/pkg/log"
+)
+
+var (
+	webhookCircuitOpen = fmt.Errorf("webhook circuit breaker open")
+)
+
+// WebhookConfig HTTP 鉴权配置
+type WebhookConfig struct {
+	// URL 鉴权地址，以 POST 方式发送 {"username": "...", "password": "..."}
+	// 返回 200 和 {"allow": true, "attributes": {"team": "..."}} 时鉴权成功，attributes 可选
+	// 返回 200 和 {"allow": false}，或返回 401、403 时鉴权失败，其他响应视为鉴权服务出错
+	URL string
+
+	// Header 附加的请求头，如鉴权服务要求的 Authorization
+	Header http.Header
+
+	// Timeout 请求超时时间，默认 5 秒
+	Timeout time.Duration
+
+	// PositiveTTL 鉴权成功结果缓存时间，默认 5 分钟
+	PositiveTTL time.Duration
+
+	// NegativeTTL 鉴权失败结果缓存时间，默认 30 秒
+	NegativeTTL time.Duration
+
+	// FailureThreshold 连续出错次数达到后熔断，熔断期间不再请求鉴权服务，默认 5
+	FailureThreshold int
+
+	// Cooldown 熔断时长，之后放行一个请求探测鉴权服务是否恢复，默认 30 秒
+	Cooldown time.Duration
+
+	// Client 发送请求的客户端，默认使用 Timeout 创建
+	Client *http.Client
+}
+
+// WebhookCredentials 通过 HTTP 接口鉴权的用户名密码认证
+type WebhookCredentials struct {
+	config WebhookConfig
+	salt   []byte // 缓存键中密码哈希的盐，避免明文密码留在内存中
+
+	mu        sync.Mutex
+	cache     map[string]*webhookResult
+	lastPurge time.Time
+
+	// 熔断器状态
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+type webhookResult struct {
+	allow      bool
+	attributes map[string]string
+	expires    time.Time
+}
+
+type webhookRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+type webhookResponse struct {
+	Allow      bool              `json:"allow"`
+	Attributes map[string]string `json:"attributes,omitempty"`
+}
+
+func NewWebhookCredentials(conf WebhookConfig) (*WebhookCredentials, error) {
+	if conf.URL == "" {
+		return nil, fmt.Errorf("webhook url required")
+	}
+	if conf.Timeout <= 0 {
+		conf.Timeout = 5 * time.Second
+	}
+	if conf.PositiveTTL <= 0 {
+		conf.PositiveTTL = 5 * time.Minute
+	}
+	if conf.NegativeTTL <= 0 {
+		conf.NegativeTTL = 30 * time.Second
+	}
+	if conf.FailureThreshold <= 0 {
+		conf.FailureThreshold = 5
+	}
+	if conf.Cooldown <= 0 {
+		conf.Cooldown = 30 * time.Second
+	}
+	if conf.Client == nil {
+		conf.Client = &http.Client{Timeout: conf.Timeout}
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return &WebhookCredentials{
+		config: conf,
+		salt:   salt,
+		cache:  make(map[string]*webhookResult),
+	}, nil
+}
+
+func (c *WebhookCredentials) Valid(user, password string) bool {
+	_, ok := c.ValidAttributes(user, password)
+	return ok
+}
+
+// ValidAttributes 鉴权成功时返回鉴权服务提供的用户属性
+func (c *WebhookCredentials) ValidAttributes(user, password string) (map[string]string, bool) {
+	attributes, ok, _ := c.CheckAttributes(user, password)
+	return attributes, ok
+}
+
+// CheckAttributes 鉴权成功时返回鉴权服务提供的用户属性，请求出错或熔断期间返回 CredentialsUnavailable
+func (c *WebhookCredentials) CheckAttributes(user, password string) (map[string]string, bool, error) {
+	key := c.cacheKey(user, password)
+	if result, ok := c.cached(key); ok {
+		return result.attributes, result.allow, nil
+	}
+
+	if err := c.acquire(); err != nil {
+		return nil, false, CredentialsUnavailable
+	}
+	resp, err := c.request(user, password)
+	c.release(err)
+	if err != nil {
+		log.WithError(err).Warnf("webhook auth request failed: user=%s", user)
+		return nil, false, CredentialsUnavailable
+	}
+
+	ttl := c.config.NegativeTTL
+	if resp.Allow {
+		ttl = c.config.PositiveTTL
+	}
+	c.store(key, &webhookResult{allow: resp.Allow, attributes: resp.Attributes, expires: time.Now().Add(ttl)})
+	return resp.Attributes, resp.Allow, nil
+}
+
+func (c *WebhookCredentials) request(user, password string) (*webhookResponse, error) {
+	body, err := json.Marshal(&webhookRequest{Username: user, Password: password})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range c.config.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.config.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		result := &webhookResponse{}
+		if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(result); err != nil {
+			return nil, fmt.Errorf("decode webhook response: %v", err)
+		}
+		return result, nil
+	case http.StatusUnauthorized, http.StatusForbidden:
+		return &webhookResponse{Allow: false}, nil
+	default:
+		return nil, fmt.Errorf("unexpected webhook status: %s", resp.Status)
+	}
+}
+
+// acquire 熔断期间拒绝请求，熔断结束后仅放行一个探测请求
+func (c *WebhookCredentials) acquire() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.failures < c.config.FailureThreshold {
+		return nil
+	}
+	if time.Now().Before(c.openUntil) || c.probing {
+		return webhookCircuitOpen
+	}
+	c.probing = true
+	return nil
+}
+
+// release 记录请求结果，连续出错达到阈值时熔断
+func (c *WebhookCredentials) release(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.probing = false
+	if err == nil {
+		if c.failures >= c.config.FailureThreshold {
+			log.Infof("webhook auth recovered: url=%s", c.config.URL)
+		}
+		c.failures = 0
+		return
+	}
+
+	c.failures++
+	if c.failures >= c.config.FailureThreshold {
+		c.openUntil = time.Now().Add(c.config.Cooldown)
+		if c.failures == c.config.FailureThreshold {
+			log.Errorf("webhook auth circuit open for %v after %d failures: url=%s", c.config.Cooldown, c.failures, c.config.URL)
+		}
+	}
+}
+
+func (c *WebhookCredentials) cacheKey(user, password string) string {
+	h := sha256.New()
+	h.Write(c.salt)
+	h.Write([]byte(password))
+	return user + ":" + hex.EncodeToString(h.Sum(nil))
+}
+
+func (c *WebhookCredentials) cached(key string) (*webhookResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	result, ok := c.cache[key]
+	if !ok || time.Now().After(result.expires) {
+		return nil, false
+	}
+	return result, true
+}
+
+func (c *WebhookCredentials) store(key string, result *webhookResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// 每分钟最多一次清除过期的缓存
+	now := time.Now()
+	if now.Sub(c.lastPurge) > time.Minute {
+		c.lastPurge = now
+		for k, r := range c.cache {
+			if now.After(r.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+	c.cache[key] = result
+}
@@ -0,0 +1,104 @@
+package proxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookCredentials(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		req := &webhookRequest{}
+		if err := json.NewDecoder(r.Body).Decode(req); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch {
+		case req.Username == "alice" && req.Password == "secret":
+			_ = json.NewEncoder(w).Encode(&webhookResponse{Allow: true, Attributes: map[string]string{"team": "infra"}})
+		case req.Username == "bob":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			_ = json.NewEncoder(w).Encode(&webhookResponse{Allow: false})
+		}
+	}))
+	defer server.Close()
+
+	creds, err := NewWebhookCredentials(WebhookConfig{
+		URL:    server.URL,
+		Header: http.Header{"Authorization": {"Bearer token"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	attributes, ok := ValidAttributes(creds, "alice", "secret")
+	if !ok || attributes["team"] != "infra" {
+		t.Fatalf("expected alice to be valid with attributes, got %v %v", ok, attributes)
+	}
+	if creds.Valid("alice", "wrong") || creds.Valid("bob", "secret") {
+		t.Fatal("expected wrong credentials to be invalid")
+	}
+
+	// Positive and negative results are cached
+	atomic.StoreInt32(&calls, 0)
+	creds.Valid("alice", "secret")
+	creds.Valid("alice", "wrong")
+	creds.Valid("bob", "secret")
+	if n := atomic.LoadInt32(&calls); n != 0 {
+		t.Fatalf("expected cached results, got %d calls", n)
+	}
+}
+
+func TestWebhookCircuitBreaker(t *testing.T) {
+	var calls int32
+	var healthy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			time.Sleep(50 * time.Millisecond)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(&webhookResponse{Allow: true})
+	}))
+	defer server.Close()
+
+	creds, err := NewWebhookCredentials(WebhookConfig{
+		URL:              server.URL,
+		Timeout:          10 * time.Millisecond,
+		FailureThreshold: 2,
+		Cooldown:         100 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Timeouts open the circuit after two failures
+	for i := 0; i < 4; i++ {
+		if _, ok, err := creds.CheckAttributes("alice", "secret"); ok || err != CredentialsUnavailable {
+			t.Fatalf("expected unavailable while webhook is down, got %v, %v", ok, err)
+		}
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatalf("expected 2 calls before circuit opens, got %d", n)
+	}
+
+	// After the cooldown a probe closes the circuit again
+	atomic.StoreInt32(&healthy, 1)
+	time.Sleep(150 * time.Millisecond)
+	if !creds.Valid("alice", "secret") {
+		t.Fatal("expected success after webhook recovers")
+	}
+	if !creds.Valid("carol", "secret") {
+		t.Fatal("expected circuit to be closed")
+	}
+}